@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// hashPasswordCommand prints the bcrypt hash of a password for basic_auth
+// users. On a terminal the password is prompted for twice without echo,
+// otherwise the first line of stdin is used.
+func hashPasswordCommand(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := fs.Int("cost", bcrypt.DefaultCost, fmt.Sprintf("bcrypt cost (%d-%d)", bcrypt.MinCost, bcrypt.MaxCost))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: rp hash-password [-cost n] < password\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *cost < bcrypt.MinCost || *cost > bcrypt.MaxCost {
+		fmt.Fprintf(os.Stderr, "cost must be between %d and %d\n", bcrypt.MinCost, bcrypt.MaxCost)
+		return 2
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read password: %v\n", err)
+		return 1
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(password, *cost)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to hash password: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(string(hash))
+
+	return 0
+}
+
+func readPassword() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return nil, errors.New("password is empty")
+		}
+
+		return []byte(password), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(password) == 0 {
+		return nil, errors.New("password is empty")
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(password) != string(confirm) {
+		return nil, errors.New("passwords do not match")
+	}
+
+	return password, nil
+}
@@ -8,19 +8,36 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/haadi-coder/filesize"
+	"github.com/haadi-coder/reverse-proxy/internal/admin"
 	"github.com/haadi-coder/reverse-proxy/internal/config"
 	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+	"github.com/haadi-coder/reverse-proxy/internal/systemd"
+	"github.com/haadi-coder/reverse-proxy/internal/upgrade"
 	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
-	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
 	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
 	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
 )
 
 const revision = "unknown"
 
+// commands are the subcommands of rp. Without a subcommand, rp serves the
+// config file given as argument.
+var commands = map[string]func(args []string) int{
+	"validate":      validateCommand,
+	"hash-password": hashPasswordCommand,
+	"route-test":    routeTestCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	flags := parseFlags()
 
 	if flags.version {
@@ -35,16 +52,19 @@ func main() {
 	}
 
 	setupLogger(yamlCfg)
+	logWarnings(yamlCfg)
 
-	if err := run(yamlCfg); err != nil {
+	if err := run(yamlCfg, flags); err != nil {
 		slog.Error("failed to start reverse-proxy", logger.Error(err))
 		os.Exit(1)
 	}
 }
 
 type flags struct {
-	version    bool
-	configPath string
+	version       bool
+	configPath    string
+	watch         bool
+	watchInterval time.Duration
 }
 
 func parseFlags() flags {
@@ -52,6 +72,19 @@ func parseFlags() flags {
 
 	flag.BoolVar(&f.version, "version", false, "Print appplication version (long)")
 	flag.BoolVar(&f.version, "v", false, "Print application version (short)")
+	flag.BoolVar(&f.watch, "watch", false, "Reload the configuration when the config file changes")
+	flag.DurationVar(&f.watchInterval, "watch-interval", 2*time.Second, "How often the config file is checked for changes")
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage:\n")
+		fmt.Fprintf(out, "  rp [flags] <config>        run the proxy\n")
+		fmt.Fprintf(out, "  rp validate <config>       check the config file and report every problem\n")
+		fmt.Fprintf(out, "  rp hash-password [-cost n] print a bcrypt hash for basic_auth users\n")
+		fmt.Fprintf(out, "  rp route-test <config> <url> explain how a request would be proxied\n")
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 
@@ -60,7 +93,7 @@ func parseFlags() flags {
 	return f
 }
 
-func run(yamlCfg *config.Config) error {
+func run(yamlCfg *config.Config, flags flags) error {
 	cfg, err := mapConfig(yamlCfg)
 	if err != nil {
 		return fmt.Errorf("failed to map yaml config to proxy one: %w", err)
@@ -70,38 +103,61 @@ func run(yamlCfg *config.Config) error {
 		return fmt.Errorf("failed to validate proxy config: %w", err)
 	}
 
-	slog.Info("starting proxy", slog.String("addr", cfg.Server.Listen))
-
-	p := proxy.New(cfg)
+	activation, err := systemd.Activate()
+	if err != nil {
+		return fmt.Errorf("failed to use systemd sockets: %w", err)
+	}
 
-	gMiddlewares, err := buildMiddlewares(yamlCfg.Middlewares)
+	upgrader, err := upgrade.New(activation.Listen)
 	if err != nil {
-		return fmt.Errorf("failed to build global middlewares: %w", err)
+		return fmt.Errorf("failed to inherit listeners: %w", err)
 	}
 
-	p.Use(gMiddlewares...)
+	slog.Info("starting proxy", slog.Bool("upgrade", upgrader.Inherited()))
 
-	for host, route := range yamlCfg.Routes {
-		middlewares, err := buildMiddlewares(route.Middlewares)
-		if err != nil {
-			return fmt.Errorf("failed to build route %s middlewares: %w", host, err)
-		}
+	opts := []proxy.Option{
+		proxy.WithListenFunc(upgrader.Listen),
+		proxy.WithNotifier(upgrader),
+	}
 
-		p.Route(
-			host,
-			route.Backend,
-			proxy.WithPreserveHost(route.PreserveHost),
-			proxy.WithIdleConnTimeout(route.IdleConnTimeout),
-			proxy.WithResponseHeaderTimeout(route.ResponseHeaderTimeout),
-			proxy.WithMaxIdleConns(route.MaxIdleConns),
-			proxy.WithDialTimeout(route.DialTimeout),
-			proxy.WithMiddlewares(middlewares...),
-		)
+	notifier := systemd.NewNotifier()
+	if notifier != nil {
+		opts = append(opts, proxy.WithNotifier(notifier), proxy.WithWatchdog(systemd.WatchdogInterval()))
+	}
+
+	p := proxy.New(cfg, opts...)
+
+	builder := config.NewBuilder()
+
+	if err := applyRoutes(p, yamlCfg, builder.Build); err != nil {
+		return err
+	}
+	builder.Commit()
+
+	if yamlCfg.Admin != nil && yamlCfg.Admin.Token != "" {
+		p.AdminHandle("/api/", admin.New(p, yamlCfg.Admin.Token, func(host string, route *config.RouteConfig) ([]proxy.RouteOption, error) {
+			return routeOptions(host, route, builder.Build)
+		}).Handler())
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	reloader := &reloader{
+		proxy:   p,
+		builder: builder,
+		path:    flags.configPath,
+		current: yamlCfg,
+	}
+
+	watchInterval := time.Duration(0)
+	if flags.watch {
+		watchInterval = flags.watchInterval
+	}
+
+	go reloader.run(ctx, watchInterval)
+	go handleUpgrades(ctx, cancel, upgrader, notifier)
+
 	if err := p.Run(ctx); err != nil {
 		return fmt.Errorf("failed to start proxy server: %w", err)
 	}
@@ -109,6 +165,39 @@ func run(yamlCfg *config.Config) error {
 	return nil
 }
 
+// handleUpgrades hands the listeners over to a new process on SIGUSR2. Once the
+// new process is serving, stop is called so this one drains in-flight requests
+// within the shutdown timeout and exits. The systemd notifier, if any, is told
+// about the handover so it doesn't report the service as stopping.
+func handleUpgrades(ctx context.Context, stop context.CancelFunc, upgrader *upgrade.Upgrader, notifier *systemd.Notifier) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-usr2:
+			slog.Info("received SIGUSR2, starting binary upgrade")
+
+			if err := upgrader.Upgrade(); err != nil {
+				slog.Error("binary upgrade failed, keeping current process", logger.Error(err))
+				continue
+			}
+
+			if notifier != nil {
+				notifier.HandOver()
+			}
+
+			slog.Info("binary upgrade completed, shutting down")
+			stop()
+			return
+		}
+	}
+}
+
 func mapConfig(cliCfg *config.Config) (*proxyCfg.Config, error) {
 	headersBytes, err := filesize.Parse(cliCfg.Server.MaxHeaderBytes)
 	if err != nil {
@@ -120,6 +209,11 @@ func mapConfig(cliCfg *config.Config) (*proxyCfg.Config, error) {
 		return nil, fmt.Errorf("failed to parse max_request_body: %w", err)
 	}
 
+	bufferBytes, err := filesize.Parse(cliCfg.Server.BufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buffer_size: %w", err)
+	}
+
 	cfg := &proxyCfg.Config{
 		Server: &proxyCfg.ServerConfig{
 			Listen:          cliCfg.Server.Listen,
@@ -129,6 +223,8 @@ func mapConfig(cliCfg *config.Config) (*proxyCfg.Config, error) {
 			ShutdownTimeout: cliCfg.Server.ShutdownTimeout,
 			MaxHeaderBytes:  headersBytes,
 			MaxRequestBody:  requestBodyBytes,
+			BufferSize:      bufferBytes,
+			Via:             cliCfg.Server.Via,
 		},
 		Log: &proxyCfg.LogConfig{
 			Level:  cliCfg.Log.Level,
@@ -136,12 +232,53 @@ func mapConfig(cliCfg *config.Config) (*proxyCfg.Config, error) {
 		},
 	}
 
+	for _, l := range cliCfg.Listeners {
+		listener := &proxyCfg.ListenerConfig{
+			Name:         l.Name,
+			Listen:       l.Listen,
+			ReadTimeout:  l.ReadTimeout,
+			WriteTimeout: l.WriteTimeout,
+			IdleTimeout:  l.IdleTimeout,
+			Routes:       l.Routes,
+		}
+
+		if l.TLS != nil {
+			listener.TLS = &proxyCfg.TLSConfig{
+				CertFile:   l.TLS.CertFile,
+				KeyFile:    l.TLS.KeyFile,
+				MinVersion: l.TLS.MinVersion,
+			}
+		}
+
+		cfg.Listeners = append(cfg.Listeners, listener)
+	}
+
 	if cliCfg.AccessLog != nil {
 		cfg.AccessLog = &proxyCfg.AccessLogConfig{
 			Format: accesslog.Format(cliCfg.AccessLog.Format),
 		}
 	}
 
+	if cliCfg.Admin != nil {
+		cfg.Admin = &proxyCfg.AdminConfig{
+			Listen:      cliCfg.Admin.Listen,
+			MetricsPath: cliCfg.Admin.MetricsPath,
+		}
+	}
+
+	if cliCfg.Tracing != nil {
+		cfg.Tracing = &proxyCfg.TracingConfig{
+			ServiceName:   cliCfg.Tracing.ServiceName,
+			Endpoint:      cliCfg.Tracing.Endpoint,
+			Headers:       cliCfg.Tracing.Headers,
+			SampleRatio:   cliCfg.Tracing.SampleRatio,
+			Propagators:   cliCfg.Tracing.Propagators,
+			BatchSize:     cliCfg.Tracing.BatchSize,
+			FlushInterval: cliCfg.Tracing.FlushInterval,
+			Timeout:       cliCfg.Tracing.Timeout,
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -168,17 +305,9 @@ func setupLogger(cfg *config.Config) {
 	slog.SetDefault(slog.New(handler))
 }
 
-func buildMiddlewares(mwConfigs []config.MiddlewareConfig) ([]middleware.Middleware, error) {
-	middlewares := make([]middleware.Middleware, 0, len(mwConfigs))
-
-	for _, mwCfg := range mwConfigs {
-		mw, err := mwCfg.Build()
-		if err != nil {
-			return nil, fmt.Errorf("failed to build middleware %s: %w", mwCfg.Type, err)
-		}
-
-		middlewares = append(middlewares, mw)
+// logWarnings logs the problems of the config that didn't stop it from loading.
+func logWarnings(cfg *config.Config) {
+	for _, w := range cfg.Warnings() {
+		slog.Warn("config warning", slog.String("path", w.Path), slog.Int("line", w.Line), slog.String("message", w.Message))
 	}
-
-	return middlewares, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+// reloader re-reads the config file on SIGHUP and, optionally, when the file
+// changes on disk. Routes and middlewares are rebuilt and swapped into the
+// running proxy; if anything fails the current configuration stays active.
+// Middlewares whose configuration didn't change are reused with their state.
+//
+// The config file is the source of truth: routes added, replaced or removed
+// through the admin API are reset to the file contents on reload, even if the
+// file didn't change.
+type reloader struct {
+	proxy   *proxy.Proxy
+	builder *config.Builder
+	path    string
+	current *config.Config
+}
+
+// run handles reload triggers until ctx is canceled. A zero watchInterval
+// disables watching the file, leaving SIGHUP as the only trigger.
+func (rl *reloader) run(ctx context.Context, watchInterval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if watchInterval > 0 {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	lastMod := modTime(rl.path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			slog.Info("received SIGHUP, reloading config", slog.String("path", rl.path))
+			rl.reload()
+			lastMod = modTime(rl.path)
+
+		case <-tick:
+			mod := modTime(rl.path)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+
+			slog.Info("config file changed, reloading", slog.String("path", rl.path))
+			rl.reload()
+		}
+	}
+}
+
+func (rl *reloader) reload() {
+	next, err := config.Load(rl.path)
+	if err != nil {
+		slog.Error("config reload failed, keeping current config", logger.Error(err))
+		return
+	}
+
+	logWarnings(next)
+
+	proxyCfg, err := mapConfig(next)
+	if err == nil {
+		err = proxyCfg.Validate()
+	}
+	if err != nil {
+		slog.Error("config reload failed, keeping current config", logger.Error(err))
+		return
+	}
+
+	changes := config.Diff(rl.current, next)
+	if len(changes) == 0 && !rl.proxy.RoutesModified() {
+		slog.Info("config reloaded, nothing changed")
+		return
+	}
+
+	if err := applyRoutes(rl.proxy, next, rl.builder.Build); err != nil {
+		slog.Error("config reload failed, keeping current config", logger.Error(err))
+		return
+	}
+	rl.builder.Commit()
+
+	if err := applyListenerRoutes(rl.proxy, rl.current, next); err != nil {
+		slog.Error("failed to update listener routes", logger.Error(err))
+	}
+
+	setupLogger(next)
+	rl.current = applied(rl.current, next)
+
+	for _, change := range changes {
+		slog.Info("config change", slog.String("change", change))
+	}
+	slog.Info("config reloaded", slog.Int("changes", len(changes)))
+}
+
+// applyRoutes builds the global middlewares and routes of the config and
+// swaps them into the proxy.
+func applyRoutes(p *proxy.Proxy, cfg *config.Config, build buildFunc) error {
+	middlewares, err := build("", cfg.Middlewares)
+	if err != nil {
+		return fmt.Errorf("failed to build global middlewares: %w", err)
+	}
+
+	routes, err := routeDefinitions(cfg, build)
+	if err != nil {
+		return err
+	}
+
+	return p.Reload(middlewares, routes)
+}
+
+// applyListenerRoutes updates the route lists of the running listeners, the
+// ones of the current config, that are still present in the next config.
+func applyListenerRoutes(p *proxy.Proxy, current, next *config.Config) error {
+	for _, l := range current.Listeners {
+		for _, n := range next.Listeners {
+			if l.Name != n.Name || slices.Equal(l.Routes, n.Routes) {
+				continue
+			}
+
+			if err := p.SetListenerRoutes(n.Name, n.Routes); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// applied returns the configuration that is active after reloading next: the
+// sections that need a restart keep their current values, so their changes
+// are reported again on every reload until the process is restarted.
+func applied(current, next *config.Config) *config.Config {
+	cfg := *next
+	cfg.Server = current.Server
+	cfg.AccessLog = current.AccessLog
+	cfg.Admin = current.Admin
+	cfg.Tracing = current.Tracing
+
+	cfg.Listeners = make([]*config.ListenerConfig, 0, len(current.Listeners))
+	for _, l := range current.Listeners {
+		running := *l
+		for _, n := range next.Listeners {
+			if n.Name == l.Name {
+				running.Routes = n.Routes
+			}
+		}
+		cfg.Listeners = append(cfg.Listeners, &running)
+	}
+
+	return &cfg
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+// buildFunc builds the middleware list of owner, a route host or "" for the
+// global middlewares: config.Builder.Build or dryRun.
+type buildFunc func(owner string, mws []config.MiddlewareConfig) ([]middleware.Middleware, error)
+
+// dryRun builds the middlewares with config.BuildMiddlewaresDryRun.
+func dryRun(_ string, mws []config.MiddlewareConfig) ([]middleware.Middleware, error) {
+	return config.BuildMiddlewaresDryRun(mws)
+}
+
+// routeOptions builds the route middlewares and returns the proxy options of the route.
+func routeOptions(host string, route *config.RouteConfig, build buildFunc) ([]proxy.RouteOption, error) {
+	middlewares, err := build(host, route.Middlewares)
+	if err != nil {
+		return nil, err
+	}
+
+	return []proxy.RouteOption{
+		proxy.WithPreserveHost(route.PreserveHost),
+		proxy.WithStripPrefix(route.StripPrefix),
+		proxy.WithAddPrefix(route.AddPrefix),
+		proxy.WithIdleConnTimeout(route.IdleConnTimeout),
+		proxy.WithResponseHeaderTimeout(route.ResponseHeaderTimeout),
+		proxy.WithMaxIdleConns(route.MaxIdleConns),
+		proxy.WithDialTimeout(route.DialTimeout),
+		proxy.WithMiddlewares(middlewares...),
+	}, nil
+}
+
+// routeDefinitions builds the middlewares of every route and returns the
+// routes sorted by host, ready to be passed to proxy.Reload.
+func routeDefinitions(cfg *config.Config, build buildFunc) ([]proxy.RouteDefinition, error) {
+	hosts := make([]string, 0, len(cfg.Routes))
+	for host := range cfg.Routes {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+
+	defs := make([]proxy.RouteDefinition, 0, len(hosts))
+
+	for _, host := range hosts {
+		route := cfg.Routes[host]
+
+		opts, err := routeOptions(host, route, build)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build route %s middlewares: %w", host, err)
+		}
+
+		defs = append(defs, proxy.RouteDefinition{
+			Host:    host,
+			Backend: route.Backend,
+			Options: opts,
+		})
+	}
+
+	return defs, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+// headerFlags collects repeated -H "Name: value" flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("header must be in the form \"Name: value\"")
+	}
+
+	*h = append(*h, v)
+	return nil
+}
+
+// routeTestCommand explains how the proxy would handle a synthetic request:
+// the matched route, the middleware chain, the middleware that answers the
+// request itself, or the upstream URL and headers. Backends are not contacted.
+func routeTestCommand(args []string) int {
+	var headers headerFlags
+
+	fs := flag.NewFlagSet("route-test", flag.ExitOnError)
+	method := fs.String("X", http.MethodGet, "request method")
+	remoteIP := fs.String("remote-ip", "127.0.0.1", "client IP address")
+	listener := fs.String("listener", "", "only consider routes of this listener")
+	fs.Var(&headers, "H", "request header \"Name: value\", can be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: rp route-test [flags] <config> <url>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	// Only problems are worth printing, the output is the explanation.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	p, err := dryRunProxy(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	r, err := http.NewRequest(*method, fs.Arg(1), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid request: %v\n", err)
+		return 2
+	}
+
+	r.RemoteAddr = net.JoinHostPort(*remoteIP, "50000")
+	r.RequestURI = r.URL.RequestURI()
+
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		if strings.EqualFold(name, "Host") {
+			r.Host = value
+			continue
+		}
+		r.Header.Add(name, value)
+	}
+
+	exp, err := p.Explain(r, *listener)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	printExplanation(r, exp)
+
+	if exp.Route == "" {
+		return 1
+	}
+
+	return 0
+}
+
+// dryRunProxy builds the routes of the config file on a proxy that is never
+// started. Tracing is disabled so no spans are exported, and middlewares with
+// side effects are skipped so explaining a request counts, fetches and stores
+// nothing.
+func dryRunProxy(path string) (*proxy.Proxy, error) {
+	yamlCfg, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load yaml config: %w", err)
+	}
+
+	cfg, err := mapConfig(yamlCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map yaml config to proxy one: %w", err)
+	}
+	cfg.Tracing = nil
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate proxy config: %w", err)
+	}
+
+	p := proxy.New(cfg)
+	if err := applyRoutes(p, yamlCfg, dryRun); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func printExplanation(r *http.Request, exp *proxy.Explanation) {
+	fmt.Printf("Request:      %s %s (host %s)\n", r.Method, r.URL.RequestURI(), r.Host)
+
+	if exp.Route == "" {
+		fmt.Printf("Route:        none, the proxy responds with %d\n", exp.Status)
+		return
+	}
+
+	fmt.Printf("Route:        %s -> %s\n", exp.Route, exp.Backend)
+
+	chain := make([]string, 0, len(exp.Middlewares))
+	for _, t := range exp.Middlewares {
+		chain = append(chain, string(t))
+	}
+	if len(chain) == 0 {
+		chain = append(chain, "none")
+	}
+	fmt.Printf("Middlewares:  %s\n", strings.Join(chain, " -> "))
+
+	if len(exp.Skipped) > 0 {
+		skipped := make([]string, 0, len(exp.Skipped))
+		for _, t := range exp.Skipped {
+			skipped = append(skipped, string(t))
+		}
+		fmt.Printf("Skipped:      %s (side effects, assumed to pass)\n", strings.Join(skipped, ", "))
+	}
+
+	if exp.StoppedBy != "" {
+		fmt.Printf("Result:       stopped by %s with %d %s\n", exp.StoppedBy, exp.Status, http.StatusText(exp.Status))
+		printHeaders("Response headers", exp.Header)
+		return
+	}
+
+	fmt.Printf("Result:       forwarded to backend\n")
+	fmt.Printf("Upstream:     %s %s (host %s)\n", exp.Upstream.Method, exp.Upstream.URL, exp.Upstream.Host)
+	printHeaders("Upstream headers", exp.Upstream.Header)
+}
+
+func printHeaders(title string, h http.Header) {
+	if len(h) == 0 {
+		return
+	}
+
+	fmt.Printf("%s:\n", title)
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Printf("  %s: %s\n", name, v)
+		}
+	}
+}
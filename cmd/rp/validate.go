@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+)
+
+// validateCommand checks a config file without starting the proxy. Every
+// problem is printed as "file:line:column: path: message" and the exit code is
+// non-zero if there is any error, so it can be used in CI pipelines. Warnings
+// are printed too but don't fail the check.
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: rp validate <config>\n")
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+
+	problems, err := config.Check(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	var errs int
+	for _, p := range problems {
+		if !p.Warning {
+			errs++
+		}
+	}
+
+	// The proxy config is only validated once the file itself is valid. Check
+	// covers its rules with locations, this is what the proxy would run.
+	if errs == 0 {
+		if problem := validateProxyConfig(path); problem != nil {
+			problems = append(problems, *problem)
+			errs++
+		}
+	}
+
+	for _, p := range problems {
+		location := path
+		if p.Line > 0 {
+			location = fmt.Sprintf("%s:%d", path, p.Line)
+		}
+		if p.Column > 0 {
+			location = fmt.Sprintf("%s:%d", location, p.Column)
+		}
+
+		if p.Warning {
+			location += ": warning"
+		}
+
+		fmt.Fprintf(os.Stderr, "%s: %s\n", location, p.Error())
+	}
+
+	if errs > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", errs)
+		return 1
+	}
+
+	fmt.Printf("%s: ok\n", path)
+
+	return 0
+}
+
+func validateProxyConfig(path string) *config.Problem {
+	yamlCfg, err := config.Load(path)
+	if err != nil {
+		return &config.Problem{Message: err.Error()}
+	}
+
+	proxyCfg, err := mapConfig(yamlCfg)
+	if err == nil {
+		err = proxyCfg.Validate()
+	}
+	if err != nil {
+		return &config.Problem{Message: err.Error()}
+	}
+
+	return nil
+}
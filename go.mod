@@ -6,14 +6,10 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/haadi-coder/filesize v0.0.0-20250714125257-edcf44796703
 	github.com/hashicorp/golang-lru/v2 v2.0.7
-	github.com/ilyakaznacheev/cleanenv v1.5.0
 	golang.org/x/crypto v0.42.0
+	golang.org/x/term v0.35.0
 	golang.org/x/time v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	olympos.io/encoding/edn v0.0.0-20201019073823-d3554ca0b0a3 // indirect
-)
+require golang.org/x/sys v0.36.0 // indirect
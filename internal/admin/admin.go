@@ -0,0 +1,185 @@
+// Package admin implements the HTTP API for runtime inspection and route
+// management. It is served on the admin listener of the proxy.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+const maxBodyBytes = 1 << 20
+
+// RouteOptionsFunc builds the proxy options, including the middlewares, of a
+// route added through the API.
+type RouteOptionsFunc func(host string, route *config.RouteConfig) ([]proxy.RouteOption, error)
+
+type API struct {
+	proxy        *proxy.Proxy
+	token        string
+	routeOptions RouteOptionsFunc
+}
+
+func New(p *proxy.Proxy, token string, routeOptions RouteOptionsFunc) *API {
+	return &API{proxy: p, token: token, routeOptions: routeOptions}
+}
+
+// Handler returns the API handler. Every endpoint requires the
+// "Authorization: Bearer <token>" header.
+//
+//	GET    /api/routes                  list routes with middlewares, backend and health
+//	GET    /api/routes/{host}           show a single route
+//	PUT    /api/routes/{host}           add or replace a route (YAML or JSON route config)
+//	DELETE /api/routes/{host}           remove a route
+//	GET    /api/health                  health status of every route backend
+//	POST   /api/backends/drain?backend= stop sending new requests to a backend
+//	DELETE /api/backends/drain?backend= resume sending requests to a backend
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/routes", a.listRoutes)
+	mux.HandleFunc("GET /api/routes/{host}", a.getRoute)
+	mux.HandleFunc("PUT /api/routes/{host}", a.putRoute)
+	mux.HandleFunc("DELETE /api/routes/{host}", a.deleteRoute)
+	mux.HandleFunc("GET /api/health", a.health)
+	mux.HandleFunc("POST /api/backends/drain", a.drain(true))
+	mux.HandleFunc("DELETE /api/backends/drain", a.drain(false))
+
+	return a.authenticate(mux)
+}
+
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) listRoutes(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.Routes())
+}
+
+func (a *API) getRoute(w http.ResponseWriter, r *http.Request) {
+	route, ok := a.findRoute(r.PathValue("host"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (a *API) putRoute(w http.ResponseWriter, r *http.Request) {
+	host := r.PathValue("host")
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to read body: %s", err))
+		return
+	}
+
+	routeCfg, err := config.ParseRoute(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	opts, err := a.routeOptions(host, routeCfg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, existed := a.findRoute(host)
+
+	if err := a.proxy.Route(host, routeCfg.Backend, opts...); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	route, _ := a.findRoute(host)
+
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+
+	writeJSON(w, status, route)
+}
+
+func (a *API) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	if !a.proxy.RemoveRoute(r.PathValue("host")) {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) health(w http.ResponseWriter, _ *http.Request) {
+	health := make(map[string]proxy.HealthStatus)
+	for _, route := range a.proxy.Routes() {
+		health[route.Host] = route.Health
+	}
+
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (a *API) drain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backend := r.URL.Query().Get("backend")
+		if backend == "" {
+			writeError(w, http.StatusBadRequest, "backend query parameter is required")
+			return
+		}
+
+		affected := a.proxy.DrainBackend(backend, drain)
+		if affected == 0 {
+			writeError(w, http.StatusNotFound, "no route uses this backend")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"backend":  backend,
+			"draining": drain,
+			"routes":   affected,
+		})
+	}
+}
+
+func (a *API) findRoute(host string) (proxy.RouteInfo, bool) {
+	for _, route := range a.proxy.Routes() {
+		if strings.EqualFold(route.Host, host) {
+			return route, true
+		}
+	}
+
+	return proxy.RouteInfo{}, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode admin response", logger.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
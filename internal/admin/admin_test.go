@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haadi-coder/reverse-proxy/internal/config"
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+const testToken = "secret"
+
+func newTestAPI(t *testing.T) http.Handler {
+	t.Helper()
+
+	p := proxy.New(&proxyCfg.Config{Server: &proxyCfg.ServerConfig{}})
+	if err := p.Reload(nil, []proxy.RouteDefinition{{Host: "web.example.com", Backend: "http://10.0.0.1:8080"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return New(p, testToken, func(_ string, route *config.RouteConfig) ([]proxy.RouteOption, error) {
+		middlewares, err := config.BuildMiddlewares(route.Middlewares)
+		if err != nil {
+			return nil, err
+		}
+
+		return []proxy.RouteOption{proxy.WithMiddlewares(middlewares...)}, nil
+	}).Handler()
+}
+
+func do(handler http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestAuthentication(t *testing.T) {
+	handler := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "missing", status: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "other scheme", header: "Basic " + testToken, status: http.StatusUnauthorized},
+		{name: "token prefix", header: "Bearer " + testToken[:3], status: http.StatusUnauthorized},
+		{name: "valid", header: "Bearer " + testToken, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/routes", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRouteManagement(t *testing.T) {
+	handler := newTestAPI(t)
+
+	route := "backend: http://10.0.0.2:8080\nmiddlewares:\n  - type: request_id\n"
+
+	if w := do(handler, http.MethodPut, "/api/routes/api.example.com", testToken, route); w.Code != http.StatusCreated {
+		t.Fatalf("add: status %d, body %s", w.Code, w.Body)
+	}
+
+	// Replacing an existing route answers 200, JSON is accepted too.
+	if w := do(handler, http.MethodPut, "/api/routes/api.example.com", testToken, `{"backend": "http://10.0.0.3:8080"}`); w.Code != http.StatusOK {
+		t.Fatalf("replace: status %d, body %s", w.Code, w.Body)
+	}
+
+	w := do(handler, http.MethodGet, "/api/routes/api.example.com", testToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: status %d", w.Code)
+	}
+
+	var info proxy.RouteInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Backend != "http://10.0.0.3:8080" || len(info.Middlewares) != 0 {
+		t.Errorf("got backend %s with middlewares %v", info.Backend, info.Middlewares)
+	}
+
+	if w := do(handler, http.MethodPut, "/api/routes/bad.example.com", testToken, "backend: http://10.0.0.2\nbackend_url: typo\n"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status %d", w.Code)
+	}
+
+	if w := do(handler, http.MethodDelete, "/api/routes/api.example.com", testToken, ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: status %d", w.Code)
+	}
+	if w := do(handler, http.MethodDelete, "/api/routes/api.example.com", testToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d", w.Code)
+	}
+	if w := do(handler, http.MethodGet, "/api/routes/api.example.com", testToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete: status %d", w.Code)
+	}
+
+	var routes []proxy.RouteInfo
+	if err := json.NewDecoder(do(handler, http.MethodGet, "/api/routes", testToken, "").Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Host != "web.example.com" {
+		t.Errorf("got routes %+v, want only the initial one", routes)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "yaml", data: "backend: http://10.0.0.1:8080\nstrip_prefix: /api\n"},
+		{name: "json", data: `{"backend": "http://10.0.0.1:8080", "preserve_host": true}`},
+		{name: "unknown field", data: "backend: http://10.0.0.1:8080\nstrip_prefixes: /api\n", wantErr: "unknown field strip_prefixes"},
+		{name: "unknown middleware field", data: "backend: http://10.0.0.1:8080\nmiddlewares:\n  - type: request_id\n    header: X-ID\n", wantErr: "unknown field header"},
+		{name: "missing backend", data: "strip_prefix: /api\n", wantErr: "backend"},
+		{name: "empty", data: "", wantErr: "backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, err := config.ParseRoute([]byte(tt.data))
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if route.Backend != "http://10.0.0.1:8080" {
+					t.Errorf("backend %q", route.Backend)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package config
 
+import (
+	"slices"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
+)
+
 type AccessLogConfig struct {
 	Format string `yaml:"format,omitempty"`
 }
@@ -11,3 +17,10 @@ func (c *AccessLogConfig) applyDefaults() {
 		}
 	}
 }
+
+func (c *AccessLogConfig) check(p *problems, path yamlPath) {
+	formats := []string{string(accesslog.CommonFormat), string(accesslog.JSONFormat), string(accesslog.CombinedFormat)}
+	if c != nil && !slices.Contains(formats, c.Format) {
+		p.add(path.key("format"), "invalid format: %s (must be common, json or combined)", c.Format)
+	}
+}
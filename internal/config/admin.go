@@ -0,0 +1,33 @@
+package config
+
+import "strings"
+
+type AdminConfig struct {
+	Listen      string `yaml:"listen"`
+	MetricsPath string `yaml:"metrics_path"`
+	Token       string `yaml:"token"` // Bearer token for the admin API. The API is disabled when empty.
+}
+
+func (c *AdminConfig) applyDefaults() {
+	if c != nil {
+		if c.MetricsPath == "" {
+			c.MetricsPath = "/metrics"
+		}
+	}
+}
+
+func (c *AdminConfig) check(p *problems, path yamlPath) {
+	if c == nil {
+		return
+	}
+
+	if c.Listen == "" {
+		p.add(path.key("listen"), "listen is required")
+	}
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		p.add(path.key("metrics_path"), "metrics_path must start with /")
+	}
+	if c.Token == "" {
+		p.warn(path.key("token"), "the admin API is disabled without a token")
+	}
+}
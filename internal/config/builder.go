@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// Builder builds middlewares and keeps them across config reloads. A
+// middleware whose owner, the route host or "" for the global ones, and
+// configuration didn't change is reused instead of built again, so its state
+// survives the reload: rate limit buckets, forward_auth decisions, cached
+// responses and fetched keys.
+type Builder struct {
+	mu    sync.Mutex
+	built map[string]middleware.Middleware
+	used  map[string]bool // built or reused since the last Commit
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		built: make(map[string]middleware.Middleware),
+		used:  make(map[string]bool),
+	}
+}
+
+// Build builds the middlewares of owner like BuildMiddlewares, reusing the
+// ones built before with the same configuration.
+func (b *Builder) Build(owner string, mwConfigs []MiddlewareConfig) ([]middleware.Middleware, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	middlewares := make([]middleware.Middleware, 0, len(mwConfigs))
+	occurrences := make(map[string]int)
+
+	for _, mwCfg := range mwConfigs {
+		data, err := yaml.Marshal(mwCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode middleware %s: %w", mwCfg.Type, err)
+		}
+
+		// Identical middlewares of one owner still get an instance each.
+		key := fmt.Sprintf("%s\x00%d\x00%s", owner, occurrences[string(data)], data)
+		occurrences[string(data)]++
+
+		mw, ok := b.built[key]
+		if !ok {
+			mw, err = mwCfg.Build()
+			if err != nil {
+				return nil, fmt.Errorf("failed to build middleware %s: %w", mwCfg.Type, err)
+			}
+			b.built[key] = mw
+		}
+		b.used[key] = true
+
+		middlewares = append(middlewares, mw)
+	}
+
+	return middlewares, nil
+}
+
+// Commit forgets the middlewares that weren't built since the previous
+// Commit. It is called once the built middlewares are in use, so the ones of
+// the previous configuration can be garbage collected.
+func (b *Builder) Commit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key := range b.built {
+		if !b.used[key] {
+			delete(b.built, key)
+		}
+	}
+
+	clear(b.used)
+}
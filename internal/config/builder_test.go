@@ -0,0 +1,66 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuilderReuse(t *testing.T) {
+	limit := MiddlewareConfig{Type: typeRateLimit, RatelimitConfig: RatelimitConfig{Requests: 10, Window: time.Minute}}
+	limit.ApplyDefaults()
+
+	changed := limit
+	changed.Requests = 20
+
+	b := NewBuilder()
+
+	first, err := b.Build("api.example.com", []MiddlewareConfig{limit, limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0] == first[1] {
+		t.Error("two identical middlewares of a route share an instance")
+	}
+	b.Commit()
+
+	// A reload with the same configuration keeps the instances.
+	second, err := b.Build("api.example.com", []MiddlewareConfig{limit, limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second[0] != first[0] || second[1] != first[1] {
+		t.Error("unchanged middlewares were built again")
+	}
+
+	// Other owners and changed configurations get their own instances.
+	other, err := b.Build("web.example.com", []MiddlewareConfig{limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other[0] == first[0] {
+		t.Error("two routes share a middleware instance")
+	}
+
+	third, err := b.Build("api.example.com", []MiddlewareConfig{changed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third[0] == first[0] {
+		t.Error("a changed middleware was reused")
+	}
+	b.Commit()
+
+	// A reload that drops the second middleware; it is forgotten by Commit.
+	if _, err := b.Build("api.example.com", []MiddlewareConfig{limit}); err != nil {
+		t.Fatal(err)
+	}
+	b.Commit()
+
+	fourth, err := b.Build("api.example.com", []MiddlewareConfig{limit, limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fourth[0] != first[0] || fourth[1] == first[1] {
+		t.Error("Commit kept the wrong middlewares")
+	}
+}
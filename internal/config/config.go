@@ -1,24 +1,42 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 
-	"github.com/ilyakaznacheev/cleanenv"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Server      *ServerConfig           `yaml:"server"`
+	Listeners   []*ListenerConfig       `yaml:"listeners,omitempty"`
 	Log         *LogConfig              `yaml:"log"`
 	AccessLog   *AccessLogConfig        `yaml:"access_log,omitempty"`
+	Admin       *AdminConfig            `yaml:"admin,omitempty"`
+	Tracing     *TracingConfig          `yaml:"tracing,omitempty"`
 	Routes      map[string]*RouteConfig `yaml:"routes"`
-	Middlewares []MiddlewareConfig      `yaml:"middlewares,omitempty"`
+	Middlewares Middlewares             `yaml:"middlewares,omitempty"`
+
+	warnings []Problem
 }
 
 func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
 	var cfg Config
 
-	if err := cleanenv.ReadConfig(path, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+	unknown, err := decode(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
 	cfg.applyDefaults()
@@ -27,15 +45,66 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to validate config: %w", err)
 	}
 
+	cfg.warnings = append(unknown, cfg.warnings...)
+
 	return &cfg, nil
 }
 
+var unknownFieldRe = regexp.MustCompile(`^line (\d+): field (.+) not found in type`)
+
+// decode decodes the YAML document into cfg, a Config or a RouteConfig.
+// Unknown fields don't stop the decoding, they are returned as warnings: a
+// typo in an option name is reported, but a config written for a newer
+// version still loads.
+func decode(data []byte, cfg any) ([]Problem, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err := dec.Decode(cfg)
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return nil, err
+	}
+
+	var unknown []Problem
+	var errs []string
+
+	for _, msg := range typeErr.Errors {
+		m := unknownFieldRe.FindStringSubmatch(msg)
+		if m == nil {
+			errs = append(errs, msg)
+			continue
+		}
+
+		line, _ := strconv.Atoi(m[1])
+		unknown = append(unknown, Problem{Line: line, Message: "unknown field " + m[2], Warning: true})
+	}
+
+	if len(errs) > 0 {
+		return unknown, &yaml.TypeError{Errors: errs}
+	}
+
+	return unknown, nil
+}
+
 func (c *Config) applyDefaults() {
 	if c.Server == nil {
 		c.Server = &ServerConfig{}
 	}
 	c.Server.applyDefaults()
 
+	for i, l := range c.Listeners {
+		if l == nil {
+			l = &ListenerConfig{}
+			c.Listeners[i] = l
+		}
+		l.applyDefaults()
+	}
+
 	if c.Log == nil {
 		c.Log = new(LogConfig)
 	}
@@ -45,8 +114,20 @@ func (c *Config) applyDefaults() {
 		c.AccessLog.applyDefaults()
 	}
 
-	for host := range c.Routes {
-		c.Routes[host].applyDefaults()
+	if c.Admin != nil {
+		c.Admin.applyDefaults()
+	}
+
+	if c.Tracing != nil {
+		c.Tracing.applyDefaults()
+	}
+
+	for host, route := range c.Routes {
+		if route == nil {
+			route = &RouteConfig{}
+			c.Routes[host] = route
+		}
+		route.applyDefaults()
 	}
 
 	for i := range c.Middlewares {
@@ -54,29 +135,80 @@ func (c *Config) applyDefaults() {
 	}
 }
 
+// Warnings returns the problems found by Load that didn't stop the config
+// from loading.
+func (c *Config) Warnings() []Problem {
+	return c.warnings
+}
+
 func (c *Config) validate() error {
+	var p problems
+	c.check(&p)
+
+	c.warnings = p.warnings()
+
+	return p.err()
+}
+
+func (c *Config) check(p *problems) {
+	c.Server.check(p, yamlPath{"server"})
+	c.Log.check(p, yamlPath{"log"})
+	c.AccessLog.check(p, yamlPath{"access_log"})
+	c.Tracing.check(p, yamlPath{"tracing"})
+
 	if len(c.Routes) == 0 {
-		return fmt.Errorf("failed to validate routes. There must be at least one route")
+		p.add(yamlPath{"routes"}, "there must be at least one route")
 	}
 
-	for host, route := range c.Routes {
-		if err := route.validate(); err != nil {
-			return fmt.Errorf("failed to validate route for %s: %w", host, err)
-		}
+	hosts := make([]string, 0, len(c.Routes))
+	for host := range c.Routes {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+
+	for _, host := range hosts {
+		c.Routes[host].check(p, yamlPath{"routes", host})
+	}
+
+	if len(c.Listeners) > 0 && c.Server.Listen != "" {
+		p.add(yamlPath{"server", "listen"}, "server.listen can't be used together with listeners")
 	}
+	if len(c.Listeners) == 0 && c.Server.Listen == "" {
+		p.add(yamlPath{"server", "listen"}, "listen is required")
+	}
+
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	for i, l := range c.Listeners {
+		path := yamlPath{"listeners"}.index(i)
 
-	mwTypes := make(map[string]bool)
-	for _, mw := range c.Middlewares {
-		if mwTypes[mw.Type] {
-			return fmt.Errorf("duplicate middleware: %s", mw.Type)
+		// Names default to the address, so a duplicate address is reported once.
+		if names[l.Name] {
+			p.add(path.key("name"), "duplicate listener: %s", l.Name)
+		} else if l.Listen != "" && addrs[l.Listen] {
+			p.add(path.key("listen"), "duplicate listener address: %s", l.Listen)
 		}
+		names[l.Name] = true
+		addrs[l.Listen] = true
+
+		l.check(p, path, c.Routes)
+	}
+
+	c.Admin.check(p, yamlPath{"admin"})
 
-		mwTypes[mw.Type] = true
+	checkMiddlewares(p, yamlPath{"middlewares"}, c.Middlewares)
 
-		if err := mw.Validate(); err != nil {
-			return fmt.Errorf("failed to validate middleware %s: %w", mw.Type, err)
+	// Global middlewares run before the ones of the routes, so a global
+	// cache would serve responses without the routes' authentication.
+	for i, mw := range c.Middlewares {
+		if mw.Type == typeCache {
+			p.add(yamlPath{"middlewares"}.index(i).key("type"), "cache can't be a global middleware, add it to the routes after their authentication")
 		}
 	}
 
-	return nil
+	reported := make(map[string]bool)
+	for _, host := range hosts {
+		chain := mergedChain(c.Middlewares, yamlPath{"middlewares"}, c.Routes[host].Middlewares, yamlPath{"routes", host, "middlewares"})
+		checkChain(p, chain, reported)
+	}
 }
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Diff describes what changed between two configurations, one human readable
+// line per change. Changes marked "(restart required)" are not applied by a reload.
+func Diff(old, new *Config) []string {
+	var changes []string
+
+	if !reflect.DeepEqual(old.Server, new.Server) {
+		changes = append(changes, "server settings changed (restart required)")
+	}
+	if !reflect.DeepEqual(listenerSettings(old.Listeners), listenerSettings(new.Listeners)) {
+		changes = append(changes, "listeners changed (restart required)")
+	}
+	changes = append(changes, diffListenerRoutes(old.Listeners, new.Listeners)...)
+	if !reflect.DeepEqual(old.AccessLog, new.AccessLog) {
+		changes = append(changes, "access_log settings changed (restart required)")
+	}
+	if !reflect.DeepEqual(old.Admin, new.Admin) {
+		changes = append(changes, "admin settings changed (restart required)")
+	}
+	if !reflect.DeepEqual(old.Tracing, new.Tracing) {
+		changes = append(changes, "tracing settings changed (restart required)")
+	}
+	if !reflect.DeepEqual(old.Log, new.Log) {
+		changes = append(changes, fmt.Sprintf("log settings changed: level %s -> %s, format %s -> %s",
+			old.Log.Level, new.Log.Level, old.Log.Format, new.Log.Format))
+	}
+
+	if !reflect.DeepEqual(old.Middlewares, new.Middlewares) {
+		changes = append(changes, fmt.Sprintf("global middlewares changed: %v -> %v",
+			middlewareTypes(old.Middlewares), middlewareTypes(new.Middlewares)))
+	}
+
+	hosts := make([]string, 0, len(old.Routes)+len(new.Routes))
+	for host := range old.Routes {
+		hosts = append(hosts, host)
+	}
+	for host := range new.Routes {
+		if _, ok := old.Routes[host]; !ok {
+			hosts = append(hosts, host)
+		}
+	}
+	slices.Sort(hosts)
+
+	for _, host := range hosts {
+		oldRoute, inOld := old.Routes[host]
+		newRoute, inNew := new.Routes[host]
+
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("route %s added (backend %s)", host, newRoute.Backend))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("route %s removed", host))
+		default:
+			changes = append(changes, diffRoute(host, oldRoute, newRoute)...)
+		}
+	}
+
+	return changes
+}
+
+func diffRoute(host string, old, new *RouteConfig) []string {
+	var changes []string
+
+	if old.Backend != new.Backend {
+		changes = append(changes, fmt.Sprintf("route %s backend changed: %s -> %s", host, old.Backend, new.Backend))
+	}
+
+	if !reflect.DeepEqual(old.Middlewares, new.Middlewares) {
+		changes = append(changes, fmt.Sprintf("route %s middlewares changed: %v -> %v",
+			host, middlewareTypes(old.Middlewares), middlewareTypes(new.Middlewares)))
+	}
+
+	oldSettings, newSettings := *old, *new
+	oldSettings.Backend, newSettings.Backend = "", ""
+	oldSettings.Middlewares, newSettings.Middlewares = nil, nil
+
+	if !reflect.DeepEqual(oldSettings, newSettings) {
+		changes = append(changes, fmt.Sprintf("route %s settings changed", host))
+	}
+
+	return changes
+}
+
+// listenerSettings returns copies of the listeners without their route lists,
+// which are applied by a reload.
+func listenerSettings(listeners []*ListenerConfig) []ListenerConfig {
+	settings := make([]ListenerConfig, 0, len(listeners))
+	for _, l := range listeners {
+		c := *l
+		c.Routes = nil
+		settings = append(settings, c)
+	}
+
+	return settings
+}
+
+// diffListenerRoutes reports the route list changes of listeners that exist
+// in both configurations.
+func diffListenerRoutes(old, new []*ListenerConfig) []string {
+	var changes []string
+
+	for _, n := range new {
+		for _, o := range old {
+			if o.Name == n.Name && !slices.Equal(o.Routes, n.Routes) {
+				changes = append(changes, fmt.Sprintf("listener %s routes changed: %v -> %v", n.Name, o.Routes, n.Routes))
+			}
+		}
+	}
+
+	return changes
+}
+
+func middlewareTypes(mws []MiddlewareConfig) []string {
+	types := make([]string, 0, len(mws))
+	for _, mw := range mws {
+		types = append(types, mw.Type)
+	}
+
+	return types
+}
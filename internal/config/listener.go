@@ -0,0 +1,61 @@
+package config
+
+import "time"
+
+// ListenerConfig is an entrypoint of the proxy. Timeouts that are not set are
+// taken from the server section.
+type ListenerConfig struct {
+	Name         string        `yaml:"name"`
+	Listen       string        `yaml:"listen"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	TLS          *TLSConfig    `yaml:"tls,omitempty"`
+	Routes       []string      `yaml:"routes,omitempty"` // Route hosts served by the listener, all when empty.
+}
+
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+}
+
+func (c *ListenerConfig) applyDefaults() {
+	if c.Name == "" {
+		c.Name = c.Listen
+	}
+
+	if c.TLS != nil && c.TLS.MinVersion == "" {
+		c.TLS.MinVersion = "1.2"
+	}
+}
+
+func (c *ListenerConfig) check(p *problems, path yamlPath, routes map[string]*RouteConfig) {
+	if c.Listen == "" {
+		p.add(path.key("listen"), "listen is required")
+	}
+
+	checkNonNegative(p, path.key("read_timeout"), c.ReadTimeout)
+	checkNonNegative(p, path.key("write_timeout"), c.WriteTimeout)
+	checkNonNegative(p, path.key("idle_timeout"), c.IdleTimeout)
+
+	if c.TLS != nil {
+		tlsPath := path.key("tls")
+
+		if c.TLS.CertFile == "" {
+			p.add(tlsPath.key("cert_file"), "cert_file is required")
+		}
+		if c.TLS.KeyFile == "" {
+			p.add(tlsPath.key("key_file"), "key_file is required")
+		}
+		if c.TLS.MinVersion != "1.2" && c.TLS.MinVersion != "1.3" {
+			p.add(tlsPath.key("min_version"), "unsupported min_version %q, must be 1.2 or 1.3", c.TLS.MinVersion)
+		}
+	}
+
+	for i, host := range c.Routes {
+		if _, ok := routes[host]; !ok {
+			p.add(path.key("routes").index(i), "unknown route %s", host)
+		}
+	}
+}
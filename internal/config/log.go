@@ -1,6 +1,10 @@
 package config
 
-import proxy "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+import (
+	"slices"
+
+	proxy "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
 
 type LogConfig struct {
 	Level  proxy.LogLevel  `yaml:"level"`
@@ -15,3 +19,15 @@ func (c *LogConfig) applyDefaults() {
 		c.Format = "text"
 	}
 }
+
+func (c *LogConfig) check(p *problems, path yamlPath) {
+	levels := []proxy.LogLevel{proxy.LogLevelDebug, proxy.LogLevelInfo, proxy.LogLevelWarn, proxy.LogLevelError}
+	if !slices.Contains(levels, c.Level) {
+		p.add(path.key("level"), "invalid level: %s (must be debug, info, warn or error)", c.Level)
+	}
+
+	formats := []proxy.LogFormat{proxy.LogFormatText, proxy.LogFormatJSON}
+	if !slices.Contains(formats, c.Format) {
+		p.add(path.key("format"), "invalid format: %s (must be text or json)", c.Format)
+	}
+}
@@ -1,44 +1,276 @@
 package config
 
 import (
+	"bytes"
+	"crypto"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"regexp"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/haadi-coder/filesize"
 	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	typeRateLimit       = "rate_limit"
-	typeBasicAuth       = "basic_auth"
-	typeCORS            = "cors"
-	typeHeaders         = "headers"
-	typeCompress        = "compress"
-	typeRequestID       = "request_id"
-	typeSecurityHeaders = "security_headers"
+	typeRateLimit        = "rate_limit"
+	typeBasicAuth        = "basic_auth"
+	typeCORS             = "cors"
+	typeHeaders          = "headers"
+	typeCompress         = "compress"
+	typeRequestID        = "request_id"
+	typeSecurityHeaders  = "security_headers"
+	typeRedirect         = "redirect"
+	typeRewrite          = "rewrite"
+	typeJWT              = "jwt"
+	typeForwardAuth      = "forward_auth"
+	typeOIDC             = "oidc"
+	typeAPIKey           = "api_key"
+	typeIPFilter         = "ip_filter"
+	typeConcurrencyLimit = "concurrency_limit"
+	typeCache            = "cache"
 )
 
+// authTypes are the middlewares that authenticate requests.
+var authTypes = []string{typeBasicAuth, typeJWT, typeForwardAuth, typeOIDC, typeAPIKey}
+
+// minCookieSecretLen is the minimum length of the oidc cookie_secret, which
+// the session encryption key is derived from.
+const minCookieSecretLen = 32
+
+// MiddlewareConfig is a middleware of the chain. Only the options of its type
+// are decoded, see UnmarshalYAML.
 type MiddlewareConfig struct {
-	Type                  string `yaml:"type"`
-	RatelimitConfig       `yaml:",inline"`
-	BasicAuthConfig       `yaml:",inline"`
-	CORSConfig            `yaml:",inline"`
-	HeadersConfig         `yaml:",inline"`
-	RequestIDConfig       `yaml:",inline"`
-	SecurityHeadersConfig `yaml:",inline"`
-	CompressConfig        `yaml:",inline"`
+	Type                   string `yaml:"type"`
+	RatelimitConfig        `yaml:"-"`
+	BasicAuthConfig        `yaml:"-"`
+	CORSConfig             `yaml:"-"`
+	HeadersConfig          `yaml:"-"`
+	RequestIDConfig        `yaml:"-"`
+	SecurityHeadersConfig  `yaml:"-"`
+	CompressConfig         `yaml:"-"`
+	RewriteConfig          `yaml:"-"`
+	JWTConfig              `yaml:"-"`
+	ForwardAuthConfig      `yaml:"-"`
+	OIDCConfig             `yaml:"-"`
+	APIKeyConfig           `yaml:"-"`
+	IPFilterConfig         `yaml:"-"`
+	ConcurrencyLimitConfig `yaml:"-"`
+	CacheConfig            `yaml:"-"`
+}
+
+// options returns the options of the middleware type, or nil for an unknown
+// type.
+func (c *MiddlewareConfig) options() any {
+	switch c.Type {
+	case typeRateLimit:
+		return &c.RatelimitConfig
+	case typeBasicAuth:
+		return &c.BasicAuthConfig
+	case typeCORS:
+		return &c.CORSConfig
+	case typeHeaders:
+		return &c.HeadersConfig
+	case typeRequestID:
+		return &c.RequestIDConfig
+	case typeSecurityHeaders:
+		return &c.SecurityHeadersConfig
+	case typeCompress:
+		return &c.CompressConfig
+	case typeRedirect, typeRewrite:
+		return &c.RewriteConfig
+	case typeJWT:
+		return &c.JWTConfig
+	case typeForwardAuth:
+		return &c.ForwardAuthConfig
+	case typeOIDC:
+		return &c.OIDCConfig
+	case typeAPIKey:
+		return &c.APIKeyConfig
+	case typeIPFilter:
+		return &c.IPFilterConfig
+	case typeConcurrencyLimit:
+		return &c.ConcurrencyLimitConfig
+	case typeCache:
+		return &c.CacheConfig
+	}
+
+	return nil
+}
+
+// UnmarshalYAML decodes the type and then only the options of that type, so
+// middlewares can use the same option names without sharing them. Options of
+// other types are unknown fields.
+func (c *MiddlewareConfig) UnmarshalYAML(node *yaml.Node) error {
+	var head struct {
+		Type string `yaml:"type"`
+	}
+	if err := node.Decode(&head); err != nil {
+		return err
+	}
+	c.Type = head.Type
+
+	opts := c.options()
+	if opts == nil {
+		return nil
+	}
+
+	// Node.Decode doesn't report unknown fields, they are reported here in the
+	// format of a decoder with KnownFields set.
+	known := yamlKeys(reflect.TypeOf(opts).Elem())
+
+	var errs []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if key.Value != "type" && !known[key.Value] {
+			errs = append(errs, fmt.Sprintf("line %d: field %s not found in type %T", key.Line, key.Value, opts))
+		}
+	}
+
+	if err := node.Decode(opts); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return err
+		}
+		errs = append(errs, typeErr.Errors...)
+	}
+
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+
+	return nil
+}
+
+// Middlewares is a middleware chain.
+type Middlewares []MiddlewareConfig
+
+// UnmarshalYAML decodes the middlewares one by one. Unlike a plain slice, it
+// keeps a middleware that had decoding errors, so it is still checked and
+// unknown fields stay warnings.
+func (m *Middlewares) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return node.Decode((*[]MiddlewareConfig)(m))
+	}
+
+	*m = make(Middlewares, len(node.Content))
+
+	var errs []string
+	for i, n := range node.Content {
+		err := (*m)[i].UnmarshalYAML(n)
+
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			errs = append(errs, typeErr.Errors...)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+
+	return nil
 }
 
+// MarshalYAML encodes the type and the options of that type.
+func (c MiddlewareConfig) MarshalYAML() (any, error) {
+	var node yaml.Node
+
+	if opts := c.options(); opts != nil {
+		if err := node.Encode(opts); err != nil {
+			return nil, err
+		}
+	} else {
+		node.Kind = yaml.MappingNode
+	}
+
+	typeNodes := []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "type"},
+		{Kind: yaml.ScalarNode, Value: c.Type},
+	}
+	node.Content = append(typeNodes, node.Content...)
+
+	return &node, nil
+}
+
+// yamlKeys returns the keys of the fields of a struct type.
+func yamlKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool, t.NumField())
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		if key != "-" {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// RatelimitConfig configures the rate_limit middleware. The key combines
+// parts with "+", e.g. "ip+path" or "header:X-Tenant+user".
 type RatelimitConfig struct {
+	Requests       int                                `yaml:"requests"`
+	Window         time.Duration                      `yaml:"window"`
+	Burst          int                                `yaml:"burst"`
+	Key            string                             `yaml:"key"`
+	Overrides      map[string]RateLimitOverrideConfig `yaml:"overrides"`
+	CacheSize      int                                `yaml:"cache_size"`
+	CacheTTL       time.Duration                      `yaml:"cache_ttl"`
+	Store          *RateLimitStoreConfig              `yaml:"store"`
+	TrustedProxies []string                           `yaml:"trusted_proxies"`
+}
+
+// RateLimitStoreConfig selects where rate_limit keeps its state. The memory
+// store limits every proxy instance on its own, the redis store shares the
+// limits between instances.
+type RateLimitStoreConfig struct {
+	Type        string        `yaml:"type"`
+	Address     string        `yaml:"address"`
+	Password    string        `yaml:"password"`
+	DB          int           `yaml:"db"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Prefix      string        `yaml:"prefix"`
+	FailureMode string        `yaml:"failure_mode"`
+}
+
+const (
+	storeMemory = "memory"
+	storeRedis  = "redis"
+
+	failureOpen   = "open"
+	failureClosed = "closed"
+)
+
+// RateLimitOverrideConfig is the limit of a single API consumer, used with
+// a key containing `consumer` or `api_key`.
+type RateLimitOverrideConfig struct {
 	Requests int           `yaml:"requests"`
 	Window   time.Duration `yaml:"window"`
 	Burst    int           `yaml:"burst"`
 }
 
 type BasicAuthConfig struct {
-	Users map[string]string `yaml:"users"`
-	Realm string            `yaml:"realm"`
+	Users              map[string]string `yaml:"users"`
+	UsersFile          string            `yaml:"users_file"`
+	Realm              string            `yaml:"realm"`
+	StripAuthorization bool              `yaml:"strip_authorization"`
+	UserHeader         string            `yaml:"user_header"`
 }
 
 type CORSConfig struct {
@@ -78,11 +310,139 @@ type SecurityHeadersConfig struct {
 	PermissionsPolicy  string `yaml:"permissions_policy"`
 }
 
+// RewriteConfig configures the redirect and rewrite middlewares.
+type RewriteConfig struct {
+	Rules          []RewriteRuleConfig `yaml:"rules"`
+	TrustedProxies []string            `yaml:"trusted_proxies"`
+}
+
+// JWTConfig configures the jwt middleware.
+type JWTConfig struct {
+	Realm          string              `yaml:"realm"`
+	Algorithms     []string            `yaml:"algorithms"`
+	Secret         string              `yaml:"secret"`
+	SecretFile     string              `yaml:"secret_file"`
+	KeyFiles       []string            `yaml:"key_files"`
+	JWKSURL        string              `yaml:"jwks_url"`
+	JWKSRefresh    time.Duration       `yaml:"jwks_refresh"`
+	Issuer         string              `yaml:"issuer"`
+	Audience       []string            `yaml:"audience"`
+	ClockSkew      time.Duration       `yaml:"clock_skew"`
+	RequiredClaims map[string][]string `yaml:"required_claims"`
+	ForwardClaims  map[string]string   `yaml:"forward_claims"`
+}
+
+// ForwardAuthConfig configures the forward_auth middleware.
+type ForwardAuthConfig struct {
+	URL             string        `yaml:"url"`
+	RequestHeaders  []string      `yaml:"request_headers"`
+	ResponseHeaders []string      `yaml:"response_headers"`
+	Timeout         time.Duration `yaml:"timeout"`
+	CacheTTL        time.Duration `yaml:"cache_ttl"`
+	TrustedProxies  []string      `yaml:"trusted_proxies"`
+}
+
+// OIDCConfig configures the oidc middleware.
+type OIDCConfig struct {
+	Issuer                string            `yaml:"issuer"`
+	ClientID              string            `yaml:"client_id"`
+	ClientSecret          string            `yaml:"client_secret"`
+	RedirectURL           string            `yaml:"redirect_url"`
+	LogoutPath            string            `yaml:"logout_path"`
+	PostLogoutRedirectURL string            `yaml:"post_logout_redirect_url"`
+	Scopes                []string          `yaml:"scopes"`
+	CookieName            string            `yaml:"cookie_name"`
+	CookieSecret          string            `yaml:"cookie_secret"`
+	SessionTTL            time.Duration     `yaml:"session_ttl"`
+	AllowedEmails         []string          `yaml:"allowed_emails"`
+	AllowedGroups         []string          `yaml:"allowed_groups"`
+	GroupsClaim           string            `yaml:"groups_claim"`
+	ClockSkew             time.Duration     `yaml:"clock_skew"`
+	ForwardClaims         map[string]string `yaml:"forward_claims"`
+	TrustedProxies        []string          `yaml:"trusted_proxies"`
+}
+
+// APIKeyConfig configures the api_key middleware. Keys are given as hex
+// encoded SHA-256 hashes, e.g. from `printf %s "$KEY" | sha256sum`.
+type APIKeyConfig struct {
+	HeaderName string            `yaml:"header_name"`
+	QueryParam string            `yaml:"query_param"`
+	Keys       map[string]string `yaml:"keys"`
+	KeysFile   string            `yaml:"keys_file"`
+}
+
+// IPFilterConfig configures the ip_filter middleware. Networks are given as
+// CIDRs or single IP addresses.
+type IPFilterConfig struct {
+	Allow        []string      `yaml:"allow"`
+	Deny         []string      `yaml:"deny"`
+	AllowFiles   []string      `yaml:"allow_files"`
+	DenyFiles    []string      `yaml:"deny_files"`
+	FilesRefresh time.Duration `yaml:"files_refresh"`
+
+	// TrustedProxies are the proxies whose X-Forwarded-For and
+	// X-Forwarded-Proto headers are believed, see middleware.ClientIP. The
+	// other middlewares that look at the client IP or the scheme take the
+	// same `trusted_proxies` option.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	DenyStatus int    `yaml:"deny_status"`
+	DenyBody   string `yaml:"deny_body"`
+}
+
+// ConcurrencyLimitConfig configures the concurrency_limit middleware. With
+// adaptive set, the limit moves between min_limit and max_in_flight
+// depending on the backend latency.
+type ConcurrencyLimitConfig struct {
+	MaxInFlight      int           `yaml:"max_in_flight"`
+	QueueSize        int           `yaml:"queue_size"`
+	QueueTimeout     time.Duration `yaml:"queue_timeout"`
+	Adaptive         bool          `yaml:"adaptive"`
+	MinLimit         int           `yaml:"min_limit"`
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+}
+
+// CacheConfig configures the cache middleware. Sizes are given like
+// "64MB"; the disk tier is enabled by setting disk_dir.
+type CacheConfig struct {
+	MaxSize              string        `yaml:"max_size"`
+	MaxEntrySize         string        `yaml:"max_entry_size"`
+	DiskDir              string        `yaml:"disk_dir"`
+	DiskMaxSize          string        `yaml:"disk_max_size"`
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+	TrustedProxies       []string      `yaml:"trusted_proxies"`
+}
+
+type RewriteRuleConfig struct {
+	Match         string   `yaml:"match"`
+	Replacement   string   `yaml:"replacement"`
+	Hosts         []string `yaml:"hosts"`
+	Schemes       []string `yaml:"schemes"`
+	StatusCode    int      `yaml:"status_code"`
+	PreserveQuery bool     `yaml:"preserve_query"`
+}
+
 func (c *MiddlewareConfig) ApplyDefaults() {
 	switch c.Type {
+	case typeRateLimit:
+		if c.Key == "" {
+			c.Key = middleware.RateLimitKeyIP
+		}
+		if c.CacheSize == 0 {
+			c.CacheSize = 10000
+		}
+		if c.RatelimitConfig.CacheTTL == 0 {
+			c.RatelimitConfig.CacheTTL = max(15*time.Minute, c.Window)
+		}
+		if c.Store == nil {
+			c.Store = &RateLimitStoreConfig{}
+		}
+		c.Store.applyDefaults()
+
 	case typeBasicAuth:
-		if c.Realm == "" {
-			c.Realm = "Restricted"
+		if c.BasicAuthConfig.Realm == "" {
+			c.BasicAuthConfig.Realm = "Restricted"
 		}
 
 	case typeCORS:
@@ -115,8 +475,13 @@ func (c *MiddlewareConfig) ApplyDefaults() {
 		}
 
 	case typeRequestID:
-		if c.HeaderName == "" {
-			c.HeaderName = "X-Request-ID"
+		if c.RequestIDConfig.HeaderName == "" {
+			c.RequestIDConfig.HeaderName = "X-Request-ID"
+		}
+
+	case typeAPIKey:
+		if c.APIKeyConfig.HeaderName == "" {
+			c.APIKeyConfig.HeaderName = "X-API-Key"
 		}
 
 	case typeSecurityHeaders:
@@ -132,81 +497,672 @@ func (c *MiddlewareConfig) ApplyDefaults() {
 		if c.ReferrerPolicy == "" {
 			c.ReferrerPolicy = "strict-origin-when-cross-origin"
 		}
+
+	case typeJWT:
+		if c.JWTConfig.Realm == "" {
+			c.JWTConfig.Realm = "Restricted"
+		}
+		if len(c.Algorithms) == 0 {
+			if c.Secret != "" || c.SecretFile != "" {
+				c.Algorithms = append(c.Algorithms, middleware.AlgHS256)
+			}
+			if len(c.KeyFiles) > 0 || c.JWKSURL != "" {
+				c.Algorithms = append(c.Algorithms, middleware.AlgRS256, middleware.AlgES256, middleware.AlgEdDSA)
+			}
+		}
+		if c.JWKSRefresh == 0 {
+			c.JWKSRefresh = time.Hour
+		}
+		if c.JWTConfig.ClockSkew == 0 {
+			c.JWTConfig.ClockSkew = 30 * time.Second
+		}
+
+	case typeForwardAuth:
+		if c.RequestHeaders == nil {
+			c.RequestHeaders = []string{"Authorization", "Cookie"}
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 5 * time.Second
+		}
+
+	case typeOIDC:
+		if c.RedirectURL == "" {
+			c.RedirectURL = "/oauth2/callback"
+		}
+		if c.LogoutPath == "" {
+			c.LogoutPath = "/oauth2/logout"
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "email", "profile"}
+		}
+		if c.CookieName == "" {
+			c.CookieName = "_rp_oidc"
+		}
+		if c.SessionTTL == 0 {
+			c.SessionTTL = 24 * time.Hour
+		}
+		if c.OIDCConfig.ClockSkew == 0 {
+			c.OIDCConfig.ClockSkew = 30 * time.Second
+		}
+		if c.GroupsClaim == "" {
+			c.GroupsClaim = "groups"
+		}
+		if c.OIDCConfig.ForwardClaims == nil {
+			c.OIDCConfig.ForwardClaims = map[string]string{
+				"sub":   "X-Forwarded-User",
+				"email": "X-Forwarded-Email",
+			}
+		}
+
+	case typeIPFilter:
+		if c.FilesRefresh == 0 {
+			c.FilesRefresh = 30 * time.Second
+		}
+		if c.DenyStatus == 0 {
+			c.DenyStatus = http.StatusForbidden
+		}
+		if c.DenyBody == "" {
+			c.DenyBody = http.StatusText(c.DenyStatus)
+		}
+
+	case typeConcurrencyLimit:
+		if c.QueueTimeout == 0 {
+			c.QueueTimeout = time.Second
+		}
+		if c.MinLimit == 0 {
+			c.MinLimit = 1
+		}
+
+	case typeCache:
+		if c.MaxSize == "" {
+			c.MaxSize = "64MB"
+		}
+		if c.MaxEntrySize == "" {
+			c.MaxEntrySize = "1MB"
+		}
+		if c.DiskDir != "" && c.DiskMaxSize == "" {
+			c.DiskMaxSize = "1GB"
+		}
+
+	case typeRedirect:
+		for i := range c.Rules {
+			if c.Rules[i].StatusCode == 0 {
+				c.Rules[i].StatusCode = http.StatusMovedPermanently
+			}
+		}
+	}
+}
+
+// checkMiddlewares validates a middleware list. With problems.files set, the
+// files of middlewares without problems are also read and parsed.
+func checkMiddlewares(p *problems, path yamlPath, mws []MiddlewareConfig) {
+	mwTypes := make(map[string]bool)
+
+	for i, mw := range mws {
+		mwPath := path.index(i)
+
+		if mwTypes[mw.Type] {
+			p.add(mwPath.key("type"), "duplicate middleware: %s", mw.Type)
+		}
+		mwTypes[mw.Type] = true
+
+		before := len(p.list)
+		mw.check(p, mwPath)
+
+		if p.files && len(p.list) == before {
+			mw.checkFiles(p, mwPath)
+		}
+	}
+
+	// Cached responses are served without passing the rest of the chain.
+	if i := slices.IndexFunc(mws, func(mw MiddlewareConfig) bool { return mw.Type == typeCache }); i >= 0 {
+		for _, mw := range mws[i+1:] {
+			if slices.Contains(authTypes, mw.Type) {
+				p.add(path.index(i).key("type"), "cache must come after the %s middleware, cached responses skip the rest of the chain", mw.Type)
+			}
+		}
 	}
 }
 
-func (c *MiddlewareConfig) Validate() error {
+// chainEntry is a middleware of the chain a route runs, with its location in
+// the config.
+type chainEntry struct {
+	path yamlPath
+	mw   *MiddlewareConfig
+}
+
+// mergedChain returns the middlewares a route runs in order, merged like
+// proxy.mergeMiddlewares does: a route middleware replaces the global one of
+// the same type in place, the other route middlewares run after the global ones.
+func mergedChain(global []MiddlewareConfig, globalPath yamlPath, route []MiddlewareConfig, routePath yamlPath) []chainEntry {
+	routeByType := make(map[string]int, len(route))
+	for i := range route {
+		routeByType[route[i].Type] = i
+	}
+
+	chain := make([]chainEntry, 0, len(global)+len(route))
+
+	for i := range global {
+		if j, ok := routeByType[global[i].Type]; ok {
+			chain = append(chain, chainEntry{path: routePath.index(j), mw: &route[j]})
+			delete(routeByType, global[i].Type)
+		} else {
+			chain = append(chain, chainEntry{path: globalPath.index(i), mw: &global[i]})
+		}
+	}
+
+	for i := range route {
+		if _, ok := routeByType[route[i].Type]; ok {
+			chain = append(chain, chainEntry{path: routePath.index(i), mw: &route[i]})
+		}
+	}
+
+	return chain
+}
+
+// checkChain validates the order of the middlewares a route runs. A problem
+// of a global middleware is reported once, even if several routes run it.
+func checkChain(p *problems, chain []chainEntry, reported map[string]bool) {
+	add := func(path yamlPath, format string, args ...any) {
+		if !reported[path.String()] {
+			reported[path.String()] = true
+			p.add(path, format, args...)
+		}
+	}
+
+	var apiKey bool
+
+	for _, e := range chain {
+		switch e.mw.Type {
+		case typeAPIKey:
+			apiKey = true
+		case typeRateLimit:
+			// Without the consumer the limiter would silently fall back to
+			// the client IP.
+			keyParts, _ := middleware.ParseRateLimitKey(e.mw.Key)
+			for _, part := range keyParts {
+				if (part == middleware.RateLimitKeyConsumer || part == middleware.RateLimitKeyAPIKey) && !apiKey {
+					add(e.path.key("key"), "rate_limit key %s requires an api_key middleware running before it", part)
+				}
+			}
+		}
+	}
+}
+
+func (c *MiddlewareConfig) check(p *problems, path yamlPath) {
 	types := []string{
 		typeBasicAuth, typeCORS, typeCompress, typeHeaders,
-		typeRateLimit, typeRequestID, typeSecurityHeaders,
+		typeRateLimit, typeRequestID, typeSecurityHeaders, typeRedirect,
+		typeRewrite, typeJWT, typeForwardAuth, typeOIDC, typeAPIKey, typeIPFilter,
+		typeConcurrencyLimit, typeCache,
 	}
 
 	if !slices.Contains(types, c.Type) {
-		return fmt.Errorf("unknown type of middleware: %s", c.Type)
+		p.add(path.key("type"), "unknown type of middleware: %s", c.Type)
+		return
 	}
 
 	switch c.Type {
 	case typeRateLimit:
 		if c.Requests <= 0 {
-			return fmt.Errorf("rate_limit requests must be greater then 0")
+			p.add(path.key("requests"), "rate_limit requests must be greater then 0")
 		}
 		if c.Window <= 0 {
-			return fmt.Errorf("rate_limit window must be greater then 0")
+			p.add(path.key("window"), "rate_limit window must be greater then 0")
 		}
 		if c.Burst < 0 {
-			return fmt.Errorf("rate_limit burst can't be negative")
+			p.add(path.key("burst"), "rate_limit burst can't be negative")
+		}
+
+		keyParts, err := middleware.ParseRateLimitKey(c.Key)
+		if err != nil {
+			p.add(path.key("key"), "invalid rate_limit key: %s", err)
+		} else if len(c.Overrides) > 0 &&
+			!slices.Contains(keyParts, middleware.RateLimitKeyConsumer) &&
+			!slices.Contains(keyParts, middleware.RateLimitKeyAPIKey) {
+			p.add(path.key("overrides"), "rate_limit overrides require a key with consumer or api_key")
+		}
+
+		if c.CacheSize <= 0 {
+			p.add(path.key("cache_size"), "rate_limit cache_size must be greater then 0")
+		}
+		// A limiter dropped before its window passed would start over with a
+		// full bucket.
+		if c.RatelimitConfig.CacheTTL < c.Window {
+			p.add(path.key("cache_ttl"), "rate_limit cache_ttl must be at least the window")
+		}
+
+		checkPrefixes(p, path.key("trusted_proxies"), c.RatelimitConfig.TrustedProxies)
+
+		if c.Store != nil {
+			c.Store.check(p, path.key("store"))
+		}
+
+		// The redis store uses a sliding window, which has no burst.
+		redis := c.Store != nil && c.Store.Type == storeRedis
+		if redis && c.Burst != 0 {
+			p.add(path.key("burst"), "rate_limit burst is not supported by the redis store")
+		}
+
+		for _, consumer := range slices.Sorted(maps.Keys(c.Overrides)) {
+			override := c.Overrides[consumer]
+			overridePath := path.key("overrides").key(consumer)
+
+			if override.Requests <= 0 {
+				p.add(overridePath.key("requests"), "rate_limit requests must be greater then 0")
+			}
+			if override.Window <= 0 {
+				p.add(overridePath.key("window"), "rate_limit window must be greater then 0")
+			}
+			if override.Burst < 0 {
+				p.add(overridePath.key("burst"), "rate_limit burst can't be negative")
+			}
+			if redis && override.Burst != 0 {
+				p.add(overridePath.key("burst"), "rate_limit burst is not supported by the redis store")
+			}
 		}
 
 	case typeBasicAuth:
-		if len(c.Users) == 0 {
-			return fmt.Errorf("basic_auth users is required")
+		if len(c.Users) == 0 && c.UsersFile == "" {
+			p.add(path.key("users"), "basic_auth requires users or users_file")
 		}
 
-		for user, hash := range c.Users {
-			if !isBcryptHash(hash) {
-				return fmt.Errorf("basic_auth invalid bcrypt hash for user `%s`", user)
+		for _, user := range slices.Sorted(maps.Keys(c.Users)) {
+			if err := middleware.CheckBcryptHash(c.Users[user]); err != nil {
+				p.add(path.key("users").key(user), "basic_auth invalid bcrypt hash for user `%s`: %s", user, err)
 			}
 		}
 
 	case typeCORS:
 		if len(c.AllowedOrigins) == 0 {
-			return fmt.Errorf("cors allowed_origins is required")
+			p.add(path.key("allowed_origins"), "cors allowed_origins is required")
 		}
 		if c.MaxAge < 0 {
-			return fmt.Errorf("cors max_age can't be negative")
+			p.add(path.key("max_age"), "cors max_age can't be negative")
 		}
 
 	case typeCompress:
 		if c.MinSize < 0 {
-			return fmt.Errorf("compress min_size can't be negative")
+			p.add(path.key("min_size"), "compress min_size can't be negative")
 		}
 		if c.Level < 1 || c.Level > 9 {
-			return fmt.Errorf("compress level must be between 1 and 9")
+			p.add(path.key("level"), "compress level must be between 1 and 9")
+		}
+
+	case typeJWT:
+		if c.Secret == "" && c.SecretFile == "" && len(c.KeyFiles) == 0 && c.JWKSURL == "" {
+			p.add(path, "jwt requires secret, secret_file, key_files or jwks_url")
+		}
+		if c.Secret != "" && c.SecretFile != "" {
+			p.add(path.key("secret_file"), "jwt secret and secret_file can't be used together")
+		}
+
+		algorithms := []string{middleware.AlgHS256, middleware.AlgRS256, middleware.AlgES256, middleware.AlgEdDSA}
+		for i, alg := range c.Algorithms {
+			if !slices.Contains(algorithms, alg) {
+				p.add(path.key("algorithms").index(i), "unsupported jwt algorithm %s (must be HS256, RS256, ES256 or EdDSA)", alg)
+			}
+		}
+		if slices.Contains(c.Algorithms, middleware.AlgHS256) && c.Secret == "" && c.SecretFile == "" {
+			p.add(path.key("algorithms"), "jwt HS256 requires secret or secret_file")
+		}
+
+		if c.JWKSURL != "" && !isUrl(c.JWKSURL) {
+			p.add(path.key("jwks_url"), "invalid jwks_url: %s", c.JWKSURL)
+		}
+		if c.JWKSRefresh <= 0 {
+			p.add(path.key("jwks_refresh"), "jwt jwks_refresh must be greater then 0")
+		}
+		if c.JWTConfig.ClockSkew < 0 {
+			p.add(path.key("clock_skew"), "jwt clock_skew can't be negative")
+		}
+
+	case typeForwardAuth:
+		if c.URL == "" {
+			p.add(path.key("url"), "forward_auth url is required")
+		} else if !isUrl(c.URL) {
+			p.add(path.key("url"), "invalid url: %s", c.URL)
+		}
+		if c.Timeout <= 0 {
+			p.add(path.key("timeout"), "forward_auth timeout must be greater then 0")
+		}
+		if c.ForwardAuthConfig.CacheTTL < 0 {
+			p.add(path.key("cache_ttl"), "forward_auth cache_ttl can't be negative")
+		}
+
+		checkPrefixes(p, path.key("trusted_proxies"), c.ForwardAuthConfig.TrustedProxies)
+
+	case typeOIDC:
+		if c.OIDCConfig.Issuer == "" {
+			p.add(path.key("issuer"), "oidc issuer is required")
+		} else if !isUrl(c.OIDCConfig.Issuer) {
+			p.add(path.key("issuer"), "invalid issuer: %s", c.OIDCConfig.Issuer)
+		}
+		if c.ClientID == "" {
+			p.add(path.key("client_id"), "oidc client_id is required")
+		}
+		if len(c.CookieSecret) < minCookieSecretLen {
+			p.add(path.key("cookie_secret"), "oidc cookie_secret must be at least %d characters long", minCookieSecretLen)
+		}
+		if !slices.Contains(c.Scopes, "openid") {
+			p.add(path.key("scopes"), "oidc scopes must contain openid")
+		}
+
+		if !strings.HasPrefix(c.RedirectURL, "/") && !isUrl(c.RedirectURL) {
+			p.add(path.key("redirect_url"), "invalid redirect_url: %s (must be a URL or a path)", c.RedirectURL)
+		}
+		if c.PostLogoutRedirectURL != "" && !strings.HasPrefix(c.PostLogoutRedirectURL, "/") && !isUrl(c.PostLogoutRedirectURL) {
+			p.add(path.key("post_logout_redirect_url"), "invalid post_logout_redirect_url: %s (must be a URL or a path)", c.PostLogoutRedirectURL)
 		}
+		if !strings.HasPrefix(c.LogoutPath, "/") {
+			p.add(path.key("logout_path"), "oidc logout_path must start with /")
+		}
+
+		if c.SessionTTL <= 0 {
+			p.add(path.key("session_ttl"), "oidc session_ttl must be greater then 0")
+		}
+		if c.OIDCConfig.ClockSkew < 0 {
+			p.add(path.key("clock_skew"), "oidc clock_skew can't be negative")
+		}
+
+		checkPrefixes(p, path.key("trusted_proxies"), c.OIDCConfig.TrustedProxies)
+
+	case typeAPIKey:
+		if len(c.Keys) == 0 && c.KeysFile == "" {
+			p.add(path, "api_key requires keys or keys_file")
+		}
+
+		for _, consumer := range slices.Sorted(maps.Keys(c.Keys)) {
+			if err := middleware.CheckAPIKeyHash(c.Keys[consumer]); err != nil {
+				p.add(path.key("keys").key(consumer), "api_key invalid key for consumer `%s`: %s", consumer, err)
+			}
+		}
+
+	case typeIPFilter:
+		if len(c.Allow) == 0 && len(c.Deny) == 0 && len(c.AllowFiles) == 0 && len(c.DenyFiles) == 0 {
+			p.add(path, "ip_filter requires allow, deny, allow_files or deny_files")
+		}
+
+		checkPrefixes(p, path.key("allow"), c.Allow)
+		checkPrefixes(p, path.key("deny"), c.Deny)
+		checkPrefixes(p, path.key("trusted_proxies"), c.IPFilterConfig.TrustedProxies)
+
+		if c.FilesRefresh <= 0 {
+			p.add(path.key("files_refresh"), "ip_filter files_refresh must be greater then 0")
+		}
+		if c.DenyStatus < 400 || c.DenyStatus > 599 {
+			p.add(path.key("deny_status"), "ip_filter deny_status must be between 400 and 599")
+		}
+
+	case typeConcurrencyLimit:
+		if c.MaxInFlight <= 0 {
+			p.add(path.key("max_in_flight"), "concurrency_limit max_in_flight must be greater then 0")
+		}
+		if c.QueueSize < 0 {
+			p.add(path.key("queue_size"), "concurrency_limit queue_size can't be negative")
+		}
+		if c.QueueTimeout <= 0 {
+			p.add(path.key("queue_timeout"), "concurrency_limit queue_timeout must be greater then 0")
+		}
+
+		if c.Adaptive {
+			if c.LatencyThreshold <= 0 {
+				p.add(path.key("latency_threshold"), "concurrency_limit adaptive requires latency_threshold")
+			}
+			if c.MinLimit < 1 || c.MinLimit > c.MaxInFlight {
+				p.add(path.key("min_limit"), "concurrency_limit min_limit must be between 1 and max_in_flight")
+			}
+		}
+
+	case typeCache:
+		c.checkCache(p, path)
+
+	case typeRedirect, typeRewrite:
+		if len(c.Rules) == 0 {
+			p.add(path.key("rules"), "%s rules is required", c.Type)
+		}
+
+		for i, rule := range c.Rules {
+			rule.check(p, path.key("rules").index(i), c.Type)
+		}
+
+		checkPrefixes(p, path.key("trusted_proxies"), c.RewriteConfig.TrustedProxies)
 	}
+}
 
-	return nil
+// checkFiles reads and parses the files of the middleware the same way Build
+// does.
+func (c *MiddlewareConfig) checkFiles(p *problems, path yamlPath) {
+	switch c.Type {
+	case typeBasicAuth:
+		checkFile(p, path.key("users_file"), c.UsersFile, func(data []byte) error {
+			_, err := middleware.ParseHtpasswd(data)
+			return err
+		})
+
+	case typeJWT:
+		checkFile(p, path.key("secret_file"), c.SecretFile, nil)
+		for i, file := range c.KeyFiles {
+			checkFile(p, path.key("key_files").index(i), file, func(data []byte) error {
+				_, err := middleware.ParsePublicKey(data)
+				return err
+			})
+		}
+
+	case typeAPIKey:
+		checkFile(p, path.key("keys_file"), c.KeysFile, func(data []byte) error {
+			_, err := middleware.ParseAPIKeys(data)
+			return err
+		})
+
+	case typeIPFilter:
+		parse := func(data []byte) error {
+			_, err := middleware.ParseIPList(data)
+			return err
+		}
+		for i, file := range c.AllowFiles {
+			checkFile(p, path.key("allow_files").index(i), file, parse)
+		}
+		for i, file := range c.DenyFiles {
+			checkFile(p, path.key("deny_files").index(i), file, parse)
+		}
+	}
 }
 
-func isBcryptHash(hash string) bool {
-	return strings.HasPrefix(hash, "$2a") ||
-		strings.HasPrefix(hash, "$2b") ||
-		strings.HasPrefix(hash, "$2y")
+// checkFile reads the file and, if parse is set, parses its contents. An
+// empty file name is skipped.
+func checkFile(p *problems, path yamlPath, file string, parse func(data []byte) error) {
+	if file == "" {
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		p.add(path, "failed to read file: %s", err)
+		return
+	}
+
+	if parse != nil {
+		if err := parse(data); err != nil {
+			p.add(path, "invalid file %s: %s", file, err)
+		}
+	}
+}
+
+func (c *RateLimitStoreConfig) applyDefaults() {
+	if c.Type == "" {
+		c.Type = storeMemory
+	}
+
+	if c.Type == storeRedis {
+		if c.Address == "" {
+			c.Address = "127.0.0.1:6379"
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 200 * time.Millisecond
+		}
+		if c.Prefix == "" {
+			c.Prefix = "rp:ratelimit:"
+		}
+		if c.FailureMode == "" {
+			c.FailureMode = failureOpen
+		}
+	}
+}
+
+func (c *RateLimitStoreConfig) check(p *problems, path yamlPath) {
+	switch c.Type {
+	case storeMemory:
+	case storeRedis:
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			p.add(path.key("address"), "invalid redis address %s: %s", c.Address, err)
+		}
+		if c.DB < 0 {
+			p.add(path.key("db"), "redis db can't be negative")
+		}
+		if c.Timeout <= 0 {
+			p.add(path.key("timeout"), "redis timeout must be greater then 0")
+		}
+		if c.FailureMode != failureOpen && c.FailureMode != failureClosed {
+			p.add(path.key("failure_mode"), "invalid failure_mode: %s (must be open or closed)", c.FailureMode)
+		}
+	default:
+		p.add(path.key("type"), "invalid store type: %s (must be memory or redis)", c.Type)
+	}
+}
+
+func (c *MiddlewareConfig) checkCache(p *problems, path yamlPath) {
+	maxSize, err := filesize.Parse(c.MaxSize)
+	if err != nil {
+		p.add(path.key("max_size"), "invalid size %q: %s", c.MaxSize, err)
+	} else if maxSize <= 0 {
+		p.add(path.key("max_size"), "cache max_size must be greater then 0")
+	}
+
+	maxEntrySize, err := filesize.Parse(c.MaxEntrySize)
+	if err != nil {
+		p.add(path.key("max_entry_size"), "invalid size %q: %s", c.MaxEntrySize, err)
+	} else if maxEntrySize <= 0 {
+		p.add(path.key("max_entry_size"), "cache max_entry_size must be greater then 0")
+	} else if maxSize > 0 && maxEntrySize > maxSize {
+		p.add(path.key("max_entry_size"), "cache max_entry_size can't be larger than max_size")
+	}
+
+	if c.DiskDir != "" {
+		diskMaxSize, err := filesize.Parse(c.DiskMaxSize)
+		if err != nil {
+			p.add(path.key("disk_max_size"), "invalid size %q: %s", c.DiskMaxSize, err)
+		} else if diskMaxSize < maxEntrySize {
+			p.add(path.key("disk_max_size"), "cache disk_max_size can't be smaller than max_entry_size")
+		}
+	}
+
+	checkNonNegative(p, path.key("stale_while_revalidate"), c.StaleWhileRevalidate)
+	checkNonNegative(p, path.key("stale_if_error"), c.StaleIfError)
+
+	checkPrefixes(p, path.key("trusted_proxies"), c.CacheConfig.TrustedProxies)
+}
+
+func checkPrefixes(p *problems, path yamlPath, cidrs []string) {
+	for i, cidr := range cidrs {
+		if _, err := middleware.ParsePrefix(cidr); err != nil {
+			p.add(path.index(i), "invalid network %s: %s", cidr, err)
+		}
+	}
+}
+
+func (c *RewriteRuleConfig) check(p *problems, path yamlPath, mwType string) {
+	if c.Match == "" {
+		p.add(path.key("match"), "match is required")
+	} else if _, err := regexp.Compile(c.Match); err != nil {
+		p.add(path.key("match"), "invalid match regexp: %s", err)
+	}
+	if c.Replacement == "" {
+		p.add(path.key("replacement"), "replacement is required")
+	}
+
+	for i, scheme := range c.Schemes {
+		if scheme != "http" && scheme != "https" {
+			p.add(path.key("schemes").index(i), "invalid scheme: %s (must be http or https)", scheme)
+		}
+	}
+
+	if mwType == typeRedirect {
+		codes := []int{
+			http.StatusMovedPermanently, http.StatusFound,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect,
+		}
+		if !slices.Contains(codes, c.StatusCode) {
+			p.add(path.key("status_code"), "status_code must be 301, 302, 307 or 308")
+		}
+	}
 }
 
 func (c *MiddlewareConfig) Build() (middleware.Middleware, error) {
 	switch c.Type {
 	case typeRateLimit:
-		return middleware.RateLimit(&middleware.RatelimitConfig{
-			Requests: c.Requests,
-			Window:   c.Window,
-			Burst:    c.Burst,
-		}), nil
+		overrides := make(map[string]middleware.RateLimitOverride, len(c.Overrides))
+		for consumer, override := range c.Overrides {
+			overrides[consumer] = middleware.RateLimitOverride{
+				Requests: override.Requests,
+				Window:   override.Window,
+				Burst:    override.Burst,
+			}
+		}
+
+		key, err := middleware.ParseRateLimitKey(c.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		trusted, err := parsePrefixes(c.RatelimitConfig.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &middleware.RatelimitConfig{
+			Requests:       c.Requests,
+			Window:         c.Window,
+			Burst:          c.Burst,
+			Key:            key,
+			Overrides:      overrides,
+			TrustedProxies: trusted,
+			CacheSize:      c.CacheSize,
+			CacheTTL:       c.RatelimitConfig.CacheTTL,
+			FailOpen:       true,
+		}
+
+		if c.Store != nil && c.Store.Type == storeRedis {
+			cfg.Store = middleware.NewRedisRateLimitStore(&middleware.RedisStoreConfig{
+				Address:  c.Store.Address,
+				Password: c.Store.Password,
+				DB:       c.Store.DB,
+				Timeout:  c.Store.Timeout,
+				Prefix:   c.Store.Prefix,
+			})
+			cfg.FailOpen = c.Store.FailureMode != failureClosed
+		}
+
+		return middleware.RateLimit(cfg), nil
 
 	case typeBasicAuth:
+		// Like keys_file of api_key, a broken users_file fails the config load.
+		if c.UsersFile != "" {
+			data, err := os.ReadFile(c.UsersFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read users_file: %w", err)
+			}
+			if _, err := middleware.ParseHtpasswd(data); err != nil {
+				return nil, fmt.Errorf("invalid users_file %s: %w", c.UsersFile, err)
+			}
+		}
+
 		return middleware.BasicAuth(&middleware.BasicAuthConfig{
-			Users: c.Users,
-			Realm: c.Realm,
+			Users:              c.Users,
+			UsersFile:          c.UsersFile,
+			Realm:              c.BasicAuthConfig.Realm,
+			StripAuthorization: c.StripAuthorization,
+			UserHeader:         c.UserHeader,
 		}), nil
 
 	case typeCORS:
@@ -221,21 +1177,13 @@ func (c *MiddlewareConfig) Build() (middleware.Middleware, error) {
 
 	case typeHeaders:
 		return middleware.Headers(&middleware.HeadersConfig{
-			Request: &middleware.HeaderRules{
-				Add:    c.Request.Add,
-				Set:    c.Request.Set,
-				Remove: c.Request.Remove,
-			},
-			Response: &middleware.HeaderRules{
-				Add:    c.Response.Add,
-				Set:    c.Response.Set,
-				Remove: c.Response.Remove,
-			},
+			Request:  c.Request.build(),
+			Response: c.Response.build(),
 		}), nil
 
 	case typeRequestID:
 		return middleware.RequestID(&middleware.RequestIDConfig{
-			HeaderName: c.HeaderName,
+			HeaderName: c.RequestIDConfig.HeaderName,
 		}), nil
 
 	case typeSecurityHeaders:
@@ -254,7 +1202,317 @@ func (c *MiddlewareConfig) Build() (middleware.Middleware, error) {
 			Types:   c.Types,
 		}), nil
 
+	case typeRedirect, typeRewrite:
+		rules, err := buildRewriteRules(c.Rules)
+		if err != nil {
+			return nil, err
+		}
+
+		trusted, err := parsePrefixes(c.RewriteConfig.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &middleware.RewriteConfig{Rules: rules, TrustedProxies: trusted}
+		if c.Type == typeRedirect {
+			return middleware.Redirect(cfg), nil
+		}
+
+		return middleware.Rewrite(cfg), nil
+
+	case typeJWT:
+		return c.buildJWT()
+
+	case typeForwardAuth:
+		trusted, err := parsePrefixes(c.ForwardAuthConfig.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+
+		return middleware.ForwardAuth(&middleware.ForwardAuthConfig{
+			URL:             c.URL,
+			RequestHeaders:  c.RequestHeaders,
+			ResponseHeaders: c.ResponseHeaders,
+			Timeout:         c.Timeout,
+			CacheTTL:        c.ForwardAuthConfig.CacheTTL,
+			TrustedProxies:  trusted,
+		}), nil
+
+	case typeOIDC:
+		trusted, err := parsePrefixes(c.OIDCConfig.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+
+		return middleware.OIDC(&middleware.OIDCConfig{
+			Issuer:                c.OIDCConfig.Issuer,
+			ClientID:              c.ClientID,
+			ClientSecret:          c.ClientSecret,
+			RedirectURL:           c.RedirectURL,
+			LogoutPath:            c.LogoutPath,
+			PostLogoutRedirectURL: c.PostLogoutRedirectURL,
+			Scopes:                c.Scopes,
+			CookieName:            c.CookieName,
+			CookieSecret:          []byte(c.CookieSecret),
+			SessionTTL:            c.SessionTTL,
+			ClockSkew:             c.OIDCConfig.ClockSkew,
+			AllowedEmails:         c.AllowedEmails,
+			AllowedGroups:         c.AllowedGroups,
+			GroupsClaim:           c.GroupsClaim,
+			ForwardClaims:         c.OIDCConfig.ForwardClaims,
+			TrustedProxies:        trusted,
+		}), nil
+
+	case typeAPIKey:
+		// The keys file is parsed once here so a broken file fails the
+		// config load; the middleware re-reads it when it changes.
+		if c.KeysFile != "" {
+			data, err := os.ReadFile(c.KeysFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read keys_file: %w", err)
+			}
+			if _, err := middleware.ParseAPIKeys(data); err != nil {
+				return nil, fmt.Errorf("invalid keys_file %s: %w", c.KeysFile, err)
+			}
+		}
+
+		return middleware.APIKey(&middleware.APIKeyConfig{
+			HeaderName: c.APIKeyConfig.HeaderName,
+			QueryParam: c.QueryParam,
+			Keys:       c.Keys,
+			KeysFile:   c.KeysFile,
+		}), nil
+
+	case typeIPFilter:
+		return c.buildIPFilter()
+
+	case typeCache:
+		return c.buildCache()
+
+	case typeConcurrencyLimit:
+		return middleware.ConcurrencyLimit(&middleware.ConcurrencyLimitConfig{
+			MaxInFlight:      c.MaxInFlight,
+			QueueSize:        c.QueueSize,
+			QueueTimeout:     c.QueueTimeout,
+			Adaptive:         c.Adaptive,
+			MinLimit:         c.MinLimit,
+			LatencyThreshold: c.LatencyThreshold,
+		}), nil
+
 	default:
 		return nil, fmt.Errorf("unknow middleware type: %s", c.Type)
 	}
 }
+
+func (c *MiddlewareConfig) buildJWT() (middleware.Middleware, error) {
+	secret := []byte(c.Secret)
+	if c.SecretFile != "" {
+		data, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret_file: %w", err)
+		}
+		secret = bytes.TrimRight(data, "\r\n")
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(c.KeyFiles))
+	for _, file := range c.KeyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+
+		key, err := middleware.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return middleware.JWT(&middleware.JWTConfig{
+		Algorithms:     c.Algorithms,
+		Secret:         secret,
+		Keys:           keys,
+		JWKSURL:        c.JWKSURL,
+		JWKSRefresh:    c.JWKSRefresh,
+		Issuer:         c.JWTConfig.Issuer,
+		Audience:       c.Audience,
+		ClockSkew:      c.JWTConfig.ClockSkew,
+		RequiredClaims: c.RequiredClaims,
+		ForwardClaims:  c.JWTConfig.ForwardClaims,
+		Realm:          c.JWTConfig.Realm,
+	}), nil
+}
+
+func (c *MiddlewareConfig) buildIPFilter() (middleware.Middleware, error) {
+	allow, err := parsePrefixes(c.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(c.Deny)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parsePrefixes(c.IPFilterConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	// The files are parsed once here so a broken file fails the config load.
+	for _, file := range slices.Concat(c.AllowFiles, c.DenyFiles) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ip list: %w", err)
+		}
+		if _, err := middleware.ParseIPList(data); err != nil {
+			return nil, fmt.Errorf("invalid ip list %s: %w", file, err)
+		}
+	}
+
+	return middleware.IPFilter(&middleware.IPFilterConfig{
+		Allow:           allow,
+		Deny:            deny,
+		AllowFiles:      c.AllowFiles,
+		DenyFiles:       c.DenyFiles,
+		RefreshInterval: c.FilesRefresh,
+		TrustedProxies:  trusted,
+		DenyStatus:      c.DenyStatus,
+		DenyBody:        c.DenyBody,
+	}), nil
+}
+
+func (c *MiddlewareConfig) buildCache() (middleware.Middleware, error) {
+	maxSize, err := filesize.Parse(c.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max_size: %w", err)
+	}
+	maxEntrySize, err := filesize.Parse(c.MaxEntrySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max_entry_size: %w", err)
+	}
+
+	trusted, err := parsePrefixes(c.CacheConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &middleware.CacheConfig{
+		MaxSize:              maxSize,
+		MaxEntrySize:         maxEntrySize,
+		StaleWhileRevalidate: c.StaleWhileRevalidate,
+		StaleIfError:         c.StaleIfError,
+		TrustedProxies:       trusted,
+	}
+
+	if c.DiskDir != "" {
+		diskMaxSize, err := filesize.Parse(c.DiskMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse disk_max_size: %w", err)
+		}
+
+		cfg.Disk, err = middleware.OpenDiskCache(c.DiskDir, diskMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk cache: %w", err)
+		}
+	}
+
+	return middleware.Cache(cfg), nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := middleware.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+func (r *HeaderRules) build() *middleware.HeaderRules {
+	if r == nil {
+		return nil
+	}
+
+	return &middleware.HeaderRules{
+		Add:    r.Add,
+		Set:    r.Set,
+		Remove: r.Remove,
+	}
+}
+
+func buildRewriteRules(rulesCfg []RewriteRuleConfig) ([]*middleware.RewriteRule, error) {
+	rules := make([]*middleware.RewriteRule, 0, len(rulesCfg))
+
+	for _, ruleCfg := range rulesCfg {
+		re, err := regexp.Compile(ruleCfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile match regexp: %w", err)
+		}
+
+		rules = append(rules, &middleware.RewriteRule{
+			Match:         re,
+			Replacement:   ruleCfg.Replacement,
+			Hosts:         ruleCfg.Hosts,
+			Schemes:       ruleCfg.Schemes,
+			StatusCode:    ruleCfg.StatusCode,
+			PreserveQuery: ruleCfg.PreserveQuery,
+		})
+	}
+
+	return rules, nil
+}
+
+// BuildMiddlewaresDryRun builds the middlewares like BuildMiddlewares, but
+// replaces the ones with side effects by middleware.Skipped: rate limits,
+// forward_auth, oidc, cache and jwt with a jwks_url. Nothing is counted,
+// fetched or written when requests pass the chain.
+func BuildMiddlewaresDryRun(mwConfigs []MiddlewareConfig) ([]middleware.Middleware, error) {
+	middlewares := make([]middleware.Middleware, 0, len(mwConfigs))
+
+	for _, mwCfg := range mwConfigs {
+		if mwCfg.sideEffects() {
+			middlewares = append(middlewares, &middleware.Skipped{T: middleware.Type(mwCfg.Type)})
+			continue
+		}
+
+		mw, err := mwCfg.Build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build middleware %s: %w", mwCfg.Type, err)
+		}
+
+		middlewares = append(middlewares, mw)
+	}
+
+	return middlewares, nil
+}
+
+func (c *MiddlewareConfig) sideEffects() bool {
+	switch c.Type {
+	case typeRateLimit, typeForwardAuth, typeOIDC, typeCache:
+		return true
+	case typeJWT:
+		return c.JWKSURL != ""
+	}
+
+	return false
+}
+
+// BuildMiddlewares builds the middlewares in the order they are configured.
+func BuildMiddlewares(mwConfigs []MiddlewareConfig) ([]middleware.Middleware, error) {
+	middlewares := make([]middleware.Middleware, 0, len(mwConfigs))
+
+	for _, mwCfg := range mwConfigs {
+		mw, err := mwCfg.Build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build middleware %s: %w", mwCfg.Type, err)
+		}
+
+		middlewares = append(middlewares, mw)
+	}
+
+	return middlewares, nil
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDecodeMiddlewares(t *testing.T) {
+	data := `
+middlewares:
+  - type: basic_auth
+    realm: Admin
+  - type: jwt
+    realm: API
+    clock_skew: 1m
+  - type: request_id
+    header_name: X-Trace-ID
+  - type: api_key
+    header_name: X-Token
+    realm: API
+`
+
+	var cfg Config
+	unknown, err := decode([]byte(data), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each type has its own options, an option of another type is unknown.
+	want := []Problem{{Line: 12, Message: "unknown field realm", Warning: true}}
+	if !reflect.DeepEqual(unknown, want) {
+		t.Errorf("got unknown fields %+v, want %+v", unknown, want)
+	}
+
+	mws := cfg.Middlewares
+	if len(mws) != 4 {
+		t.Fatalf("got %d middlewares, want 4", len(mws))
+	}
+	if mws[0].BasicAuthConfig.Realm != "Admin" || mws[1].JWTConfig.Realm != "API" || mws[1].JWTConfig.ClockSkew != time.Minute {
+		t.Errorf("got realms %q and %q", mws[0].BasicAuthConfig.Realm, mws[1].JWTConfig.Realm)
+	}
+	if mws[2].RequestIDConfig.HeaderName != "X-Trace-ID" || mws[3].APIKeyConfig.HeaderName != "X-Token" {
+		t.Errorf("got header names %q and %q", mws[2].RequestIDConfig.HeaderName, mws[3].APIKeyConfig.HeaderName)
+	}
+	if mws[0].JWTConfig.Realm != "" || mws[3].BasicAuthConfig.Realm != "" {
+		t.Error("an option was decoded into another type")
+	}
+
+	// Encoding keeps the options of the type only.
+	out, err := yaml.Marshal(mws[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded MiddlewareConfig
+	if err := yaml.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("%v in\n%s", err, out)
+	}
+	if decoded.Type != typeJWT || decoded.JWTConfig.Realm != "API" || decoded.JWTConfig.ClockSkew != time.Minute {
+		t.Errorf("got %+v after encoding", decoded.JWTConfig)
+	}
+	if bytes.Contains(out, []byte("header_name")) {
+		t.Errorf("options of other types were encoded:\n%s", out)
+	}
+}
+
+func TestBuildMiddlewaresDryRun(t *testing.T) {
+	mws := []MiddlewareConfig{
+		{Type: typeRateLimit, RatelimitConfig: RatelimitConfig{Requests: 10, Window: time.Minute}},
+		{Type: typeJWT, JWTConfig: JWTConfig{Algorithms: []string{"RS256"}, JWKSURL: "https://auth.example.com/jwks.json"}},
+		{Type: typeJWT, JWTConfig: JWTConfig{Algorithms: []string{"HS256"}, Secret: "0123456789abcdef0123456789abcdef"}},
+		{Type: typeRequestID},
+		{Type: typeCache},
+	}
+	for i := range mws {
+		mws[i].ApplyDefaults()
+	}
+
+	built, err := BuildMiddlewaresDryRun(mws)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the middlewares that count, fetch or store are skipped.
+	skipped := []bool{true, true, false, false, true}
+
+	for i, mw := range built {
+		if mw.Type() != middleware.Type(mws[i].Type) {
+			t.Errorf("middleware %d: type %s, want %s", i, mw.Type(), mws[i].Type)
+		}
+
+		_, ok := mw.(*middleware.Skipped)
+		if ok != skipped[i] {
+			t.Errorf("middleware %d (%s): skipped %t, want %t", i, mws[i].Type, ok, skipped[i])
+		}
+	}
+}
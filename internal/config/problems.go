@@ -0,0 +1,221 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a configuration error located in the YAML document.
+type Problem struct {
+	Path    string // e.g. routes["api.example.com"].middlewares[0].requests
+	Line    int    // 0 when the location is unknown
+	Column  int
+	Message string
+
+	// Warning is set for problems that don't stop the config from loading,
+	// e.g. a part of it that has no effect.
+	Warning bool
+}
+
+func (p Problem) Error() string {
+	if p.Path == "" {
+		return p.Message
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+// yamlPath addresses a node of the config document by map keys and sequence indexes.
+type yamlPath []any
+
+func (p yamlPath) key(k string) yamlPath {
+	return append(p[:len(p):len(p)], k)
+}
+
+func (p yamlPath) index(i int) yamlPath {
+	return append(p[:len(p):len(p)], i)
+}
+
+func (p yamlPath) String() string {
+	var b strings.Builder
+
+	for _, seg := range p {
+		switch s := seg.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", s)
+		case string:
+			if s == "" || strings.ContainsAny(s, ".[]\"* :") {
+				fmt.Fprintf(&b, "[%q]", s)
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(s)
+		}
+	}
+
+	return b.String()
+}
+
+type problem struct {
+	path    yamlPath
+	msg     string
+	warning bool
+}
+
+// problems collects every validation error instead of stopping at the first one.
+type problems struct {
+	list []problem
+
+	// files makes the middleware checks also read and parse the files the
+	// middlewares load, e.g. users_file, so broken files are reported with
+	// their location. Nothing is built, so checking has no side effects.
+	files bool
+}
+
+func (p *problems) add(path yamlPath, format string, args ...any) {
+	p.list = append(p.list, problem{path: path, msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *problems) warn(path yamlPath, format string, args ...any) {
+	p.list = append(p.list, problem{path: path, msg: fmt.Sprintf(format, args...), warning: true})
+}
+
+func (p *problems) err() error {
+	errs := make([]error, 0, len(p.list))
+	for _, pr := range p.list {
+		if !pr.warning {
+			errs = append(errs, Problem{Path: pr.path.String(), Message: pr.msg})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *problems) warnings() []Problem {
+	var warnings []Problem
+	for _, pr := range p.list {
+		if pr.warning {
+			warnings = append(warnings, Problem{Path: pr.path.String(), Message: pr.msg, Warning: true})
+		}
+	}
+
+	return warnings
+}
+
+var lineRe = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Check loads the config file like Load, but reports every problem it finds
+// with its location: YAML syntax and type errors, invalid values and files of
+// middlewares that can't be read or parsed, and warnings such as unknown
+// fields. The returned error is only set when the file can't be read.
+func Check(path string) ([]Problem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []Problem{parseYAMLError(err.Error())}, nil
+	}
+
+	var cfg Config
+
+	result, err := decode(data, &cfg)
+	if err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return append(result, parseYAMLError(err.Error())), nil
+		}
+
+		// Decoding continues after type errors, so the rest is still checked.
+		for _, msg := range typeErr.Errors {
+			result = append(result, parseYAMLError(msg))
+		}
+	}
+
+	cfg.applyDefaults()
+
+	p := problems{files: true}
+	cfg.check(&p)
+
+	for _, pr := range p.list {
+		line, column := locate(&root, pr.path)
+		result = append(result, Problem{
+			Path:    pr.path.String(),
+			Line:    line,
+			Column:  column,
+			Message: pr.msg,
+			Warning: pr.warning,
+		})
+	}
+
+	slices.SortStableFunc(result, func(a, b Problem) int {
+		return a.Line - b.Line
+	})
+
+	return result, nil
+}
+
+func parseYAMLError(msg string) Problem {
+	msg = strings.TrimPrefix(msg, "yaml: ")
+
+	m := lineRe.FindStringSubmatch(msg)
+	if m == nil {
+		return Problem{Message: msg}
+	}
+
+	line, _ := strconv.Atoi(m[1])
+
+	return Problem{Line: line, Message: m[2]}
+}
+
+// locate returns the position of the node at path. If the path does not exist
+// in the document, e.g. for a missing required field, the position of the
+// deepest existing parent is returned.
+func locate(root *yaml.Node, path yamlPath) (int, int) {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line, column := node.Line, node.Column
+
+	for _, seg := range path {
+		var next, pos *yaml.Node
+
+		switch s := seg.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				break
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == s {
+					pos, next = node.Content[i], node.Content[i+1]
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && s < len(node.Content) {
+				pos, next = node.Content[s], node.Content[s]
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		line, column = pos.Line, pos.Column
+		node = next
+	}
+
+	return line, column
+}
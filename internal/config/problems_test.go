@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []Problem
+	}{
+		{
+			name: "valid",
+			data: `
+server:
+  listen: ":8080"
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`,
+		},
+		{
+			name: "unknown field",
+			data: `
+server:
+  listen: ":8080"
+  read_timeot: 10s
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`,
+			want: []Problem{{Line: 4, Message: "unknown field read_timeot", Warning: true}},
+		},
+		{
+			name: "type error",
+			data: `
+server:
+  listen: ":8080"
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+    middlewares:
+      - type: rate_limit
+        requests: many
+        window: 1m
+`,
+			// Checking continues with the zero value.
+			want: []Problem{
+				{Line: 9, Message: "cannot unmarshal !!str `many` into int"},
+				{
+					Path:    `routes["api.example.com"].middlewares[0].requests`,
+					Line:    9,
+					Column:  9,
+					Message: "rate_limit requests must be greater then 0",
+				},
+			},
+		},
+		{
+			name: "invalid middleware",
+			data: `
+server:
+  listen: ":8080"
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+    middlewares:
+      - type: rate_limit
+        requests: -1
+        window: 1m
+`,
+			want: []Problem{{
+				Path:    `routes["api.example.com"].middlewares[0].requests`,
+				Line:    9,
+				Column:  9,
+				Message: "rate_limit requests must be greater then 0",
+			}},
+		},
+		{
+			name: "missing listen",
+			data: `
+log:
+  level: debug
+server:
+  read_timeout: 10s
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`,
+			// The missing key is reported at its parent.
+			want: []Problem{{Path: "server.listen", Line: 4, Column: 1, Message: "listen is required"}},
+		},
+		{
+			name: "listeners",
+			data: `
+listeners:
+  - name: public
+    listen: ":8080"
+    routes: [api.example.com, web.example.com]
+  - name: internal
+    listen: ":8080"
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`,
+			want: []Problem{
+				{Path: "listeners[0].routes[1]", Line: 5, Column: 31, Message: "unknown route web.example.com"},
+				{Path: "listeners[1].listen", Line: 7, Column: 5, Message: "duplicate listener address: :8080"},
+			},
+		},
+		{
+			name: "admin and tracing",
+			data: `
+server:
+  listen: ":8080"
+admin:
+  listen: ":9090"
+  metrics_path: metrics
+tracing:
+  sample_ratio: 2
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`,
+			want: []Problem{
+				{Path: "admin.token", Line: 4, Column: 1, Message: "the admin API is disabled without a token", Warning: true},
+				{Path: "admin.metrics_path", Line: 6, Column: 3, Message: "metrics_path must start with /"},
+				{Path: "tracing.sample_ratio", Line: 8, Column: 3, Message: "sample_ratio must be between 0 and 1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Check(writeConfig(t, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got problems\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadWarnings(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+server:
+  listen: ":8080"
+  read_timeot: 10s
+routes:
+  api.example.com:
+    backend: http://localhost:9000
+`))
+	if err != nil {
+		t.Fatalf("an unknown field stopped the config from loading: %v", err)
+	}
+
+	want := []Problem{{Line: 4, Message: "unknown field read_timeot", Warning: true}}
+	if got := cfg.Warnings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got warnings %+v, want %+v", got, want)
+	}
+
+	// Errors still stop it.
+	_, err = Load(writeConfig(t, "server:\n  listen: \":8080\"\nroutes: {}\n"))
+	if err == nil || !strings.Contains(err.Error(), "there must be at least one route") {
+		t.Errorf("got %v, want the missing routes error", err)
+	}
+}
@@ -2,18 +2,21 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 )
 
 type RouteConfig struct {
-	Backend               string             `yaml:"backend"`
-	PreserveHost          bool               `yaml:"preserve_host"`
-	DialTimeout           time.Duration      `yaml:"dial_timeout"`
-	ResponseHeaderTimeout time.Duration      `yaml:"response_header_timeout"`
-	IdleConnTimeout       time.Duration      `yaml:"idle_conn_timeout"`
-	MaxIdleConns          int                `yaml:"max_idle_conns"`
-	Middlewares           []MiddlewareConfig `yaml:"middlewares"`
+	Backend               string        `yaml:"backend"`
+	PreserveHost          bool          `yaml:"preserve_host"`
+	StripPrefix           string        `yaml:"strip_prefix"`
+	AddPrefix             string        `yaml:"add_prefix"`
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	Middlewares           Middlewares   `yaml:"middlewares"`
 }
 
 func (c *RouteConfig) applyDefaults() {
@@ -36,45 +39,68 @@ func (c *RouteConfig) applyDefaults() {
 }
 
 func (c *RouteConfig) validate() error {
+	var p problems
+	c.check(&p, nil)
+
+	return p.err()
+}
+
+func (c *RouteConfig) check(p *problems, path yamlPath) {
 	if c.Backend == "" {
-		return fmt.Errorf("backend is required")
-	}
-	if !isUrl(c.Backend) {
-		return fmt.Errorf("invalid backend URL: %s", c.Backend)
+		p.add(path.key("backend"), "backend is required")
+	} else if !isUrl(c.Backend) {
+		p.add(path.key("backend"), "invalid backend URL: %s", c.Backend)
 	}
 
-	if c.DialTimeout < 0 {
-		return fmt.Errorf("dial_timeout can't be negative")
+	if c.StripPrefix != "" && !strings.HasPrefix(c.StripPrefix, "/") {
+		p.add(path.key("strip_prefix"), "strip_prefix must start with /")
 	}
 
-	if c.ResponseHeaderTimeout < 0 {
-		return fmt.Errorf("response_header_timeout can't be negative")
+	if c.AddPrefix != "" && !strings.HasPrefix(c.AddPrefix, "/") {
+		p.add(path.key("add_prefix"), "add_prefix must start with /")
 	}
 
-	if c.IdleConnTimeout < 0 {
-		return fmt.Errorf("idle_conn_timeout can't be negative")
-	}
+	checkNonNegative(p, path.key("dial_timeout"), c.DialTimeout)
+	checkNonNegative(p, path.key("response_header_timeout"), c.ResponseHeaderTimeout)
+	checkNonNegative(p, path.key("idle_conn_timeout"), c.IdleConnTimeout)
 
 	if c.MaxIdleConns < 0 {
-		return fmt.Errorf("max_idle_conns can't be negative")
+		p.add(path.key("max_idle_conns"), "max_idle_conns can't be negative")
 	}
 
-	mwTypes := make(map[string]bool)
-	for _, mw := range c.Middlewares {
-		if mwTypes[mw.Type] {
-			return fmt.Errorf("duplicate middleware: %s", mw.Type)
-		}
+	checkMiddlewares(p, path.key("middlewares"), c.Middlewares)
+}
+
+// ParseRoute decodes a single route definition (YAML or JSON), applies the
+// defaults and validates it the same way as routes loaded from the config file.
+func ParseRoute(data []byte) (*RouteConfig, error) {
+	var cfg RouteConfig
+
+	// Routes sent to the admin API are rejected for unknown fields, the
+	// client gets the error right away.
+	unknown, err := decode(data, &cfg)
+	if err == nil && len(unknown) > 0 {
+		err = unknown[0]
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode route: %w", err)
+	}
 
-		mwTypes[mw.Type] = true
+	cfg.applyDefaults()
 
-		if err := mw.Validate(); err != nil {
-			return fmt.Errorf("failed to validate middleware %s: %w", mw.Type, err)
-		}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate route: %w", err)
 	}
 
-	return nil
+	return &cfg, nil
 }
 
+// isUrl reports whether s is an absolute http or https URL with a host.
 func isUrl(s string) bool {
-	return (strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://"))
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
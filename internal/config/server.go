@@ -2,6 +2,8 @@ package config
 
 import (
 	"time"
+
+	"github.com/haadi-coder/filesize"
 )
 
 type ServerConfig struct {
@@ -12,6 +14,8 @@ type ServerConfig struct {
 	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 	MaxHeaderBytes  string        `yaml:"max_header_bytes"`
 	MaxRequestBody  string        `yaml:"max_request_body"`
+	BufferSize      string        `yaml:"buffer_size"`
+	Via             string        `yaml:"via"`
 }
 
 func (c *ServerConfig) applyDefaults() {
@@ -31,7 +35,33 @@ func (c *ServerConfig) applyDefaults() {
 	if c.MaxRequestBody == "" {
 		c.MaxRequestBody = "10MB"
 	}
+	if c.BufferSize == "" {
+		c.BufferSize = "32KB"
+	}
 	if c.ShutdownTimeout == 0 {
 		c.ShutdownTimeout = 30 * time.Second
 	}
 }
+
+func (c *ServerConfig) check(p *problems, path yamlPath) {
+	checkNonNegative(p, path.key("read_timeout"), c.ReadTimeout)
+	checkNonNegative(p, path.key("write_timeout"), c.WriteTimeout)
+	checkNonNegative(p, path.key("idle_timeout"), c.IdleTimeout)
+	checkNonNegative(p, path.key("shutdown_timeout"), c.ShutdownTimeout)
+
+	checkSize(p, path.key("max_header_bytes"), c.MaxHeaderBytes)
+	checkSize(p, path.key("max_request_body"), c.MaxRequestBody)
+	checkSize(p, path.key("buffer_size"), c.BufferSize)
+}
+
+func checkNonNegative(p *problems, path yamlPath, d time.Duration) {
+	if d < 0 {
+		p.add(path, "%s can't be negative", path[len(path)-1])
+	}
+}
+
+func checkSize(p *problems, path yamlPath, size string) {
+	if _, err := filesize.Parse(size); err != nil {
+		p.add(path, "invalid size %q: %s", size, err)
+	}
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/tracing"
+)
+
+type TracingConfig struct {
+	ServiceName   string            `yaml:"service_name"`
+	Endpoint      string            `yaml:"endpoint"`
+	Headers       map[string]string `yaml:"headers"`
+	SampleRatio   float64           `yaml:"sample_ratio"`
+	Propagators   []string          `yaml:"propagators"`
+	BatchSize     int               `yaml:"batch_size"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+func (c *TracingConfig) applyDefaults() {
+	if c != nil {
+		if c.ServiceName == "" {
+			c.ServiceName = "reverse-proxy"
+		}
+		if c.Endpoint == "" {
+			c.Endpoint = "http://localhost:4318/v1/traces"
+		}
+		if c.SampleRatio == 0 {
+			c.SampleRatio = 1
+		}
+		if len(c.Propagators) == 0 {
+			c.Propagators = []string{"tracecontext"}
+		}
+		if c.BatchSize == 0 {
+			c.BatchSize = 512
+		}
+		if c.FlushInterval == 0 {
+			c.FlushInterval = 5 * time.Second
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 10 * time.Second
+		}
+	}
+}
+
+func (c *TracingConfig) check(p *problems, path yamlPath) {
+	if c == nil {
+		return
+	}
+
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		p.add(path.key("endpoint"), "invalid endpoint: %s", c.Endpoint)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		p.add(path.key("sample_ratio"), "sample_ratio must be between 0 and 1")
+	}
+	propagators := []string{tracing.PropagatorTraceContext, tracing.PropagatorB3}
+	for i, propagator := range c.Propagators {
+		if !slices.Contains(propagators, propagator) {
+			p.add(path.key("propagators").index(i), "invalid propagator: %s (must be tracecontext or b3)", propagator)
+		}
+	}
+	if c.BatchSize <= 0 {
+		p.add(path.key("batch_size"), "batch_size must be greater than 0")
+	}
+	if c.FlushInterval <= 0 {
+		p.add(path.key("flush_interval"), "flush_interval must be greater than 0")
+	}
+	checkNonNegative(p, path.key("timeout"), c.Timeout)
+}
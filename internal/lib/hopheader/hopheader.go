@@ -0,0 +1,39 @@
+// Package hopheader removes the hop-by-hop headers of messages that are
+// forwarded or replayed by the proxy.
+package hopheader
+
+import (
+	"net/http"
+	"strings"
+)
+
+// headers are the hop-by-hop headers defined in RFC 9110 section 7.6.1.
+// They are meaningful only for a single transport-level connection and must
+// not be forwarded by proxies.
+var headers = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",      // canonicalized version of "TE"
+	"Trailer", // not Trailers per RFC 7230 errata
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Remove deletes the hop-by-hop headers from h, including the ones listed as
+// connection options in the Connection header.
+func Remove(h http.Header) {
+	for _, f := range h["Connection"] {
+		for sf := range strings.SplitSeq(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+
+	for _, hh := range headers {
+		h.Del(hh)
+	}
+}
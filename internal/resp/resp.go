@@ -0,0 +1,310 @@
+// Package resp is a minimal client for servers speaking the Redis
+// serialization protocol (RESP2), such as Redis, Valkey and KeyDB. It only
+// supports what the proxy needs: sending pipelined commands and reading their
+// replies over a bounded pool of connections.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxIdleConns = 16
+
+	// maxConns limits the connections in use, so a slow server doesn't get
+	// a new connection for every waiting request.
+	maxConns = 64
+)
+
+// ErrPoolTimeout is returned when no connection became free within the
+// timeout.
+var ErrPoolTimeout = errors.New("resp: timed out waiting for a connection")
+
+// Error is an error reply of the server, e.g. "WRONGTYPE ...". The
+// connection stays usable after it.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Config holds the connection settings.
+type Config struct {
+	Address  string
+	Password string
+	DB       int
+
+	// Timeout limits connecting and every pipeline round trip.
+	Timeout time.Duration
+}
+
+// Client sends commands to the server. It is safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	// sem holds a token for every connection in use.
+	sem chan struct{}
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg, sem: make(chan struct{}, maxConns)}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Do sends one command and returns its reply.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+
+	return replies[0], nil
+}
+
+// Pipeline sends the commands in one write and returns their replies, in
+// order. Error replies are returned as Error values in the list.
+// Replies are string, int64, nil, Error or []any for arrays.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.roundTrip(ctx, c.cfg.Timeout, cmds)
+	if err != nil {
+		c.discard(cn)
+		return nil, err
+	}
+
+	c.put(cn)
+
+	return replies, nil
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	var errs []error
+	for _, cn := range idle {
+		errs = append(errs, cn.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	cn, err := c.dial(ctx)
+	if err != nil {
+		<-c.sem
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// acquire waits for a free slot for a connection in use, at most for the
+// timeout.
+func (c *Client) acquire(ctx context.Context) error {
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(c.cfg.Timeout)
+	defer timer.Stop()
+
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrPoolTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.cfg.Timeout}
+
+	nc, err := dialer.DialContext(ctx, "tcp", c.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+
+	if len(setup) > 0 {
+		replies, err := cn.roundTrip(ctx, c.cfg.Timeout, setup)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(Error); ok {
+					err = replyErr
+				}
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to set up connection: %w", err)
+		}
+	}
+
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	if len(c.idle) < maxIdleConns {
+		c.idle = append(c.idle, cn)
+		cn = nil
+	}
+	c.mu.Unlock()
+
+	if cn != nil {
+		cn.Close()
+	}
+	<-c.sem
+}
+
+// discard closes a connection that failed and frees its slot.
+func (c *Client) discard(cn *conn) {
+	cn.Close()
+	<-c.sem
+}
+
+func (cn *conn) roundTrip(ctx context.Context, timeout time.Duration, cmds [][]string) ([]any, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := cn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, 0, len(cmds))
+	for range cmds {
+		reply, err := readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+
+	case '-':
+		return Error(payload), nil
+
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]any, 0, n)
+		for range n {
+			item, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
@@ -0,0 +1,101 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted atomic.Int32
+	release := make(chan struct{})
+
+	// The server answers every command with +OK once released.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := readReply(r); err != nil {
+						return
+					}
+					<-release
+					if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	client := New(Config{Address: ln.Addr().String(), Timeout: 2 * time.Second})
+	defer client.Close()
+
+	const requests = maxConns + 10
+
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+
+	for i := range requests {
+		wg.Go(func() {
+			_, errs[i] = client.Do(context.Background(), "PING")
+		})
+	}
+
+	for deadline := time.Now().Add(time.Second); accepted.Load() < maxConns; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d connections were opened", accepted.Load())
+		}
+	}
+
+	// The other requests wait for a connection instead of opening one.
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted.Load(); n != maxConns {
+		t.Errorf("%d connections opened, want %d", n, maxConns)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	client := New(Config{Address: "127.0.0.1:1", Timeout: 50 * time.Millisecond})
+
+	for range maxConns {
+		client.sem <- struct{}{}
+	}
+
+	if _, err := client.Do(context.Background(), "PING"); !errors.Is(err, ErrPoolTimeout) {
+		t.Errorf("got %v, want ErrPoolTimeout", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := client.Do(ctx, "PING"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
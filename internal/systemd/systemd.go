@@ -0,0 +1,207 @@
+// Package systemd implements the parts of the systemd service protocol used by
+// the proxy: socket activation (LISTEN_FDS) and state notifications over
+// NOTIFY_SOCKET, so units can use Type=notify and privileged ports can be bound
+// by systemd instead of the proxy.
+package systemd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// Activation holds the sockets passed by systemd.
+type Activation struct {
+	mu        sync.Mutex
+	listeners []activated
+}
+
+type activated struct {
+	name string
+	ln   net.Listener
+}
+
+// Activate picks up the sockets passed by systemd. Without socket activation
+// it returns an empty Activation, whose Listen binds every address itself.
+func Activate() (*Activation, error) {
+	a := &Activation{}
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return a, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return a, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := range n {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use activated socket %d: %w", listenFDsStart+i, err)
+		}
+
+		a.listeners = append(a.listeners, activated{name: name, ln: ln})
+	}
+
+	slog.Info("received sockets from systemd", slog.Int("count", n))
+
+	return a, nil
+}
+
+// Listen returns the activated socket for addr or binds a new one. A socket
+// matches when its FileDescriptorName= equals addr or it is bound to addr.
+// It satisfies proxy.ListenFunc.
+func (a *Activation) Listen(network, addr string) (net.Listener, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, l := range a.listeners {
+		if l.name == addr || sameAddr(l.ln.Addr(), addr) {
+			a.listeners = append(a.listeners[:i], a.listeners[i+1:]...)
+			slog.Info("using activated socket", slog.String("addr", addr))
+
+			return l.ln, nil
+		}
+	}
+
+	return net.Listen(network, addr)
+}
+
+// sameAddr reports whether the bound address is the configured one. A
+// configured address without a host matches sockets bound to any address.
+func sameAddr(bound net.Addr, addr string) bool {
+	tcp, ok := bound.(*net.TCPAddr)
+	if !ok {
+		return bound.String() == addr
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || want.Port != tcp.Port {
+		return false
+	}
+
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcp.IP == nil || tcp.IP.IsUnspecified()
+	}
+
+	return want.IP.Equal(tcp.IP)
+}
+
+// Notifier sends state changes of the proxy to the service manager.
+type Notifier struct {
+	addr *net.UnixAddr
+
+	// handedOver is set once a new process took over after a binary upgrade.
+	handedOver atomic.Bool
+}
+
+// NewNotifier returns a notifier for the NOTIFY_SOCKET environment variable,
+// or nil if the process was not started by systemd with Type=notify.
+func NewNotifier() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	return NewSocketNotifier(socket)
+}
+
+// NewSocketNotifier returns a notifier that sends to the given socket path.
+// A leading "@" denotes a socket in the abstract namespace.
+func NewSocketNotifier(socket string) *Notifier {
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	return &Notifier{addr: &net.UnixAddr{Name: socket, Net: "unixgram"}}
+}
+
+// HandOver records that a new process took over as main process after a
+// binary upgrade. STOPPING=1 is not sent anymore: with NotifyAccess=all
+// systemd would apply it to the service and stop the new main process.
+func (n *Notifier) HandOver() {
+	n.handedOver.Store(true)
+}
+
+// Notify implements proxy.Notifier. MAINPID is sent with READY=1, so systemd
+// follows the process that took over after a binary upgrade (which requires
+// NotifyAccess=all in the unit).
+func (n *Notifier) Notify(event proxy.Event) error {
+	var state string
+
+	switch event {
+	case proxy.EventReady:
+		state = "READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())
+	case proxy.EventReloading:
+		state = "RELOADING=1"
+	case proxy.EventStopping:
+		if n.handedOver.Load() {
+			return nil
+		}
+		state = "STOPPING=1"
+	case proxy.EventWatchdog:
+		state = "WATCHDOG=1"
+	default:
+		return nil
+	}
+
+	return n.send(state)
+}
+
+func (n *Notifier) send(state string) error {
+	conn, err := net.DialUnix(n.addr.Net, nil, n.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns how often the service manager expects a WATCHDOG=1
+// keep-alive, or 0 if the watchdog is disabled for this process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
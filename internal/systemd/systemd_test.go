@@ -0,0 +1,113 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+// notifySocket is a stand-in for the notify socket of systemd.
+type notifySocket struct {
+	conn *net.UnixConn
+	path string
+}
+
+func newNotifySocket(t *testing.T) *notifySocket {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &notifySocket{conn: conn, path: path}
+}
+
+// receive returns the next message, or "" if none arrives in time.
+func (s *notifySocket) receive(t *testing.T) string {
+	t.Helper()
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := s.conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	socket := newNotifySocket(t)
+	n := NewSocketNotifier(socket.path)
+
+	tests := []struct {
+		event proxy.Event
+		want  string
+	}{
+		{event: proxy.EventReady, want: "READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())},
+		{event: proxy.EventReloading, want: "RELOADING=1"},
+		{event: proxy.EventWatchdog, want: "WATCHDOG=1"},
+		{event: proxy.EventStopping, want: "STOPPING=1"},
+	}
+
+	for _, tt := range tests {
+		if err := n.Notify(tt.event); err != nil {
+			t.Fatal(err)
+		}
+		if got := socket.receive(t); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyAfterHandOver(t *testing.T) {
+	socket := newNotifySocket(t)
+	n := NewSocketNotifier(socket.path)
+
+	n.HandOver()
+
+	if err := n.Notify(proxy.EventStopping); err != nil {
+		t.Fatal(err)
+	}
+	if got := socket.receive(t); got != "" {
+		t.Errorf("got %q after the handover, want no message", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		usec string
+		want time.Duration
+	}{
+		{name: "this process", pid: strconv.Itoa(os.Getpid()), usec: "30000000", want: 30 * time.Second},
+		{name: "no pid", usec: "30000000", want: 30 * time.Second},
+		{name: "other process", pid: "1", usec: "30000000"},
+		{name: "disabled", pid: strconv.Itoa(os.Getpid())},
+		{name: "invalid", usec: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+
+			if got := WatchdogInterval(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
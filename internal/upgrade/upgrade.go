@@ -0,0 +1,298 @@
+// Package upgrade implements zero-downtime binary upgrades. The running
+// process starts a new instance of the executable and hands over its listening
+// sockets; once the child reports that it is serving, the parent stops
+// accepting connections and drains in-flight requests.
+//
+// The sockets are passed as extra file descriptors starting at 3, their
+// addresses are listed in the RP_UPGRADE_LISTENERS environment variable and
+// the write end of the readiness pipe is announced in RP_UPGRADE_READY_FD.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/proxy"
+)
+
+const (
+	envListeners = "RP_UPGRADE_LISTENERS"
+	envReadyFD   = "RP_UPGRADE_READY_FD"
+
+	// firstFD is the descriptor of the first entry of exec.Cmd.ExtraFiles.
+	firstFD = 3
+
+	// readyTimeout limits how long the parent waits for the child to serve.
+	readyTimeout = 30 * time.Second
+)
+
+var ErrUpgradeInProgress = errors.New("upgrade already in progress")
+
+// filer is implemented by the listeners that can be passed to a child process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+type listener struct {
+	addr string
+	ln   net.Listener
+}
+
+// Upgrader creates the listeners of the process, reusing the ones inherited
+// from the parent, and performs the handoff to a new process.
+type Upgrader struct {
+	listen proxy.ListenFunc
+
+	mu        sync.Mutex
+	inherited map[string]net.Listener
+	listeners []listener
+	ready     *os.File
+	upgrading bool
+	upgraded  bool
+}
+
+// New returns an upgrader that picks up the sockets passed by a parent process,
+// if there is one. Addresses that were not inherited are bound with listen,
+// or net.Listen if it is nil.
+func New(listen proxy.ListenFunc) (*Upgrader, error) {
+	if listen == nil {
+		listen = net.Listen
+	}
+
+	u := &Upgrader{
+		listen:    listen,
+		inherited: make(map[string]net.Listener),
+	}
+
+	if addrs := os.Getenv(envListeners); addrs != "" {
+		for i, addr := range strings.Split(addrs, ",") {
+			file := os.NewFile(uintptr(firstFD+i), addr)
+
+			ln, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to inherit listener %s: %w", addr, err)
+			}
+
+			u.inherited[addr] = ln
+		}
+	}
+
+	if fd := os.Getenv(envReadyFD); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envReadyFD, err)
+		}
+
+		u.ready = os.NewFile(uintptr(n), "upgrade-ready")
+	}
+
+	// The variables describe this process only and must not leak into the
+	// environment of a later upgrade.
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReadyFD)
+
+	return u, nil
+}
+
+// Inherited reports whether the process was started by an upgrade.
+func (u *Upgrader) Inherited() bool {
+	return u.ready != nil
+}
+
+// Listen returns the inherited listener for addr or binds a new one. It
+// satisfies proxy.ListenFunc.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ln, ok := u.inherited[addr]
+	if ok {
+		delete(u.inherited, addr)
+		slog.Info("using inherited listener", slog.String("addr", addr))
+	} else {
+		var err error
+		if ln, err = u.listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	u.listeners = append(u.listeners, listener{addr: addr, ln: ln})
+
+	return ln, nil
+}
+
+// Notify implements proxy.Notifier. Once the proxy is serving, the parent is
+// told that it can stop, and inherited sockets that the new configuration no
+// longer uses are closed.
+func (u *Upgrader) Notify(event proxy.Event) error {
+	if event != proxy.EventReady {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for addr, ln := range u.inherited {
+		slog.Info("closing unused inherited listener", slog.String("addr", addr))
+		ln.Close()
+		delete(u.inherited, addr)
+	}
+
+	if u.ready == nil {
+		return nil
+	}
+
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	if err != nil {
+		return fmt.Errorf("failed to notify parent process: %w", err)
+	}
+
+	return nil
+}
+
+// Upgrade starts a new instance of the executable with the same arguments and
+// passes the listeners to it. It returns once the child is serving; the caller
+// is then expected to shut down gracefully. On error the child is killed and
+// the current process keeps serving.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.upgrading || u.upgraded {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+	listeners := u.listeners
+	u.mu.Unlock()
+
+	err := u.upgrade(listeners)
+
+	u.mu.Lock()
+	u.upgrading = false
+	u.upgraded = err == nil
+	u.mu.Unlock()
+
+	return err
+}
+
+func (u *Upgrader) upgrade(listeners []listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	addrs := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		f, ok := l.ln.(filer)
+		if !ok {
+			return fmt.Errorf("listener %s can't be passed to a child process", l.addr)
+		}
+
+		file, err := f.File()
+		if err != nil {
+			return fmt.Errorf("failed to get file of listener %s: %w", l.addr, err)
+		}
+
+		files = append(files, file)
+		addrs = append(addrs, l.addr)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environ(),
+		envListeners+"="+strings.Join(addrs, ","),
+		envReadyFD+"="+strconv.Itoa(firstFD+len(files)-1),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start child process: %w", err)
+	}
+
+	// Without our copy of the write end, the read fails with EOF as soon as
+	// the child exits without reporting readiness.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	pid := cmd.Process.Pid
+	slog.Info("started child process, waiting for it to become ready", slog.Int("pid", pid))
+
+	if err := waitReady(readyR); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	// The child outlives this process; release it so it is not reaped here.
+	_ = cmd.Process.Release()
+
+	slog.Info("child process is ready", slog.Int("pid", pid))
+
+	return nil
+}
+
+func waitReady(r *os.File) error {
+	if err := r.SetReadDeadline(time.Now().Add(readyTimeout)); err != nil {
+		return fmt.Errorf("failed to set readiness deadline: %w", err)
+	}
+
+	var buf [1]byte
+	if _, err := r.Read(buf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("child process exited before it became ready")
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("child process did not become ready within %s", readyTimeout)
+		}
+
+		return fmt.Errorf("failed to wait for child process: %w", err)
+	}
+
+	return nil
+}
+
+// environ returns the environment without upgrade variables of the current
+// process. WATCHDOG_PID is dropped as well when it names this process: the
+// child becomes the main process and takes over the systemd watchdog.
+func environ() []string {
+	env := os.Environ()
+	out := env[:0:0]
+
+	watchdogPID := "WATCHDOG_PID=" + strconv.Itoa(os.Getpid())
+
+	for _, kv := range env {
+		if strings.HasPrefix(kv, envListeners+"=") || strings.HasPrefix(kv, envReadyFD+"=") || kv == watchdogPID {
+			continue
+		}
+		out = append(out, kv)
+	}
+
+	return out
+}
@@ -0,0 +1,36 @@
+package upgrade
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestEnviron(t *testing.T) {
+	t.Setenv(envListeners, ":8080")
+	t.Setenv(envReadyFD, "4")
+	t.Setenv("WATCHDOG_USEC", "30000000")
+
+	t.Run("watchdog of this process", func(t *testing.T) {
+		t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+		env := environ()
+		for _, kv := range []string{envListeners + "=:8080", envReadyFD + "=4", "WATCHDOG_PID=" + strconv.Itoa(os.Getpid())} {
+			if slices.Contains(env, kv) {
+				t.Errorf("%s was passed to the child", kv)
+			}
+		}
+		if !slices.Contains(env, "WATCHDOG_USEC=30000000") {
+			t.Error("WATCHDOG_USEC was not passed to the child")
+		}
+	})
+
+	t.Run("watchdog of another process", func(t *testing.T) {
+		t.Setenv("WATCHDOG_PID", "1")
+
+		if !slices.Contains(environ(), "WATCHDOG_PID=1") {
+			t.Error("WATCHDOG_PID of another process was dropped")
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package accesslog
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -77,6 +78,7 @@ type Entry struct {
 	Size       int       `json:"size"`
 	IP         string    `json:"ip"`
 	Username   string    `json:"username,omitempty"`
+	Consumer   string    `json:"consumer,omitempty"`
 	Referer    string    `json:"referer,omitempty"`
 	UserAgent  string    `json:"user_agent,omitempty"`
 	DurationMs int64     `json:"duration_ms,omitempty"`
@@ -103,6 +105,10 @@ func (l *AccessLogger) buildEntry(req *http.Request, resp *ResponseWriter, start
 		entry.Username = username
 	}
 
+	if d, ok := req.Context().Value(detailsKey{}).(*details); ok {
+		entry.Consumer = d.getConsumer()
+	}
+
 	if l.cfg.Format == CombinedFormat || l.cfg.Format == JSONFormat {
 		entry.Referer = req.Referer()
 		entry.UserAgent = req.UserAgent()
@@ -112,10 +118,7 @@ func (l *AccessLogger) buildEntry(req *http.Request, resp *ResponseWriter, start
 }
 
 func (l *AccessLogger) formatCommon(entry *Entry) string {
-	username := entry.Username
-	if username == "" {
-		username = "-"
-	}
+	username := cmp.Or(entry.Username, entry.Consumer, "-")
 
 	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d\n",
 		entry.IP,
@@ -130,10 +133,7 @@ func (l *AccessLogger) formatCommon(entry *Entry) string {
 }
 
 func (l *AccessLogger) formatCombined(entry *Entry) string {
-	username := entry.Username
-	if username == "" {
-		username = "-"
-	}
+	username := cmp.Or(entry.Username, entry.Consumer, "-")
 
 	referer := entry.Referer
 	if referer == "" {
@@ -0,0 +1,40 @@
+package accesslog
+
+import (
+	"context"
+	"sync"
+)
+
+// details collects request information that is only known further down the
+// handler chain, after the access log middleware has passed the request on.
+type details struct {
+	mu       sync.Mutex
+	consumer string
+}
+
+type detailsKey struct{}
+
+func withDetails(ctx context.Context) (context.Context, *details) {
+	d := &details{}
+	return context.WithValue(ctx, detailsKey{}, d), d
+}
+
+// SetConsumer records the authenticated API consumer of the request, e.g. set
+// by the api_key middleware. It does nothing if access logging is disabled.
+func SetConsumer(ctx context.Context, consumer string) {
+	d, ok := ctx.Value(detailsKey{}).(*details)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	d.consumer = consumer
+	d.mu.Unlock()
+}
+
+func (d *details) getConsumer() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.consumer
+}
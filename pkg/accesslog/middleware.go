@@ -25,6 +25,9 @@ func (m *Middleware) Handler(next http.Handler) http.Handler {
 			StatusCode:     http.StatusOK,
 		}
 
+		ctx, _ := withDetails(r.Context())
+		r = r.WithContext(ctx)
+
 		next.ServeHTTP(rw, r)
 
 		if err := m.Logger.Log(r, rw, startTime); err != nil {
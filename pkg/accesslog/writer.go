@@ -1,6 +1,8 @@
 package accesslog
 
-import "net/http"
+import (
+	"net/http"
+)
 
 type ResponseWriter struct {
 	http.ResponseWriter
@@ -19,3 +21,14 @@ func (rw *ResponseWriter) WriteHeader(code int) {
 	rw.StatusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush passes the flush on to the wrapped writer, for handlers that look
+// for http.Flusher directly.
+func (rw *ResponseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,320 @@
+// Package metrics implements a small set of Prometheus metric types (counters,
+// gauges and histograms with labels) and exposes them in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the default latency histogram buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds registered metrics and renders them for scraping.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// Handler returns an http.Handler serving all metrics of the registry in the
+// Prometheus text format (version 0.0.4).
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+
+		r.mu.Lock()
+		collectors := slices.Clone(r.collectors)
+		r.mu.Unlock()
+
+		for _, c := range collectors {
+			c.write(bw)
+		}
+
+		_ = bw.Flush()
+	})
+}
+
+// desc describes a metric family and stores its labelled series.
+type desc[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]*labelled[T]
+	newFn  func() *T
+}
+
+type labelled[T any] struct {
+	values []string
+	metric *T
+}
+
+func newDesc[T any](name, help, typ string, labels []string, newFn func() *T) *desc[T] {
+	return &desc[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*labelled[T]),
+		newFn:  newFn,
+	}
+}
+
+func (d *desc[T]) with(values []string) *T {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	d.mu.RLock()
+	s, ok := d.series[key]
+	d.mu.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if s, ok := d.series[key]; ok {
+		return s.metric
+	}
+
+	s = &labelled[T]{values: slices.Clone(values), metric: d.newFn()}
+	d.series[key] = s
+
+	return s.metric
+}
+
+// sorted returns the series ordered by label values, so the output is stable.
+func (d *desc[T]) sorted() []*labelled[T] {
+	d.mu.RLock()
+	out := make([]*labelled[T], 0, len(d.series))
+	for _, s := range d.series {
+		out = append(out, s)
+	}
+	d.mu.RUnlock()
+
+	slices.SortFunc(out, func(a, b *labelled[T]) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	return out
+}
+
+func (d *desc[T]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	*desc[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newDesc(name, help, "counter", labels, func() *Counter { return new(Counter) })}
+	r.register(c)
+
+	return c
+}
+
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.with(values)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, s.values), s.metric.Value())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	*desc[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newDesc(name, help, "gauge", labels, func() *Gauge { return new(Gauge) })}
+	r.register(g)
+
+	return g
+}
+
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.with(values)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, formatLabels(g.labels, s.values), s.metric.Value())
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64 // one per bucket plus +Inf
+	sumBits     atomic.Uint64
+	count       atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	idx, _ := slices.BinarySearch(h.upperBounds, v)
+	h.counts[idx].Add(1)
+	h.count.Add(1)
+
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	*desc[Histogram]
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	h := &HistogramVec{newDesc(name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(h)
+
+	return h
+}
+
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+
+	bucketLabels := append(slices.Clone(h.labels), "le")
+
+	for _, s := range h.sorted() {
+		var cumulative uint64
+		for i := range s.metric.counts {
+			cumulative += s.metric.counts[i].Load()
+
+			le := "+Inf"
+			if i < len(s.metric.upperBounds) {
+				le = strconv.FormatFloat(s.metric.upperBounds[i], 'g', -1, 64)
+			}
+
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(slices.Clone(s.values), le)), cumulative)
+		}
+
+		labels := formatLabels(h.labels, s.values)
+		sum := math.Float64frombits(s.metric.sumBits.Load())
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.metric.count.Load())
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+
+	sb.WriteByte('}')
+
+	return sb.String()
+}
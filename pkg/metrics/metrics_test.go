@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	return w.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("rp_requests_total", "Requests.", "route", "code")
+	requests.WithLabelValues("web", "5xx").Inc()
+	requests.WithLabelValues("api", "2xx").Add(3)
+	requests.WithLabelValues(`a"b\c`+"\n", "2xx").Inc()
+
+	open := r.NewGaugeVec("rp_open_connections", "Open connections.")
+	open.WithLabelValues().Set(2)
+	open.WithLabelValues().Dec()
+
+	want := `# HELP rp_requests_total Requests.
+# TYPE rp_requests_total counter
+rp_requests_total{route="a\"b\\c\n",code="2xx"} 1
+rp_requests_total{route="api",code="2xx"} 3
+rp_requests_total{route="web",code="5xx"} 1
+# HELP rp_open_connections Open connections.
+# TYPE rp_open_connections gauge
+rp_open_connections 1
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	r := NewRegistry()
+
+	// The buckets are sorted on registration.
+	latency := r.NewHistogramVec("rp_latency_seconds", "Latency.", []float64{1, 0.1, 0.5}, "route")
+
+	h := latency.WithLabelValues("web")
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.5, 2} {
+		h.Observe(v)
+	}
+
+	// The upper bounds are inclusive, and the buckets are cumulative.
+	want := `# HELP rp_latency_seconds Latency.
+# TYPE rp_latency_seconds histogram
+rp_latency_seconds_bucket{route="web",le="0.1"} 2
+rp_latency_seconds_bucket{route="web",le="0.5"} 4
+rp_latency_seconds_bucket{route="web",le="1"} 4
+rp_latency_seconds_bucket{route="web",le="+Inf"} 5
+rp_latency_seconds_sum{route="web"} 2.95
+rp_latency_seconds_count{route="web"} 5
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	c := NewRegistry().NewCounterVec("rp_test_total", "Test.", "route")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for a missing label value")
+		}
+	}()
+
+	c.WithLabelValues()
+}
@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Default is the registry used by the proxy and the middlewares.
+var Default = NewRegistry()
+
+var (
+	RequestsTotal = Default.NewCounterVec(
+		"rp_requests_total",
+		"Total number of HTTP requests handled, partitioned by route, backend and status class.",
+		"route", "backend", "code",
+	)
+
+	RequestDuration = Default.NewHistogramVec(
+		"rp_request_duration_seconds",
+		"Time spent handling HTTP requests, including middlewares and the backend round trip.",
+		DefaultBuckets,
+		"route", "backend",
+	)
+
+	RequestsInFlight = Default.NewGaugeVec(
+		"rp_requests_in_flight",
+		"Number of HTTP requests currently being handled.",
+		"route",
+	)
+
+	UnmatchedRequests = Default.NewCounterVec(
+		"rp_unmatched_requests_total",
+		"Total number of requests for which no route was found.",
+	)
+
+	UpstreamRequestsTotal = Default.NewCounterVec(
+		"rp_upstream_requests_total",
+		"Total number of requests sent to backends, partitioned by status class.",
+		"route", "backend", "code",
+	)
+
+	UpstreamDuration = Default.NewHistogramVec(
+		"rp_upstream_duration_seconds",
+		"Time until the backend response headers were received.",
+		DefaultBuckets,
+		"route", "backend",
+	)
+
+	UpstreamErrors = Default.NewCounterVec(
+		"rp_upstream_errors_total",
+		"Total number of failed backend round trips.",
+		"route", "backend",
+	)
+
+	UpstreamConnectionsOpen = Default.NewGaugeVec(
+		"rp_upstream_connections_open",
+		"Number of currently open connections to a backend.",
+		"backend",
+	)
+
+	UpstreamDials = Default.NewCounterVec(
+		"rp_upstream_dials_total",
+		"Total number of connections dialed to a backend, partitioned by result.",
+		"backend", "result",
+	)
+
+	MiddlewareRejections = Default.NewCounterVec(
+		"rp_middleware_rejections_total",
+		"Total number of requests answered by a middleware instead of the backend.",
+		"route", "middleware",
+	)
+
+	ConcurrencyLimit = Default.NewGaugeVec(
+		"rp_concurrency_limit",
+		"Current limit of the adaptive concurrency_limit middleware.",
+		"route",
+	)
+
+	CacheRequests = Default.NewCounterVec(
+		"rp_cache_requests_total",
+		"Total number of GET and HEAD requests seen by the cache middleware, partitioned by X-Cache result.",
+		"route", "result",
+	)
+
+	AuthFailures = Default.NewCounterVec(
+		"rp_auth_failures_total",
+		"Total number of failed authentication attempts.",
+		"route", "middleware", "reason",
+	)
+)
+
+type routeKey struct{}
+
+// WithRoute stores the matched route in the context, so middlewares can label
+// their metrics with it.
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// RouteFromContext returns the route stored by WithRoute.
+func RouteFromContext(ctx context.Context) string {
+	route, _ := ctx.Value(routeKey{}).(string)
+	return route
+}
+
+// RecordRejection counts a request that a middleware answered itself,
+// e.g. a rate limit or CORS rejection.
+func RecordRejection(r *http.Request, middleware string) {
+	MiddlewareRejections.WithLabelValues(RouteFromContext(r.Context()), middleware).Inc()
+}
+
+// RecordAuthFailure counts a failed authentication attempt. The request is
+// counted as a middleware rejection as well.
+func RecordAuthFailure(r *http.Request, middleware, reason string) {
+	route := RouteFromContext(r.Context())
+
+	AuthFailures.WithLabelValues(route, middleware, reason).Inc()
+	MiddlewareRejections.WithLabelValues(route, middleware).Inc()
+}
+
+// StatusClass maps a status code to its class label ("2xx", "4xx", ...).
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// APIKeyConfig holds the configuration for the API key middleware.
+type APIKeyConfig struct {
+	// HeaderName is the request header carrying the key.
+	HeaderName string
+
+	// QueryParam, if set, is the query parameter the key is read from when
+	// the header is missing.
+	QueryParam string
+
+	// Keys maps a consumer name to the SHA-256 hash of its key, hex encoded.
+	Keys map[string]string
+
+	// KeysFile, if set, is a file with additional "consumer:sha256-hex" lines,
+	// see ParseAPIKeys. It is re-read when it changes.
+	KeysFile string
+}
+
+type apiKeyMiddleware struct {
+	cfg  *APIKeyConfig
+	keys map[[sha256.Size]byte]string
+	file *fileStore[map[[sha256.Size]byte]string]
+}
+
+func APIKey(cfg *APIKeyConfig) Middleware {
+	mw := &apiKeyMiddleware{
+		cfg:  cfg,
+		keys: make(map[[sha256.Size]byte]string, len(cfg.Keys)),
+	}
+
+	for consumer, hash := range cfg.Keys {
+		if sum, err := decodeKeyHash(hash); err == nil {
+			mw.keys[sum] = consumer
+		}
+	}
+
+	if cfg.KeysFile != "" {
+		mw.file = newFileStore(cfg.KeysFile, ParseAPIKeys, fileCheckInterval)
+	}
+
+	return mw
+}
+
+func (mw *apiKeyMiddleware) Type() Type {
+	return TypeAPIKey
+}
+
+// Handler returns a middleware that requires a known API key. Requests
+// without a valid key are rejected with 401. The consumer the key belongs to
+// is available through ConsumerFromContext and is written to the access log.
+// The key itself is removed from the header and the query, so it is not
+// forwarded to the backend.
+func (mw *apiKeyMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(mw.cfg.HeaderName)
+		if key == "" && mw.cfg.QueryParam != "" {
+			key = r.URL.Query().Get(mw.cfg.QueryParam)
+		}
+
+		if key == "" {
+			mw.unauthorized(w, r, "missing_credentials")
+			return
+		}
+
+		consumer, ok := mw.lookup(key)
+		if !ok {
+			mw.unauthorized(w, r, "invalid_credentials")
+			return
+		}
+
+		accesslog.SetConsumer(r.Context(), consumer)
+
+		// WithContext copies the request but shares the URL with the outer
+		// handlers, so the query is changed on a copy.
+		r = r.WithContext(context.WithValue(r.Context(), consumerKey{}, consumer))
+
+		r.Header.Del(mw.cfg.HeaderName)
+		if mw.cfg.QueryParam != "" {
+			if query := r.URL.Query(); query.Has(mw.cfg.QueryParam) {
+				query.Del(mw.cfg.QueryParam)
+
+				u := *r.URL
+				u.RawQuery = query.Encode()
+				r.URL = &u
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookup finds the consumer by the hash of the key, so the comparison
+// doesn't leak the stored keys through timing.
+func (mw *apiKeyMiddleware) lookup(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	if consumer, ok := mw.keys[sum]; ok {
+		return consumer, true
+	}
+
+	if mw.file != nil {
+		consumer, ok := mw.file.get()[sum]
+		return consumer, ok
+	}
+
+	return "", false
+}
+
+func (mw *apiKeyMiddleware) unauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	metrics.RecordAuthFailure(r, string(TypeAPIKey), reason)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+type consumerKey struct{}
+
+// ConsumerFromContext returns the consumer authenticated by the API key
+// middleware, or an empty string.
+func ConsumerFromContext(ctx context.Context) string {
+	consumer, _ := ctx.Value(consumerKey{}).(string)
+	return consumer
+}
+
+// ParseAPIKeys parses a keys file: one "consumer:sha256-hex" entry per line,
+// empty lines and lines starting with "#" are ignored. A consumer may have
+// several keys, e.g. while rotating them.
+func ParseAPIKeys(data []byte) (map[[sha256.Size]byte]string, error) {
+	keys := make(map[[sha256.Size]byte]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		consumer, hash, ok := strings.Cut(line, ":")
+		if !ok || consumer == "" {
+			return nil, fmt.Errorf("line %d: expected consumer:hash", n)
+		}
+
+		sum, err := decodeKeyHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		keys[sum] = consumer
+	}
+
+	return keys, scanner.Err()
+}
+
+// CheckAPIKeyHash reports whether hash is a hex encoded SHA-256 hash.
+func CheckAPIKeyHash(hash string) error {
+	_, err := decodeKeyHash(hash)
+	return err
+}
+
+func decodeKeyHash(hash string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	b, err := hex.DecodeString(strings.TrimSpace(hash))
+	if err != nil || len(b) != sha256.Size {
+		return sum, errors.New("key hash must be a hex encoded SHA-256 hash")
+	}
+
+	copy(sum[:], b)
+
+	return sum, nil
+}
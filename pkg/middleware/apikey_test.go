@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyStripped(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+
+	mw := APIKey(&APIKeyConfig{
+		HeaderName: "X-API-Key",
+		QueryParam: "api_key",
+		Keys:       map[string]string{"alice": hex.EncodeToString(sum[:])},
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+	}{
+		{name: "header", target: "/items?page=2", header: "secret"},
+		{name: "query", target: "/items?api_key=secret&page=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = r
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if req.URL.String() != tt.target {
+				t.Errorf("the request URL was changed to %s", req.URL)
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if consumer := ConsumerFromContext(forwarded.Context()); consumer != "alice" {
+				t.Errorf("consumer %q, want alice", consumer)
+			}
+			if key := forwarded.Header.Get("X-API-Key"); key != "" {
+				t.Errorf("the header still carries the key %q", key)
+			}
+			if query := forwarded.URL.RawQuery; query != "page=2" {
+				t.Errorf("query %q, want page=2", query)
+			}
+		})
+	}
+}
@@ -1,31 +1,55 @@
 package middleware
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	schema                = "Basic "
-	dummyBcryptHash       = "$2a$10$dummy.hash.to.prevent.timing.attack"
+	schema = "Basic "
+
+	// dummyBcryptHash is compared against for unknown users. It must be a
+	// valid hash, otherwise bcrypt fails without doing the work.
+	dummyBcryptHash = "$2a$10$prWaefrmSq0pFaLVGjzBReECMH3Zd8tFkf0OCefz/1Prpv/SAtBJO"
 )
 
 // BasicAuthConfig holds the configuration for the Basic Authentication middleware.
 type BasicAuthConfig struct {
 	Users map[string]string // Users is a map where keys are usernames and values are bcrypt-hashed passwords.
 	Realm string            // Realm is the protection space for the authentication. If empty, the default realm will be used by the browser (often "Restricted").
+
+	// UsersFile is an htpasswd file with additional users, see ParseHtpasswd.
+	// It is re-read when it changes. Users in Users take precedence.
+	UsersFile string
+
+	// StripAuthorization removes the Authorization header before the request
+	// is forwarded, so the password doesn't reach the backend.
+	StripAuthorization bool
+
+	// UserHeader, if set, is the request header the authenticated user is
+	// forwarded in. Client supplied values are always removed.
+	UserHeader string
 }
 
 type basicAuthMiddleware struct {
-	cfg *BasicAuthConfig
+	cfg  *BasicAuthConfig
+	file *fileStore[map[string]string]
 }
 
 func BasicAuth(cfg *BasicAuthConfig) Middleware {
-	return &basicAuthMiddleware{cfg: cfg}
+	mw := &basicAuthMiddleware{cfg: cfg}
+
+	if cfg.UsersFile != "" {
+		mw.file = newFileStore(cfg.UsersFile, ParseHtpasswd, fileCheckInterval)
+	}
+
+	return mw
 }
 
 func (mw *basicAuthMiddleware) Type() Type {
@@ -41,14 +65,18 @@ func (mw *basicAuthMiddleware) Type() Type {
 // even for non-existent users.
 func (mw *basicAuthMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mw.cfg.UserHeader != "" {
+			r.Header.Del(mw.cfg.UserHeader)
+		}
+
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
-			authenticate(w, mw.cfg.Realm)
+			mw.unauthorized(w, r, "missing_credentials")
 			return
 		}
 
 		if !strings.HasPrefix(auth, schema) {
-			authenticate(w, mw.cfg.Realm)
+			mw.unauthorized(w, r, "malformed_credentials")
 			return
 		}
 
@@ -56,20 +84,20 @@ func (mw *basicAuthMiddleware) Handler(next http.Handler) http.Handler {
 
 		credentials, err := base64.StdEncoding.DecodeString(rawCredentials)
 		if err != nil {
-			authenticate(w, mw.cfg.Realm)
+			mw.unauthorized(w, r, "malformed_credentials")
 			return
 		}
 
 		splitted := strings.SplitN(string(credentials), ":", 2)
 		if len(splitted) != 2 {
-			authenticate(w, mw.cfg.Realm)
+			mw.unauthorized(w, r, "malformed_credentials")
 			return
 		}
 
 		login := splitted[0]
 		password := splitted[1]
 
-		hash, ok := mw.cfg.Users[login]
+		hash, ok := mw.lookup(login)
 		if !ok {
 			// Perform a dummy bcrypt comparison to maintain constant-time behavior
 			// and mitigate timing attacks.
@@ -78,19 +106,62 @@ func (mw *basicAuthMiddleware) Handler(next http.Handler) http.Handler {
 				[]byte(password),
 			)
 
-			authenticate(w, mw.cfg.Realm)
+			mw.unauthorized(w, r, "invalid_credentials")
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
-			authenticate(w, mw.cfg.Realm)
+		if !comparePassword(hash, password) {
+			mw.unauthorized(w, r, "invalid_credentials")
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		if mw.cfg.StripAuthorization {
+			// The headers are copied, so the access log still sees the user.
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			r.Header.Del("Authorization")
+		}
+
+		if mw.cfg.UserHeader != "" {
+			r.Header.Set(mw.cfg.UserHeader, sanitizeHeaderValue(login))
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, login)))
 	})
 }
 
+type userKey struct{}
+
+// UserFromContext returns the user authenticated by the basic auth
+// middleware or, for the JWT and OIDC middlewares, the "sub" claim. It
+// returns an empty string for anonymous requests.
+func UserFromContext(ctx context.Context) string {
+	if user, ok := ctx.Value(userKey{}).(string); ok {
+		return user
+	}
+
+	sub, _ := ClaimsFromContext(ctx)["sub"].(string)
+	return sub
+}
+
+func (mw *basicAuthMiddleware) lookup(login string) (string, bool) {
+	if hash, ok := mw.cfg.Users[login]; ok {
+		return hash, true
+	}
+
+	if mw.file != nil {
+		hash, ok := mw.file.get()[login]
+		return hash, ok
+	}
+
+	return "", false
+}
+
+func (mw *basicAuthMiddleware) unauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	metrics.RecordAuthFailure(r, string(TypeBasicAuth), reason)
+	authenticate(w, mw.cfg.Realm)
+}
+
 func authenticate(w http.ResponseWriter, realm string) {
 	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
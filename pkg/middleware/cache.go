@@ -0,0 +1,642 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// Values of the X-Cache response header.
+const (
+	cacheHit         = "HIT"         // Served from the cache.
+	cacheMiss        = "MISS"        // Fetched from the backend.
+	cacheStale       = "STALE"       // Served from the cache after expiring.
+	cacheRevalidated = "REVALIDATED" // Served from the cache after the backend confirmed it.
+	cacheBypass      = "BYPASS"      // The request can't be served from the cache.
+)
+
+// CacheConfig holds the configuration for the cache middleware.
+type CacheConfig struct {
+	// MaxSize is the size of the memory cache in bytes. Responses with a body
+	// larger than MaxEntrySize are not stored.
+	MaxSize      int64
+	MaxEntrySize int64
+
+	// Disk, if set, keeps a copy of every stored response on disk.
+	Disk *DiskCache
+
+	// StaleWhileRevalidate and StaleIfError apply to responses without the
+	// Cache-Control directives of the same name (RFC 5861).
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-Proto
+	// header is believed for the scheme of the cached URL.
+	TrustedProxies []netip.Prefix
+}
+
+type cacheMiddleware struct {
+	cfg   *CacheConfig
+	store *cacheStore
+
+	mu      sync.Mutex
+	flights map[string]*cacheFlight
+}
+
+// cacheFlight is a running backend request that concurrent requests for
+// the same URL wait for instead of sending their own.
+type cacheFlight struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// release lets the waiting requests go on, e.g. as soon as the response
+// turns out not to be storable.
+func (f *cacheFlight) release() {
+	if f != nil {
+		f.once.Do(func() { close(f.done) })
+	}
+}
+
+func Cache(cfg *CacheConfig) Middleware {
+	return &cacheMiddleware{
+		cfg:     cfg,
+		store:   newCacheStore(cfg.MaxSize, cfg.Disk),
+		flights: make(map[string]*cacheFlight),
+	}
+}
+
+func (mw *cacheMiddleware) Type() Type {
+	return TypeCache
+}
+
+// Handler returns a middleware that caches backend responses as a shared
+// cache following RFC 9111: responses are stored as allowed by their
+// Cache-Control, Expires and Vary headers, served while fresh and
+// revalidated with ETag and Last-Modified once stale. The stale-while-
+// revalidate and stale-if-error extensions are supported; concurrent
+// misses for the same URL are sent to the backend once.
+//
+// Cached responses carry an Age header, and GET and HEAD responses an
+// X-Cache header with the outcome. Successful unsafe requests (e.g. POST)
+// invalidate the cached responses of their URL.
+//
+// The middleware should come after authentication middlewares, as cached
+// responses are served without passing the rest of the chain.
+func (mw *cacheMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mw.serveUnsafe(next, w, r)
+			return
+		}
+
+		reqCC := requestCacheControl(r.Header)
+
+		// Range requests are passed on, as partial responses are not stored.
+		if reqCC.has("no-store") || r.Header.Get("Range") != "" {
+			mw.pass(next, w, r, cacheBypass)
+			return
+		}
+
+		key := mw.cacheKey(r)
+		now := time.Now()
+
+		entry := mw.lookup(key, r)
+		if entry != nil {
+			if mw.fresh(entry, reqCC, now) {
+				mw.serve(w, r, entry, cacheHit)
+				return
+			}
+
+			if ok, revalidate := mw.usableStale(entry, reqCC, now); ok {
+				mw.serve(w, r, entry, cacheStale)
+				if revalidate {
+					mw.revalidate(next, r, key, entry, reqCC)
+				}
+				return
+			}
+		}
+
+		if reqCC.has("only-if-cached") {
+			recordCacheResult(r, cacheMiss)
+			w.Header().Set("X-Cache", cacheMiss)
+			http.Error(w, "Response not cached", http.StatusGatewayTimeout)
+			return
+		}
+
+		if r.Method == http.MethodHead {
+			mw.pass(next, w, r, cacheMiss)
+			return
+		}
+
+		mw.fetch(next, w, r, key, entry, reqCC)
+	})
+}
+
+func (mw *cacheMiddleware) lookup(key string, r *http.Request) *cacheEntry {
+	for _, entry := range mw.store.get(key) {
+		if entry.matches(r) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// fresh reports whether the entry may be served without contacting the
+// backend (RFC 9111, section 4.2).
+func (mw *cacheMiddleware) fresh(entry *cacheEntry, reqCC cacheControl, now time.Time) bool {
+	respCC := parseCacheControl(entry.Header.Values("Cache-Control"))
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+
+	age := entry.age(now)
+	lifetime := entry.freshnessLifetime()
+
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.duration("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+
+	return age < lifetime
+}
+
+// usableStale reports whether a stale entry may be served, because the
+// client accepts it with max-stale or it is within stale-while-revalidate.
+// In the latter case it is revalidated in the background.
+func (mw *cacheMiddleware) usableStale(entry *cacheEntry, reqCC cacheControl, now time.Time) (ok, revalidate bool) {
+	respCC := parseCacheControl(entry.Header.Values("Cache-Control"))
+	if reqCC.has("no-cache") || respCC.has("no-cache") || mustRevalidate(respCC) {
+		return false, false
+	}
+
+	age := entry.age(now)
+	staleness := age - entry.freshnessLifetime()
+
+	// Fresh entries end up here only if the request asked for fresher ones.
+	if staleness < 0 {
+		return false, false
+	}
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false, false
+	}
+
+	if arg, ok := reqCC["max-stale"]; ok {
+		maxStale, _ := reqCC.duration("max-stale")
+		if arg == "" || staleness <= maxStale {
+			return true, false
+		}
+	}
+
+	window := mw.cfg.StaleWhileRevalidate
+	if d, ok := respCC.duration("stale-while-revalidate"); ok {
+		window = d
+	}
+
+	return staleness <= window, true
+}
+
+// staleIfError reports whether the entry may be served instead of an error
+// response of the backend.
+func (mw *cacheMiddleware) staleIfError(entry *cacheEntry, reqCC cacheControl, now time.Time) bool {
+	respCC := parseCacheControl(entry.Header.Values("Cache-Control"))
+	if mustRevalidate(respCC) {
+		return false
+	}
+
+	window := mw.cfg.StaleIfError
+	if d, ok := respCC.duration("stale-if-error"); ok {
+		window = d
+	}
+	if d, ok := reqCC.duration("stale-if-error"); ok {
+		window = d
+	}
+
+	return entry.age(now)-entry.freshnessLifetime() <= window
+}
+
+// mustRevalidate reports whether a stale response must not be served without
+// revalidation. s-maxage implies proxy-revalidate.
+func mustRevalidate(cc cacheControl) bool {
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+}
+
+// fetch forwards a GET request to the backend, revalidating the stale entry
+// if there is one, and stores the response. Concurrent requests for the same
+// URL wait for the first one and are served from its response.
+func (mw *cacheMiddleware) fetch(next http.Handler, w http.ResponseWriter, r *http.Request, key string, stale *cacheEntry, reqCC cacheControl) {
+	flight, leader := mw.join(key)
+	if leader {
+		defer mw.leave(key, flight)
+	} else {
+		select {
+		case <-flight.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		if entry := mw.lookup(key, r); entry != nil && mw.fresh(entry, reqCC, time.Now()) {
+			mw.serve(w, r, entry, cacheHit)
+			return
+		}
+
+		// The response was not stored, e.g. because it varies by a
+		// header this request differs in, so it is fetched on its own.
+		flight = nil
+	}
+
+	req := r
+	if stale != nil {
+		req = revalidationRequest(r.Context(), r, stale)
+	}
+
+	entry, result := mw.forward(next, w, req, key, stale, reqCC, flight)
+	if entry == nil {
+		recordCacheResult(r, cacheMiss)
+		return
+	}
+
+	mw.serve(w, r, entry, result)
+}
+
+// revalidate refreshes the stale entry in the background.
+func (mw *cacheMiddleware) revalidate(next http.Handler, r *http.Request, key string, stale *cacheEntry, reqCC cacheControl) {
+	flight, leader := mw.join(key)
+	if !leader {
+		return
+	}
+
+	req := revalidationRequest(context.WithoutCancel(r.Context()), r, stale)
+
+	go func() {
+		defer mw.leave(key, flight)
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				slog.Error("panic in cache revalidation", slog.Any("error", err))
+			}
+		}()
+
+		mw.forward(next, &discardResponseWriter{header: make(http.Header)}, req, key, stale, reqCC, flight)
+	}()
+}
+
+// revalidationRequest returns a GET request for the URL of r with the
+// validators of the stale entry. The client's own conditions are removed, so
+// a 304 response always refers to the stored one.
+func revalidationRequest(ctx context.Context, r *http.Request, stale *cacheEntry) *http.Request {
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	if etag := stale.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return req
+}
+
+// forward sends the request down the chain and stores the response if
+// allowed. The response is written to w, unless a cached entry is to be
+// served instead: it then returns the entry and the X-Cache result.
+func (mw *cacheMiddleware) forward(next http.Handler, w http.ResponseWriter, r *http.Request, key string, stale *cacheEntry, reqCC cacheControl, flight *cacheFlight) (*cacheEntry, string) {
+	cw := &cacheWriter{
+		ResponseWriter: w,
+		mw:             mw,
+		r:              r,
+		header:         make(http.Header),
+		stale:          stale,
+		reqCC:          reqCC,
+		flight:         flight,
+		requestTime:    time.Now(),
+	}
+
+	next.ServeHTTP(cw, r)
+
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case cw.discard && cw.status == http.StatusNotModified:
+		entry := stale.revalidated(cw.header, cw.requestTime, cw.responseTime)
+		mw.store.put(key, entry)
+		return entry, cacheRevalidated
+
+	case cw.discard:
+		return stale, cacheStale
+
+	case cw.store && cw.complete():
+		mw.store.put(key, cw.entry())
+	}
+
+	cw.copyTrailers()
+
+	return nil, ""
+}
+
+func (mw *cacheMiddleware) join(key string) (*cacheFlight, bool) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if flight, ok := mw.flights[key]; ok {
+		return flight, false
+	}
+
+	flight := &cacheFlight{done: make(chan struct{})}
+	mw.flights[key] = flight
+
+	return flight, true
+}
+
+func (mw *cacheMiddleware) leave(key string, flight *cacheFlight) {
+	mw.mu.Lock()
+	if mw.flights[key] == flight {
+		delete(mw.flights, key)
+	}
+	mw.mu.Unlock()
+
+	flight.release()
+}
+
+// serve writes a cached response, answering the client's conditions with
+// 304 Not Modified where they match.
+func (mw *cacheMiddleware) serve(w http.ResponseWriter, r *http.Request, entry *cacheEntry, result string) {
+	recordCacheResult(r, result)
+
+	h := w.Header()
+	for name, values := range entry.Header {
+		h[name] = slices.Clone(values)
+	}
+	h.Set("Age", strconv.FormatInt(int64(entry.age(time.Now())/time.Second), 10))
+	h.Set("X-Cache", result)
+
+	if entry.Status == http.StatusOK && notModified(r, entry.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if entry.Status != http.StatusNoContent {
+		h.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	}
+	w.WriteHeader(entry.Status)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// pass forwards a request that is not served from the cache.
+func (mw *cacheMiddleware) pass(next http.Handler, w http.ResponseWriter, r *http.Request, result string) {
+	recordCacheResult(r, result)
+	w.Header().Set("X-Cache", result)
+
+	next.ServeHTTP(w, r)
+}
+
+// serveUnsafe forwards a request with an unsafe method, e.g. POST, and
+// invalidates the cached responses of its URL and of the Location and
+// Content-Location of a successful response (RFC 9111, section 4.4).
+func (mw *cacheMiddleware) serveUnsafe(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	sw := &latencyWriter{ResponseWriter: w, start: time.Now(), status: http.StatusOK}
+	next.ServeHTTP(sw, r)
+
+	safe := r.Method == http.MethodOptions || r.Method == http.MethodTrace
+	if safe || sw.status < http.StatusOK || sw.status >= http.StatusBadRequest {
+		return
+	}
+
+	mw.store.remove(mw.cacheKey(r))
+
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := w.Header().Get(name)
+		if value == "" {
+			continue
+		}
+
+		location, err := r.URL.Parse(value)
+		if err != nil {
+			continue
+		}
+
+		// Only URLs of the same origin may be invalidated.
+		if location.Host == "" || strings.EqualFold(location.Host, r.Host) {
+			mw.store.remove(requestScheme(r, mw.cfg.TrustedProxies) + "://" + strings.ToLower(r.Host) + location.RequestURI())
+		}
+	}
+}
+
+func recordCacheResult(r *http.Request, result string) {
+	metrics.CacheRequests.WithLabelValues(metrics.RouteFromContext(r.Context()), strings.ToLower(result)).Inc()
+}
+
+// cacheKey identifies the URL of the request. HEAD requests share the key of
+// GET requests, as they can be answered from the stored GET response.
+func (mw *cacheMiddleware) cacheKey(r *http.Request) string {
+	return requestScheme(r, mw.cfg.TrustedProxies) + "://" + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// revalidated returns the entry with the header fields of a 304 response
+// applied (RFC 9111, section 4.3.4).
+func (e *cacheEntry) revalidated(h http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+
+	for name, values := range h {
+		if name == "Content-Length" || name == "X-Cache" {
+			continue
+		}
+		updated.Header[name] = slices.Clone(values)
+	}
+
+	updated.ResponseTime = responseTime
+	updated.InitialAge = initialAge(h, requestTime, responseTime)
+	updated.Header.Del("Age")
+
+	return &updated
+}
+
+// cacheWriter passes the response to the client and captures it for the
+// cache. It can also hold back the response, when the cached entry is served
+// instead: on 304 Not Modified for a revalidation, or on a server error if
+// stale-if-error allows it.
+type cacheWriter struct {
+	http.ResponseWriter
+	mw     *cacheMiddleware
+	r      *http.Request
+	header http.Header // the response header of the chain below
+	stale  *cacheEntry
+	reqCC  cacheControl
+	flight *cacheFlight
+
+	requestTime  time.Time
+	responseTime time.Time
+	status       int
+	wroteHeader  bool
+
+	discard bool         // the response is held back
+	store   bool         // the response is being captured
+	body    bytes.Buffer // the captured body
+}
+
+func (w *cacheWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.wroteHeader = true
+	w.status = code
+	w.responseTime = time.Now()
+
+	if w.stale != nil {
+		w.discard = code == http.StatusNotModified ||
+			(isServerError(code) && w.mw.staleIfError(w.stale, w.reqCC, w.responseTime))
+	}
+	if w.discard {
+		return
+	}
+
+	w.store = storable(w.r, code, w.header)
+	if !w.store {
+		w.flight.release()
+	}
+
+	h := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		h[name] = values
+	}
+	h.Set("X-Cache", cacheMiss)
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.store {
+		if int64(w.body.Len()+len(b)) > w.mw.cfg.MaxEntrySize {
+			w.store = false
+			w.body = bytes.Buffer{}
+			w.flight.release()
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	if w.discard {
+		return len(b), nil
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil && w.store {
+		// The client is gone; the body would be cut off for the cache too.
+		w.store = false
+		w.flight.release()
+	}
+
+	return n, err
+}
+
+func (w *cacheWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.discard {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// copyTrailers passes on the header fields set after the body was written.
+func (w *cacheWriter) copyTrailers() {
+	h := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		if _, ok := h[name]; !ok {
+			h[name] = values
+		}
+	}
+}
+
+// complete reports whether the whole body was captured, as far as the
+// Content-Length tells.
+func (w *cacheWriter) complete() bool {
+	length, err := strconv.Atoi(w.header.Get("Content-Length"))
+	return err != nil || length == w.body.Len()
+}
+
+// entry returns the captured response as a cache entry.
+func (w *cacheWriter) entry() *cacheEntry {
+	h := w.header.Clone()
+	h.Del("Age")
+	h.Del("X-Cache")
+	for name := range h {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			delete(h, name)
+		}
+	}
+
+	vary := varyNames(h)
+
+	return &cacheEntry{
+		Status:       w.status,
+		Header:       h,
+		Body:         w.body.Bytes(),
+		ResponseTime: w.responseTime,
+		InitialAge:   initialAge(w.header, w.requestTime, w.responseTime),
+		Vary:         vary,
+		VaryValues:   varyValues(w.r, vary),
+	}
+}
+
+func isServerError(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// discardResponseWriter is the client of background revalidations.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
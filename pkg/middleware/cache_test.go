@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheBackend counts the requests that reach the backend.
+type cacheBackend struct {
+	calls   atomic.Int32
+	handler http.HandlerFunc
+}
+
+func (b *cacheBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.calls.Add(1)
+	b.handler(w, r)
+}
+
+func newTestCache(t *testing.T, disk *DiskCache, backend http.Handler) http.Handler {
+	t.Helper()
+
+	return Cache(&CacheConfig{MaxSize: 1 << 20, MaxEntrySize: 1 << 16, Disk: disk}).Handler(backend)
+}
+
+// cacheGet sends a GET request with the headers through the handler.
+func cacheGet(handler http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestCacheFreshness(t *testing.T) {
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/aged" {
+			// Already older than its lifetime when it arrives.
+			w.Header().Set("Age", "120")
+		}
+		w.Write([]byte("body"))
+	}}
+	handler := newTestCache(t, nil, backend)
+
+	if w := cacheGet(handler, "/page"); w.Header().Get("X-Cache") != cacheMiss {
+		t.Fatalf("first request: X-Cache %q", w.Header().Get("X-Cache"))
+	}
+
+	w := cacheGet(handler, "/page")
+	if w.Header().Get("X-Cache") != cacheHit || w.Body.String() != "body" {
+		t.Errorf("second request: X-Cache %q, body %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w.Header().Get("Age") == "" {
+		t.Error("a cached response has no Age header")
+	}
+
+	// The client may ask for a response from the backend.
+	if w := cacheGet(handler, "/page", "Cache-Control", "no-cache"); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("no-cache request: X-Cache %q", w.Header().Get("X-Cache"))
+	}
+
+	cacheGet(handler, "/aged")
+	if w := cacheGet(handler, "/aged"); w.Header().Get("X-Cache") != cacheMiss {
+		t.Errorf("stale response: X-Cache %q", w.Header().Get("X-Cache"))
+	}
+
+	if calls := backend.calls.Load(); calls != 4 {
+		t.Errorf("got %d backend requests, want 4", calls)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("lang=" + r.Header.Get("Accept-Language")))
+	}}
+	handler := newTestCache(t, nil, backend)
+
+	cacheGet(handler, "/", "Accept-Language", "en")
+	cacheGet(handler, "/", "Accept-Language", "de")
+
+	for _, lang := range []string{"en", "de"} {
+		w := cacheGet(handler, "/", "Accept-Language", lang)
+		if w.Header().Get("X-Cache") != cacheHit || w.Body.String() != "lang="+lang {
+			t.Errorf("%s: X-Cache %q, body %q", lang, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+
+	if calls := backend.calls.Load(); calls != 2 {
+		t.Errorf("got %d backend requests, want one per variant", calls)
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var conditional atomic.Int32
+
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte("body"))
+	}}
+	handler := newTestCache(t, nil, backend)
+
+	cacheGet(handler, "/")
+
+	w := cacheGet(handler, "/")
+	if w.Code != http.StatusOK || w.Body.String() != "body" {
+		t.Errorf("status %d, body %q, want the stored response", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Cache") != cacheRevalidated {
+		t.Errorf("X-Cache %q, want %s", w.Header().Get("X-Cache"), cacheRevalidated)
+	}
+	if conditional.Load() != 1 {
+		t.Errorf("got %d conditional requests, want 1", conditional.Load())
+	}
+
+	// The client's own validator is answered from the revalidated entry.
+	if w := cacheGet(handler, "/", "If-None-Match", `"v1"`); w.Code != http.StatusNotModified {
+		t.Errorf("conditional request: status %d", w.Code)
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}}
+	handler := newTestCache(t, nil, backend)
+
+	const requests = 10
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, requests)
+
+	wg.Go(func() { results[0] = cacheGet(handler, "/") })
+	<-started
+
+	for i := 1; i < requests; i++ {
+		wg.Go(func() { results[i] = cacheGet(handler, "/") })
+	}
+
+	// Give the followers time to join the running request.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, w := range results {
+		if w.Code != http.StatusOK || w.Body.String() != "body" {
+			t.Errorf("request %d: status %d, body %q", i, w.Code, w.Body.String())
+		}
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("got %d backend requests, want 1", calls)
+	}
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+
+	disk, err := OpenDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}}
+
+	cacheGet(newTestCache(t, disk, backend), "/")
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files in the disk cache, want 1", len(files))
+	}
+
+	// A new middleware, e.g. after a config reload, starts with an empty
+	// memory cache and loads the response from disk.
+	w := cacheGet(newTestCache(t, disk, backend), "/")
+	if w.Header().Get("X-Cache") != cacheHit || w.Body.String() != "body" {
+		t.Errorf("X-Cache %q, body %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if calls := backend.calls.Load(); calls != 1 {
+		t.Errorf("got %d backend requests, want 1", calls)
+	}
+}
+
+func TestCacheCredentialedRequests(t *testing.T) {
+	backend := &cacheBackend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		w.Write([]byte("body"))
+	}}
+	handler := newTestCache(t, nil, backend)
+
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		stored bool
+	}{
+		{name: "anonymous", target: "/anonymous?cc=max-age=60", stored: true},
+		{name: "authorization", target: "/authorization?cc=max-age=60", header: []string{"Authorization", "Bearer token"}},
+		{name: "cookie", target: "/cookie?cc=max-age=60", header: []string{"Cookie", "session=alice"}},
+		{name: "api key", target: "/api-key?cc=max-age=60", header: []string{"X-API-Key", "secret"}},
+		{name: "public", target: "/public?cc=public,max-age=60", header: []string{"Cookie", "session=alice"}, stored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheGet(handler, tt.target, tt.header...)
+
+			stored := cacheGet(handler, tt.target).Header().Get("X-Cache") == cacheHit
+			if stored != tt.stored {
+				t.Errorf("stored %t, want %t", stored, tt.stored)
+			}
+		})
+	}
+
+	// Requests authenticated by a middleware before the cache carry no
+	// credentials anymore, e.g. the API key is stripped.
+	authenticated := APIKey(&APIKeyConfig{
+		HeaderName: "X-API-Key",
+		Keys:       map[string]string{"alice": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"},
+	}).Handler(handler)
+
+	cacheGet(authenticated, "/consumer?cc=max-age=60", "X-API-Key", "secret")
+	if w := cacheGet(handler, "/consumer?cc=max-age=60"); w.Header().Get("X-Cache") == cacheHit {
+		t.Error("the response to an authenticated consumer was stored")
+	}
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicMaxLifetime caps the freshness lifetime derived from Last-Modified
+// for responses without explicit expiration.
+const heuristicMaxLifetime = 24 * time.Hour
+
+// cacheControl holds the directives of Cache-Control header fields, keyed
+// by their lower case name. Directives without an argument map to "".
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, ok := cc[name]; ok {
+				// Only the first occurrence of a directive counts.
+				continue
+			}
+
+			cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+
+	return cc
+}
+
+// requestCacheControl also honours "Pragma: no-cache" of HTTP/1.0 clients
+// when the request has no Cache-Control header.
+func requestCacheControl(h http.Header) cacheControl {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+
+	if len(h.Values("Cache-Control")) == 0 && headerHasToken(h.Values("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// duration returns the delta-seconds argument of the directive and whether
+// the directive is present. An invalid argument is treated as 0, so e.g. an
+// invalid max-age makes the response stale.
+func (cc cacheControl) duration(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+
+	return time.Duration(min(seconds, int64(1<<31))) * time.Second, true
+}
+
+// heuristicStatuses are the status codes that may be cached without explicit
+// expiration (RFC 9110, section 15.1). 206 is left out as partial responses
+// are not stored.
+var heuristicStatuses = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+	http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+	http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+	http.StatusRequestURITooLong, http.StatusNotImplemented,
+}
+
+// storable reports whether a shared cache may store the response to the
+// request (RFC 9111, section 3). Responses setting cookies are not stored
+// either, so one client's session is never handed to another. Requests with
+// credentials other than Authorization are treated like the ones with it, see
+// credentialed.
+func storable(r *http.Request, status int, h http.Header) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if status < http.StatusOK || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	if len(h.Values("Set-Cookie")) > 0 || len(h.Values("Trailer")) > 0 || headerHasToken(h.Values("Vary"), "*") {
+		return false
+	}
+
+	if credentialed(r) && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	return cc.has("public") || cc.has("max-age") || cc.has("s-maxage") ||
+		len(h.Values("Expires")) > 0 || slices.Contains(heuristicStatuses, status)
+}
+
+// credentialed reports whether the request carries credentials, e.g. a
+// session cookie or an API key, or was authenticated by a middleware before
+// the cache. The response may then be personalized.
+func credentialed(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || r.Header.Get("X-API-Key") != "" {
+		return true
+	}
+
+	ctx := r.Context()
+
+	return ConsumerFromContext(ctx) != "" || UserFromContext(ctx) != "" || ClaimsFromContext(ctx) != nil
+}
+
+// freshnessLifetime returns how long a stored response is fresh for a shared
+// cache (RFC 9111, section 4.2.1).
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header.Values("Cache-Control"))
+
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return max(t.Sub(e.date()), 0)
+	}
+
+	if !slices.Contains(heuristicStatuses, e.Status) {
+		return 0
+	}
+
+	// Like most caches, use 10% of the time since the last modification.
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+
+	return min(max(e.date().Sub(lastModified)/10, 0), heuristicMaxLifetime)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+
+	return e.ResponseTime
+}
+
+// age returns the current age of the response (RFC 9111, section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + max(now.Sub(e.ResponseTime), 0)
+}
+
+// initialAge is the corrected initial age of a response received at
+// responseTime for a request sent at requestTime.
+func initialAge(h http.Header, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		apparentAge = max(responseTime.Sub(date), 0)
+	}
+
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+
+	return max(apparentAge, ageValue+responseTime.Sub(requestTime))
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since of a GET or HEAD
+// request against the headers of a stored 200 response (RFC 9110, section
+// 13.2.2).
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Values("If-None-Match"); len(inm) > 0 {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+
+		for _, value := range inm {
+			for tag := range strings.SplitSeq(value, ",") {
+				tag = strings.TrimSpace(tag)
+				if tag == "*" || (etag != "" && strings.TrimPrefix(tag, "W/") == etag) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ims)
+}
+
+// headerHasToken reports whether the comma-separated header values contain
+// the token, ignoring case.
+func headerHasToken(values []string, token string) bool {
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,439 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+)
+
+// maxCacheVariants is the number of variants (see Vary) kept per URL.
+const maxCacheVariants = 16
+
+// cacheEntryOverhead approximates the memory used by an entry besides its
+// body and header bytes.
+const cacheEntryOverhead = 256
+
+// cacheEntry is a stored response. Entries are never modified once stored,
+// so they can be served without holding a lock.
+type cacheEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// ResponseTime is when the response was received, InitialAge its
+	// corrected initial age (RFC 9111, section 4.2.3).
+	ResponseTime time.Time
+	InitialAge   time.Duration
+
+	// Vary lists the request headers named by the Vary header, VaryValues
+	// their values in the request the response was stored for.
+	Vary       []string
+	VaryValues []string
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.Body) + cacheEntryOverhead
+	for name, values := range e.Header {
+		n += len(name)
+		for _, v := range values {
+			n += len(v)
+		}
+	}
+
+	return int64(n)
+}
+
+// matches reports whether the entry was stored for a request with the same
+// values of the Vary headers (RFC 9111, section 4.1).
+func (e *cacheEntry) matches(r *http.Request) bool {
+	return slices.Equal(e.VaryValues, varyValues(r, e.Vary))
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// varyValues returns the values of the named request headers, with the
+// whitespace around list elements removed.
+func varyValues(r *http.Request, names []string) []string {
+	values := make([]string, len(names))
+
+	for i, name := range names {
+		var parts []string
+		for _, value := range r.Header.Values(name) {
+			for part := range strings.SplitSeq(value, ",") {
+				parts = append(parts, strings.TrimSpace(part))
+			}
+		}
+		values[i] = strings.Join(parts, ",")
+	}
+
+	return values
+}
+
+// cacheStore keeps the variants of the cached URLs in memory, bounded by
+// their total size, and evicts the least recently used URL first. With a
+// disk tier, every stored URL is also written to disk and URLs missing in
+// memory are loaded from there.
+type cacheStore struct {
+	maxSize int64
+	disk    *DiskCache
+
+	mu    sync.Mutex
+	size  int64
+	ll    list.List // of *cacheItem, most recently used first
+	items map[string]*list.Element
+}
+
+type cacheItem struct {
+	key      string
+	variants []*cacheEntry
+	size     int64
+}
+
+func newCacheStore(maxSize int64, disk *DiskCache) *cacheStore {
+	return &cacheStore{
+		maxSize: maxSize,
+		disk:    disk,
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the variants stored for key, most recently stored first.
+func (s *cacheStore) get(key string) []*cacheEntry {
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		variants := el.Value.(*cacheItem).variants
+		s.mu.Unlock()
+		return variants
+	}
+	s.mu.Unlock()
+
+	if s.disk == nil {
+		return nil
+	}
+
+	variants := s.disk.load(key)
+	if variants != nil {
+		s.mu.Lock()
+		s.set(key, variants)
+		s.mu.Unlock()
+	}
+
+	return variants
+}
+
+// put stores the entry, replacing the variant for the same request headers.
+// A changed Vary header replaces all variants.
+func (s *cacheStore) put(key string, entry *cacheEntry) {
+	s.mu.Lock()
+
+	variants := []*cacheEntry{entry}
+	if el, ok := s.items[key]; ok {
+		for _, v := range el.Value.(*cacheItem).variants {
+			if len(variants) < maxCacheVariants &&
+				slices.Equal(v.Vary, entry.Vary) && !slices.Equal(v.VaryValues, entry.VaryValues) {
+				variants = append(variants, v)
+			}
+		}
+	}
+	s.set(key, variants)
+
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		s.disk.store(key, variants)
+	}
+}
+
+func (s *cacheStore) remove(key string) {
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		s.disk.remove(key)
+	}
+}
+
+// set must be called with mu held.
+func (s *cacheStore) set(key string, variants []*cacheEntry) {
+	if el, ok := s.items[key]; ok {
+		s.removeElement(el)
+	}
+
+	item := &cacheItem{key: key, variants: variants}
+	for _, v := range variants {
+		item.size += v.size()
+	}
+
+	s.items[key] = s.ll.PushFront(item)
+	s.size += item.size
+
+	for s.size > s.maxSize && s.ll.Len() > 0 {
+		s.removeElement(s.ll.Back())
+	}
+}
+
+func (s *cacheStore) removeElement(el *list.Element) {
+	item := s.ll.Remove(el).(*cacheItem)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
+
+// DiskCache is the disk tier of the cache middleware: one file per URL in a
+// directory, bounded by the total size of the files. It outlives config
+// reloads and restarts of the proxy.
+type DiskCache struct {
+	dir string
+
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	ll      list.List // of *diskItem, most recently used first
+	items   map[string]*list.Element
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// diskRecord is the content of a cache file. The key guards against files
+// of other keys with the same name.
+type diskRecord struct {
+	Key      string
+	Variants []*cacheEntry
+}
+
+const diskCacheExt = ".cache"
+
+var (
+	diskCachesMu sync.Mutex
+	diskCaches   = make(map[string]*DiskCache)
+)
+
+// OpenDiskCache opens the disk cache in dir, creating the directory if it
+// doesn't exist. Files beyond maxSize are removed, the least recently
+// written first. Disk caches are shared per directory, so middlewares
+// rebuilt on a config reload keep the index instead of rebuilding it.
+func OpenDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	diskCachesMu.Lock()
+	defer diskCachesMu.Unlock()
+
+	if c, ok := diskCaches[dir]; ok {
+		c.mu.Lock()
+		c.maxSize = maxSize
+		c.evict()
+		c.mu.Unlock()
+
+		return c, nil
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+	}
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+
+	diskCaches[dir] = c
+
+	return c, nil
+}
+
+// scan builds the index from the files in the directory.
+func (c *DiskCache) scan() error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []file
+	for _, de := range dirEntries {
+		name := de.Name()
+
+		if strings.HasSuffix(name, ".tmp") {
+			// Left behind by an interrupted write.
+			os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		if !de.Type().IsRegular() || !strings.HasSuffix(name, diskCacheExt) {
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name: name, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	slices.SortFunc(files, func(a, b file) int { return a.modTime.Compare(b.modTime) })
+
+	for _, f := range files {
+		c.items[f.name] = c.ll.PushFront(&diskItem{name: f.name, size: f.size})
+		c.size += f.size
+	}
+	c.evict()
+
+	return nil
+}
+
+func diskFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskCacheExt
+}
+
+func (c *DiskCache) load(key string) []*cacheEntry {
+	name := diskFileName(key)
+
+	c.mu.Lock()
+	el, ok := c.items[name]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		c.remove(key)
+		return nil
+	}
+
+	var record diskRecord
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+	if err == nil && record.Key != key {
+		err = errors.New("key mismatch")
+	}
+	if err != nil {
+		slog.Warn("removing unreadable cache file", slog.String("file", name), logger.Error(err))
+		c.remove(key)
+		return nil
+	}
+
+	return record.Variants
+}
+
+func (c *DiskCache) store(key string, variants []*cacheEntry) {
+	name := diskFileName(key)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(diskRecord{Key: key, Variants: variants}); err != nil {
+		slog.Error("failed to encode cache entry", logger.Error(err))
+		return
+	}
+
+	if err := c.writeFile(name, buf.Bytes()); err != nil {
+		slog.Error("failed to write cache file", slog.String("dir", c.dir), logger.Error(err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.size -= c.ll.Remove(el).(*diskItem).size
+	}
+
+	c.items[name] = c.ll.PushFront(&diskItem{name: name, size: int64(buf.Len())})
+	c.size += int64(buf.Len())
+	c.evict()
+}
+
+// writeFile writes the file atomically, so a concurrent load never reads a
+// partial file.
+func (c *DiskCache) writeFile(name string, data []byte) error {
+	f, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+func (c *DiskCache) remove(key string) {
+	name := diskFileName(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		c.removeElement(el)
+	}
+}
+
+// evict must be called with mu held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxSize && c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *DiskCache) removeElement(el *list.Element) {
+	item := c.ll.Remove(el).(*diskItem)
+	delete(c.items, item.name)
+	c.size -= item.size
+
+	if err := os.Remove(filepath.Join(c.dir, item.name)); err != nil && !os.IsNotExist(err) {
+		slog.Error("failed to remove cache file", slog.String("file", item.name), logger.Error(err))
+	}
+}
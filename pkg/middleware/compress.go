@@ -1,86 +1,161 @@
 package middleware
 
 import (
-	"bytes"
 	"compress/gzip"
+	"io"
 	"log/slog"
 	"net/http"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
 )
 
+// gzipResponseWriter buffers the beginning of the response until it is known
+// whether the body reaches the minimum size. Small bodies are sent as is,
+// larger ones are compressed with a pooled gzip.Writer.
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	gw             *gzip.Writer
-	buf            *bytes.Buffer
-	size           int
-	level          int
-	minSize        int
-	contentType    string
-	shouldCompress bool
-	allowedTypes   []string
+	mw *compressMiddleware
+
+	gw         *gzip.Writer
+	buf        []byte
+	statusCode int
+
+	// compressible is true when the Content-Type allows compression and the
+	// response doesn't carry its own Content-Encoding.
+	compressible bool
+	wroteHeader  bool // WriteHeader was called by the next handler
+	headerSent   bool // WriteHeader was forwarded to the underlying writer
 }
 
-func (c *gzipResponseWriter) WriteHeader(code int) {
-	c.contentType = c.Header().Get("Content-Type")
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.statusCode = code
+
+	contentType := gw.Header().Get("Content-Type")
+	contentTypeBase := strings.TrimSpace(strings.Split(contentType, ";")[0])
 
-	contentTypeBase := strings.Split(c.contentType, ";")[0]
-	c.shouldCompress = slices.Contains(c.allowedTypes, contentTypeBase)
+	gw.compressible = slices.Contains(gw.mw.cfg.Types, contentTypeBase) &&
+		gw.Header().Get("Content-Encoding") == "" &&
+		code != http.StatusNoContent && code != http.StatusNotModified
 
-	if c.shouldCompress {
-		c.Header().Set("Content-Encoding", "gzip")
-		c.Header().Set("Vary", "Accept-Encoding")
+	if !gw.compressible {
+		gw.sendHeader()
+		return
 	}
 
-	c.ResponseWriter.WriteHeader(code)
+	gw.Header().Add("Vary", "Accept-Encoding")
 }
 
 func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
-	if !gw.shouldCompress {
-		return gw.ResponseWriter.Write(b)
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
 	}
 
-	if gw.size == 0 {
-		gw.buf = &bytes.Buffer{}
+	if gw.gw != nil {
+		return gw.gw.Write(b)
+	}
 
-		var err error
-		gw.gw, err = gzip.NewWriterLevel(gw.buf, gw.level)
-		if err != nil {
-			slog.Error("failed to set gzip level", logger.Error(err))
-			return gw.ResponseWriter.Write(b)
-		}
+	if !gw.compressible {
+		return gw.ResponseWriter.Write(b)
+	}
 
+	if len(gw.buf)+len(b) < gw.mw.cfg.MinSize {
+		gw.buf = append(gw.buf, b...)
+		return len(b), nil
 	}
 
-	gw.size += len(b)
-	if gw.size > gw.minSize {
-		return gw.gw.Write(b)
+	// Large writes go straight to the compressor instead of being copied
+	// into the buffer first.
+	if err := gw.startGzip(); err != nil {
+		return 0, err
 	}
 
-	return gw.buf.Write(b)
+	return gw.gw.Write(b)
 }
 
-func (gw *gzipResponseWriter) Close() error {
-	if !gw.shouldCompress {
-		return nil
+// startGzip switches the writer to compressed mode and flushes the buffered bytes.
+func (gw *gzipResponseWriter) startGzip() error {
+	gw.Header().Set("Content-Encoding", "gzip")
+	gw.Header().Del("Content-Length")
+	gw.sendHeader()
+
+	gw.gw = gw.mw.pool.Get().(*gzip.Writer)
+	gw.gw.Reset(gw.ResponseWriter)
+
+	buf := gw.buf
+	gw.buf = nil
+
+	_, err := gw.gw.Write(buf)
+	return err
+}
+
+func (gw *gzipResponseWriter) sendHeader() {
+	if gw.headerSent {
+		return
 	}
+	gw.headerSent = true
 
-	if gw.gw == nil {
-		if gw.buf != nil {
-			_, _ = gw.ResponseWriter.Write(gw.buf.Bytes())
-		}
+	gw.ResponseWriter.WriteHeader(gw.statusCode)
+}
+
+// Close finishes the response: it flushes the gzip stream or, if the body
+// never reached MinSize, sends the buffered bytes uncompressed.
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gw != nil {
+		err := gw.gw.Close()
+
+		gw.gw.Reset(io.Discard)
+		gw.mw.pool.Put(gw.gw)
+		gw.gw = nil
 
+		return err
+	}
+
+	if !gw.wroteHeader {
 		return nil
 	}
 
-	if err := gw.gw.Close(); err != nil {
+	gw.sendHeader()
+
+	if len(gw.buf) > 0 {
+		_, err := gw.ResponseWriter.Write(gw.buf)
 		return err
 	}
 
-	_, err := gw.ResponseWriter.Write(gw.buf.Bytes())
-	return err
+	return nil
+}
+
+// Flush sends what was written so far. A body still below MinSize is
+// compressed from here on, as its final size isn't known yet.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if gw.compressible && gw.gw == nil {
+		if err := gw.startGzip(); err != nil {
+			return
+		}
+	}
+
+	if gw.gw != nil {
+		if err := gw.gw.Flush(); err != nil {
+			return
+		}
+	}
+
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
 }
 
 // CompressConfig defines the configuration for gzip compression middleware.
@@ -104,11 +179,23 @@ type CompressConfig struct {
 }
 
 type compressMiddleware struct {
-	cfg *CompressConfig
+	cfg  *CompressConfig
+	pool sync.Pool
 }
 
 func Compress(cfg *CompressConfig) Middleware {
-	return &compressMiddleware{cfg: cfg}
+	cfg.validateLevel()
+
+	mw := &compressMiddleware{cfg: cfg}
+
+	// gzip.Writer keeps large internal state (~800KB for the compressor), so the
+	// writers are reused across requests instead of being allocated each time.
+	mw.pool.New = func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, cfg.Level)
+		return w
+	}
+
+	return mw
 }
 
 func (mw *compressMiddleware) Type() Type {
@@ -122,8 +209,6 @@ func (mw *compressMiddleware) Type() Type {
 // The middleware uses a lazy-write strategy: small responses are buffered and only
 // compressed if they exceed MinSize. This avoids overhead for tiny payloads.
 func (mw *compressMiddleware) Handler(next http.Handler) http.Handler {
-	mw.cfg.validateLevel()
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		acceptEncoding := r.Header.Get("Accept-Encoding")
 		if !strings.Contains(acceptEncoding, "gzip") {
@@ -133,23 +218,20 @@ func (mw *compressMiddleware) Handler(next http.Handler) http.Handler {
 
 		gw := &gzipResponseWriter{
 			ResponseWriter: w,
-			level:          mw.cfg.Level,
-			minSize:        mw.cfg.MinSize,
-			allowedTypes:   mw.cfg.Types,
+			mw:             mw,
+			statusCode:     http.StatusOK,
 		}
 
 		next.ServeHTTP(gw, r)
 
 		if err := gw.Close(); err != nil {
-			slog.Error("failed to close gzip writer", slog.Any("error", err))
+			slog.Error("failed to close gzip writer", logger.Error(err))
 		}
 	})
 }
 
 func (c *CompressConfig) validateLevel() {
-	levels := []int{gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression}
-
-	if !slices.Contains(levels, c.Level) {
+	if c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression {
 		slog.Warn("invalid gzip compression level, falling back to DefaultCompression", slog.Int("provided_level", c.Level))
 		c.Level = gzip.DefaultCompression
 	}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// discardWriter is a minimal http.ResponseWriter that drops the body.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// BenchmarkCompress compresses a large JSON response with the pooled gzip
+// writers of one middleware and, for comparison, with a new middleware and
+// therefore a new gzip writer per request. gc/op is the number of garbage
+// collections per request.
+func BenchmarkCompress(b *testing.B) {
+	body := bytes.Repeat([]byte(`{"id":12345,"name":"example","tags":["a","b","c"]},`), 20000) // ~1MB
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+
+	newHandler := func() http.Handler {
+		cfg := &CompressConfig{MinSize: 1024, Level: 5, Types: []string{"application/json"}}
+		return Compress(cfg).Handler(backend)
+	}
+
+	pooled := newHandler()
+
+	benchmarks := []struct {
+		name    string
+		handler func() http.Handler
+	}{
+		{name: "pooled", handler: func() http.Handler { return pooled }},
+		{name: "unpooled", handler: newHandler},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			defer reportGC(b)()
+
+			for b.Loop() {
+				bm.handler().ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []int
+		flush    bool // after the first write
+		encoding string
+	}{
+		{name: "below min size", writes: []int{100, 100}, encoding: ""},
+		{name: "small writes", writes: []int{600, 600, 600}, encoding: "gzip"},
+		{name: "single large write", writes: []int{100000}, encoding: "gzip"},
+		{name: "flushed below min size", writes: []int{100, 100}, flush: true, encoding: "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want bytes.Buffer
+
+			handler := Compress(&CompressConfig{MinSize: 1024, Level: 5, Types: []string{"text/plain"}}).Handler(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "text/plain")
+					for i, n := range tt.writes {
+						chunk := bytes.Repeat([]byte{byte('a' + i)}, n)
+						want.Write(chunk)
+						w.Write(chunk)
+
+						if tt.flush && i == 0 {
+							if err := http.NewResponseController(w).Flush(); err != nil {
+								t.Fatal(err)
+							}
+						}
+					}
+				}),
+			)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if w.Flushed != tt.flush {
+				t.Errorf("flushed %t, want %t", w.Flushed, tt.flush)
+			}
+
+			var body io.Reader = w.Body
+			if tt.encoding == "gzip" {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("body of %d bytes differs from the %d bytes written", len(got), want.Len())
+			}
+		})
+	}
+}
+
+// reportGC returns a function that reports the garbage collections since
+// reportGC was called as the gc/op metric.
+func reportGC(b *testing.B) func() {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+
+		b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+	}
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// concurrencyBackoff is the factor the adaptive limit is multiplied by when
+// the backend is overloaded.
+const concurrencyBackoff = 0.9
+
+// ConcurrencyLimitConfig holds the configuration for the concurrency limit
+// middleware.
+type ConcurrencyLimitConfig struct {
+	// MaxInFlight is the maximum number of requests passed on at once.
+	MaxInFlight int
+
+	// QueueSize is the number of requests that wait for a free slot, at most
+	// for QueueTimeout. Requests that don't fit into the queue are rejected
+	// right away; 0 disables waiting.
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	// Adaptive makes the limit follow the backend: it is lowered when a
+	// response takes longer than LatencyThreshold or fails with a 5xx status,
+	// and slowly raised again up to MaxInFlight while responses are fast. It
+	// never drops below MinLimit.
+	Adaptive         bool
+	MinLimit         int
+	LatencyThreshold time.Duration
+}
+
+type concurrencyLimitMiddleware struct {
+	cfg *ConcurrencyLimitConfig
+
+	mu       sync.Mutex
+	inFlight int
+	limit    float64
+	queue    list.List // of chan struct{}, closed when the slot is granted
+}
+
+func ConcurrencyLimit(cfg *ConcurrencyLimitConfig) Middleware {
+	return &concurrencyLimitMiddleware{
+		cfg:   cfg,
+		limit: float64(cfg.MaxInFlight),
+	}
+}
+
+func (mw *concurrencyLimitMiddleware) Type() Type {
+	return TypeConcurrencyLimit
+}
+
+var (
+	errQueueFull    = errors.New("concurrency limit queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a concurrency limit slot")
+)
+
+// Handler returns a middleware that limits the number of requests handled
+// at once. Requests over the limit wait in a FIFO queue; when the queue is
+// full or the wait times out, they are shed with 503 Service Unavailable
+// before reaching the backend.
+//
+// The limit is kept per middleware, so a route middleware limits its route
+// and a global one all routes together. In-flight requests are not carried
+// over a config reload.
+func (mw *concurrencyLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := mw.acquire(r.Context()); err != nil {
+			if r.Context().Err() != nil {
+				// The client is gone, there is no one to answer.
+				return
+			}
+
+			metrics.RecordRejection(r, string(TypeConcurrencyLimit))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !mw.cfg.Adaptive {
+			defer mw.release()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &latencyWriter{ResponseWriter: w, start: time.Now(), status: http.StatusOK}
+		defer func() {
+			if sw.latency == 0 {
+				sw.latency = time.Since(sw.start)
+			}
+			mw.releaseAdaptive(r, sw.latency, sw.status)
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// acquire takes a slot, waiting in the queue if needed.
+func (mw *concurrencyLimitMiddleware) acquire(ctx context.Context) error {
+	mw.mu.Lock()
+
+	if mw.queue.Len() == 0 && mw.inFlight < int(mw.limit) {
+		mw.inFlight++
+		mw.mu.Unlock()
+		return nil
+	}
+
+	if mw.queue.Len() >= mw.cfg.QueueSize {
+		mw.mu.Unlock()
+		return errQueueFull
+	}
+
+	ready := make(chan struct{})
+	elem := mw.queue.PushBack(ready)
+	mw.mu.Unlock()
+
+	timer := time.NewTimer(mw.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	// The slot may have been granted while the timer fired.
+	select {
+	case <-ready:
+		mw.inFlight--
+		mw.grant()
+	default:
+		mw.queue.Remove(elem)
+	}
+
+	return err
+}
+
+func (mw *concurrencyLimitMiddleware) release() {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	mw.inFlight--
+	mw.grant()
+}
+
+// releaseAdaptive frees the slot and adjusts the limit (AIMD): every slow or
+// failed response lowers it by concurrencyBackoff, every good one raises it
+// by 1/limit, i.e. by about one per limit's worth of good responses.
+func (mw *concurrencyLimitMiddleware) releaseAdaptive(r *http.Request, latency time.Duration, status int) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	before := int(mw.limit)
+
+	if latency > mw.cfg.LatencyThreshold || status >= http.StatusInternalServerError {
+		mw.limit = max(mw.limit*concurrencyBackoff, float64(mw.cfg.MinLimit))
+	} else if float64(mw.inFlight)*2 >= mw.limit {
+		// The limit is only raised while it is actually used, otherwise
+		// it would grow back during quiet periods without being tested.
+		mw.limit = min(mw.limit+1/mw.limit, float64(mw.cfg.MaxInFlight))
+	}
+
+	if after := int(mw.limit); after != before {
+		metrics.ConcurrencyLimit.WithLabelValues(metrics.RouteFromContext(r.Context())).Set(int64(after))
+	}
+
+	mw.inFlight--
+	mw.grant()
+}
+
+// grant hands free slots to the queued requests, in order. It must be
+// called with mu held.
+func (mw *concurrencyLimitMiddleware) grant() {
+	for mw.queue.Len() > 0 && mw.inFlight < int(mw.limit) {
+		ready := mw.queue.Remove(mw.queue.Front()).(chan struct{})
+		close(ready)
+		mw.inFlight++
+	}
+}
+
+// latencyWriter records the response status and the time until the response
+// headers were written, which is when the backend answered.
+type latencyWriter struct {
+	http.ResponseWriter
+	start   time.Time
+	latency time.Duration
+	status  int
+}
+
+func (w *latencyWriter) WriteHeader(code int) {
+	// Informational responses like 103 Early Hints precede the final one.
+	if w.latency == 0 && code >= http.StatusOK {
+		w.latency = time.Since(w.start)
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *latencyWriter) Write(b []byte) (int, error) {
+	if w.latency == 0 {
+		w.latency = time.Since(w.start)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *latencyWriter) Flush() {
+	if w.latency == 0 {
+		w.latency = time.Since(w.start)
+	}
+
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *latencyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
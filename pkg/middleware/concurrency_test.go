@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests wait in the queue.
+func waitQueued(t *testing.T, mw *concurrencyLimitMiddleware, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		mw.mu.Lock()
+		queued := mw.queue.Len()
+		mw.mu.Unlock()
+
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", queued, n)
+		}
+	}
+}
+
+func TestConcurrencyQueueOrder(t *testing.T) {
+	mw := ConcurrencyLimit(&ConcurrencyLimitConfig{
+		MaxInFlight:  1,
+		QueueSize:    3,
+		QueueTimeout: 5 * time.Second,
+	}).(*concurrencyLimitMiddleware)
+
+	if err := mw.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			if err := mw.acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- i
+		}()
+		waitQueued(t, mw, i+1)
+	}
+
+	if err := mw.acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Fatalf("got %v with a full queue, want errQueueFull", err)
+	}
+
+	// Every released slot goes to the request that waited longest.
+	for want := range 3 {
+		mw.release()
+
+		if got := <-granted; got != want {
+			t.Fatalf("slot granted to request %d, want %d", got, want)
+		}
+	}
+
+	mw.release()
+
+	if mw.inFlight != 0 || mw.queue.Len() != 0 {
+		t.Errorf("%d in flight, %d queued after all requests finished", mw.inFlight, mw.queue.Len())
+	}
+}
+
+// TestConcurrencyGrantRace grants the slot of a waiting request right after
+// it gave up waiting, but before it could leave the queue. The slot must be
+// passed on instead of being lost.
+func TestConcurrencyGrantRace(t *testing.T) {
+	mw := ConcurrencyLimit(&ConcurrencyLimitConfig{
+		MaxInFlight:  1,
+		QueueSize:    2,
+		QueueTimeout: 5 * time.Second,
+	}).(*concurrencyLimitMiddleware)
+
+	if err := mw.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- mw.acquire(ctx) }()
+	waitQueued(t, mw, 1)
+
+	second := make(chan error, 1)
+	go func() { second <- mw.acquire(context.Background()) }()
+	waitQueued(t, mw, 2)
+
+	// The first request gives up while the lock is held, so it can only
+	// leave the queue after its slot was granted.
+	mw.mu.Lock()
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	mw.inFlight--
+	mw.grant()
+	mw.mu.Unlock()
+
+	if err := <-first; err == nil {
+		// It saw the grant before the cancellation, which is fine too.
+		mw.release()
+	} else if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slot of the request that gave up was lost")
+	}
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.inFlight != 1 || mw.queue.Len() != 0 {
+		t.Errorf("%d in flight, %d queued, want 1 and 0", mw.inFlight, mw.queue.Len())
+	}
+}
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	mw := ConcurrencyLimit(&ConcurrencyLimitConfig{
+		MaxInFlight:  1,
+		QueueSize:    1,
+		QueueTimeout: 20 * time.Millisecond,
+	}).(*concurrencyLimitMiddleware)
+
+	if err := mw.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mw.acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("got %v, want errQueueTimeout", err)
+	}
+
+	if mw.inFlight != 1 || mw.queue.Len() != 0 {
+		t.Errorf("%d in flight, %d queued, want 1 and 0", mw.inFlight, mw.queue.Len())
+	}
+}
+
+func TestConcurrencyAdaptiveBounds(t *testing.T) {
+	mw := ConcurrencyLimit(&ConcurrencyLimitConfig{
+		MaxInFlight:      4,
+		Adaptive:         true,
+		MinLimit:         2,
+		LatencyThreshold: 100 * time.Millisecond,
+	}).(*concurrencyLimitMiddleware)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// release finishes a request while inFlight requests are in flight.
+	release := func(inFlight int, latency time.Duration, status int) {
+		mw.inFlight = inFlight
+		mw.releaseAdaptive(req, latency, status)
+	}
+
+	// A slow response and a failed one lower the limit multiplicatively.
+	release(4, time.Second, http.StatusOK)
+	if mw.limit != 4*concurrencyBackoff {
+		t.Errorf("limit %g after a slow response, want %g", mw.limit, 4*concurrencyBackoff)
+	}
+	release(4, time.Millisecond, http.StatusBadGateway)
+	if mw.limit != 4*concurrencyBackoff*concurrencyBackoff {
+		t.Errorf("limit %g after a failed response, want %g", mw.limit, 4*concurrencyBackoff*concurrencyBackoff)
+	}
+
+	// It never drops below min_limit.
+	for range 50 {
+		release(1, time.Second, http.StatusOK)
+	}
+	if mw.limit != 2 {
+		t.Fatalf("limit %g after slow responses, want min_limit 2", mw.limit)
+	}
+
+	// Fast responses don't raise it while it isn't used.
+	for range 10 {
+		release(0, time.Millisecond, http.StatusOK)
+	}
+	if mw.limit != 2 {
+		t.Errorf("limit %g after fast responses of an idle route, want 2", mw.limit)
+	}
+
+	// Fast responses raise it additively while it is used, by about one per
+	// limit's worth of responses, up to max_in_flight.
+	release(2, time.Millisecond, http.StatusOK)
+	if mw.limit != 2.5 {
+		t.Errorf("limit %g after a fast response, want 2.5", mw.limit)
+	}
+	for range 50 {
+		release(int(mw.limit), time.Millisecond, http.StatusOK)
+	}
+	if mw.limit != 4 {
+		t.Errorf("limit %g after fast responses, want max_in_flight 4", mw.limit)
+	}
+}
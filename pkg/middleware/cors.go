@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
 )
 
 // CORSConfig defines the configuration for Cross-Origin Resource Sharing (CORS) middleware.
@@ -72,6 +74,7 @@ func (mw *corsMiddleware) Handler(next http.Handler) http.Handler {
 		}
 
 		if !slices.Contains(mw.cfg.AllowedOrigins, origin) {
+			metrics.RecordRejection(r, string(TypeCORS))
 			http.Error(w, "CORS policy: Origin not allowed", http.StatusForbidden)
 			return
 		}
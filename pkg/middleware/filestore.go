@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+)
+
+// fileCheckInterval is how often a fileStore looks for changes of its file
+// by default.
+const fileCheckInterval = 5 * time.Second
+
+// fileStore holds the parsed content of a file. The file is loaded when the
+// store is created and checked for changes by a background goroutine, so
+// requests only read the published content. If the changed file can't be
+// parsed, the previous content stays in use.
+//
+// Middlewares have no Close, so the goroutine is stopped when the store is
+// garbage collected, e.g. after a config reload replaced the middleware.
+type fileStore[T any] struct {
+	file *watchedFile[T]
+}
+
+// watchedFile is the state shared with the goroutine. It must not refer to
+// the fileStore, or the store would never become unreachable.
+type watchedFile[T any] struct {
+	path  string
+	parse func([]byte) (T, error)
+	value atomic.Pointer[T]
+
+	// Only used by load.
+	modTime time.Time
+	size    int64
+}
+
+func newFileStore[T any](path string, parse func([]byte) (T, error), interval time.Duration) *fileStore[T] {
+	if interval <= 0 {
+		interval = fileCheckInterval
+	}
+
+	file := &watchedFile[T]{path: path, parse: parse}
+	file.load()
+
+	stop := make(chan struct{})
+	go file.watch(interval, stop)
+
+	s := &fileStore[T]{file: file}
+	runtime.AddCleanup(s, func(stop chan struct{}) { close(stop) }, stop)
+
+	return s
+}
+
+// get returns the content of the file, or the zero value if it was never
+// loaded successfully.
+func (s *fileStore[T]) get() T {
+	if value := s.file.value.Load(); value != nil {
+		return *value
+	}
+
+	var zero T
+	return zero
+}
+
+func (f *watchedFile[T]) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.load()
+		}
+	}
+}
+
+// load parses the file again if its modification time or size changed.
+func (f *watchedFile[T]) load() {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		slog.Error("failed to stat file", slog.String("path", f.path), logger.Error(err))
+		return
+	}
+
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		slog.Error("failed to read file", slog.String("path", f.path), logger.Error(err))
+		return
+	}
+
+	value, err := f.parse(data)
+	if err != nil {
+		slog.Error("failed to parse file", slog.String("path", f.path), logger.Error(err))
+		return
+	}
+
+	if !f.modTime.IsZero() {
+		slog.Info("reloaded file", slog.String("path", f.path))
+	}
+
+	f.modTime, f.size = info.ModTime(), info.Size()
+	f.value.Store(&value)
+}
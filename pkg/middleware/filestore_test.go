@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(path, []byte("first"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(data []byte) (string, error) { return strings.TrimSpace(string(data)), nil }
+	s := newFileStore(path, parse, 10*time.Millisecond)
+
+	if got := s.get(); got != "first" {
+		t.Fatalf("got %q, want the content on creation", got)
+	}
+
+	if err := os.WriteFile(path, []byte("second line"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.get() != "second line" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, the change was not picked up", s.get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileStoreStopsWhenUnreachable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+
+	s := newFileStore(path, func(data []byte) ([]byte, error) { return data, nil }, time.Millisecond)
+	s.get()
+	s = nil
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("the watching goroutine is still running")
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/hopheader"
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+const (
+	forwardAuthCacheSize = 10000
+
+	// forwardAuthMaxBody limits the denial body returned to the client.
+	forwardAuthMaxBody = 64 << 10
+)
+
+// ForwardAuthConfig holds the configuration for the forward auth middleware.
+type ForwardAuthConfig struct {
+	// URL of the auth service. Every request is checked with a GET to this URL.
+	URL string
+
+	// RequestHeaders are copied from the client request to the auth request,
+	// e.g. "Authorization" and "Cookie".
+	RequestHeaders []string
+
+	// ResponseHeaders are copied from an allowing auth response to the
+	// upstream request, e.g. "X-User". Client supplied values are removed.
+	ResponseHeaders []string
+
+	// Timeout limits a single auth request.
+	Timeout time.Duration
+
+	// CacheTTL is how long a decision is reused for requests with the same
+	// method, URL and request headers. Zero disables the cache.
+	CacheTTL time.Duration
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-Proto
+	// header is believed for the scheme passed to the auth service.
+	TrustedProxies []netip.Prefix
+}
+
+// authDecision is the outcome of an auth request.
+type authDecision struct {
+	allowed bool
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+type forwardAuthMiddleware struct {
+	cfg    *ForwardAuthConfig
+	client *http.Client
+	cache  *ttlCache[string, *authDecision]
+}
+
+func ForwardAuth(cfg *ForwardAuthConfig) Middleware {
+	mw := &forwardAuthMiddleware{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			// Redirects, e.g. to a login page, are returned to the client.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	if cfg.CacheTTL > 0 {
+		mw.cache = newTTLCache[string, *authDecision](forwardAuthCacheSize, cfg.CacheTTL, false)
+	}
+
+	return mw
+}
+
+func (mw *forwardAuthMiddleware) Type() Type {
+	return TypeForwardAuth
+}
+
+// Handler returns a middleware that asks the auth service whether the request
+// is allowed. The auth request carries the original request in the
+// X-Forwarded-Method, -Proto, -Host, -Uri and -For headers. On a 2xx response
+// the request is passed on; otherwise the auth service's response (e.g. 401 or
+// a redirect to a login page) is returned to the client.
+func (mw *forwardAuthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range mw.cfg.ResponseHeaders {
+			r.Header.Del(name)
+		}
+
+		key := mw.cacheKey(r)
+
+		decision, ok := mw.cachedDecision(key)
+		if !ok {
+			var err error
+			decision, err = mw.check(r)
+			if err != nil {
+				slog.Error("forward auth request failed", slog.String("url", mw.cfg.URL), logger.Error(err))
+				metrics.RecordAuthFailure(r, string(TypeForwardAuth), "auth_error")
+				http.Error(w, "Authentication service unavailable", http.StatusBadGateway)
+				return
+			}
+
+			if mw.cache != nil {
+				mw.cache.Add(key, decision)
+			}
+		}
+
+		if !decision.allowed {
+			metrics.RecordAuthFailure(r, string(TypeForwardAuth), "denied")
+
+			copyHeaderValues(w.Header(), decision.header)
+			w.WriteHeader(decision.status)
+			_, _ = w.Write(decision.body)
+			return
+		}
+
+		for _, name := range mw.cfg.ResponseHeaders {
+			if values := decision.header.Values(name); len(values) > 0 {
+				r.Header[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (mw *forwardAuthMiddleware) cachedDecision(key string) (*authDecision, bool) {
+	if mw.cache == nil {
+		return nil, false
+	}
+
+	return mw.cache.Get(key)
+}
+
+func (mw *forwardAuthMiddleware) check(r *http.Request) (*authDecision, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, mw.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range mw.cfg.RequestHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", requestScheme(r, mw.cfg.TrustedProxies))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	resp, err := mw.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decision := &authDecision{
+		allowed: resp.StatusCode >= 200 && resp.StatusCode < 300,
+		status:  resp.StatusCode,
+		header:  resp.Header,
+	}
+
+	if !decision.allowed {
+		decision.body, err = io.ReadAll(io.LimitReader(resp.Body, forwardAuthMaxBody))
+		if err != nil {
+			return nil, err
+		}
+
+		// The response is replayed, possibly from the cache, so the length and
+		// date are set again when it is written.
+		hopheader.Remove(decision.header)
+		decision.header.Del("Content-Length")
+		decision.header.Del("Date")
+	}
+
+	return decision, nil
+}
+
+// cacheKey identifies requests that get the same decision: the method, URL
+// and every header sent to the auth service.
+func (mw *forwardAuthMiddleware) cacheKey(r *http.Request) string {
+	if mw.cache == nil {
+		return ""
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+"\n"+requestScheme(r, mw.cfg.TrustedProxies)+"\n"+r.Host+"\n"+r.URL.RequestURI()+"\n")
+
+	for _, name := range mw.cfg.RequestHeaders {
+		io.WriteString(h, name+":"+strings.Join(r.Header.Values(name), ",")+"\n")
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func copyHeaderValues(dst, src http.Header) {
+	for name, values := range src {
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+}
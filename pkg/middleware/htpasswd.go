@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	apr1Prefix = "$apr1$"
+	shaPrefix  = "{SHA}"
+
+	// bcryptHashLen is the length of an encoded bcrypt hash: "$2a$", two cost
+	// digits, "$", 22 characters of salt and 31 characters of checksum.
+	bcryptHashLen = 60
+
+	// bcryptAlphabet is the base64 alphabet of bcrypt salts and checksums.
+	bcryptAlphabet = "./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// ParseHtpasswd parses an Apache htpasswd file: one "user:hash" entry per
+// line, empty lines and lines starting with "#" are ignored. Supported hashes
+// are bcrypt ("htpasswd -B"), APR1-MD5 ("htpasswd -m") and SHA-1
+// ("htpasswd -s").
+func ParseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+
+		if err := checkHtpasswdHash(hash); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: %w", n, user, err)
+		}
+
+		users[user] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+func checkHtpasswdHash(hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		return CheckBcryptHash(hash)
+
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt, sum, ok := strings.Cut(hash[len(apr1Prefix):], "$")
+		if !ok || salt == "" || len(salt) > 8 || len(sum) != 22 {
+			return fmt.Errorf("malformed APR1 hash")
+		}
+		return nil
+
+	case strings.HasPrefix(hash, shaPrefix):
+		sum, err := base64.StdEncoding.DecodeString(hash[len(shaPrefix):])
+		if err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("malformed SHA hash")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported hash format, expected bcrypt, $apr1$ or {SHA}")
+}
+
+// CheckBcryptHash parses the hash the same way bcrypt does when comparing
+// passwords, so malformed hashes are rejected when they are loaded instead of
+// failing every login.
+func CheckBcryptHash(hash string) error {
+	if !isBcryptHash(hash) {
+		return errors.New("unsupported hash format, expected $2a$, $2b$ or $2y$")
+	}
+
+	if len(hash) != bcryptHashLen {
+		return fmt.Errorf("hash must be %d characters long, got %d", bcryptHashLen, len(hash))
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return err
+	}
+
+	if i := strings.IndexFunc(hash[7:], func(r rune) bool { return !strings.ContainsRune(bcryptAlphabet, r) }); i != -1 {
+		return fmt.Errorf("invalid character %q in salt or checksum", hash[7+i])
+	}
+
+	return nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// comparePassword reports whether password matches an htpasswd hash.
+func comparePassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt, _, _ := strings.Cut(hash[len(apr1Prefix):], "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		expected := shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// apr1 computes the Apache variant of the MD5-based crypt.
+func apr1(password, salt string) string {
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Prefix + salt))
+
+	for i := len(pw); i > 0; i -= md5.Size {
+		h.Write(altSum[:min(i, md5.Size)])
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+
+	sum := h.Sum(nil)
+
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	var b strings.Builder
+	b.WriteString(apr1Prefix + salt + "$")
+
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+
+	return b.String()
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Known hashes: the bcrypt one is from the OpenBSD test vectors, the others
+// are from "openssl passwd -apr1" and "openssl sha1 -binary | base64".
+const (
+	bcryptUU   = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW" // U*U
+	apr1Pass   = "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"                        // password
+	shaPass    = "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="                            // password
+	apr1Long   = "$apr1$12345678$73hG3Nj0llBBNcNjFBzc4/"                        // a password longer than sixteen bytes
+	apr1Empty  = "$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ."                              // empty
+	apr1Myname = "$apr1$z0Lz$0T/QyTUqVn2baVyl.SbWO1"                            // myPassword
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: "# users\n\nalice:" + bcryptUU + "\n  bob:" + apr1Pass + "  \ncarol:" + shaPass + "\n",
+			want: map[string]string{"alice": bcryptUU, "bob": apr1Pass, "carol": shaPass},
+		},
+		{
+			name: "2y bcrypt",
+			data: "alice:$2y$" + bcryptUU[4:] + "\n",
+			want: map[string]string{"alice": "$2y$" + bcryptUU[4:]},
+		},
+		{name: "missing hash", data: "alice\n", wantErr: "line 1: expected user:hash"},
+		{name: "empty user", data: "# comment\n:" + shaPass + "\n", wantErr: "line 2: expected user:hash"},
+		{name: "unsupported", data: "alice:plaintext\n", wantErr: "unsupported hash format"},
+		{name: "truncated bcrypt", data: "alice:" + bcryptUU[:59] + "\n", wantErr: "hash must be 60 characters long"},
+		{name: "bcrypt character", data: "alice:" + bcryptUU[:59] + "!\n", wantErr: "invalid character '!'"},
+		{name: "bcrypt cost", data: "alice:$2a$99" + bcryptUU[6:] + "\n", wantErr: "cost"},
+		{name: "apr1 without sum", data: "alice:$apr1$saltsalt\n", wantErr: "malformed APR1 hash"},
+		{name: "apr1 long salt", data: "alice:$apr1$saltsaltsalt$yAAkm4libquA.ZWLHbSBq/\n", wantErr: "malformed APR1 hash"},
+		{name: "sha length", data: "alice:{SHA}" + base64.StdEncoding.EncodeToString([]byte("short")) + "\n", wantErr: "malformed SHA hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := ParseHtpasswd([]byte(tt.data))
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(tt.want) {
+				t.Errorf("got %d users, want %d", len(users), len(tt.want))
+			}
+			for user, hash := range tt.want {
+				if users[user] != hash {
+					t.Errorf("user %s: hash %q, want %q", user, users[user], hash)
+				}
+			}
+		})
+	}
+}
+
+func TestComparePassword(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{hash: bcryptUU, password: "U*U", want: true},
+		{hash: "$2y$" + bcryptUU[4:], password: "U*U", want: true},
+		{hash: bcryptUU, password: "U*V"},
+		{hash: apr1Pass, password: "password", want: true},
+		{hash: apr1Pass, password: "Password"},
+		{hash: apr1Long, password: "a password longer than sixteen bytes", want: true},
+		{hash: apr1Empty, password: "", want: true},
+		{hash: apr1Myname, password: "myPassword", want: true},
+		{hash: apr1Myname, password: "myPassword "},
+		{hash: shaPass, password: "password", want: true},
+		{hash: shaPass, password: "passwore"},
+	}
+
+	for _, tt := range tests {
+		if got := comparePassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("comparePassword(%q, %q) = %t, want %t", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestBasicAuthUserHeader(t *testing.T) {
+	mw := BasicAuth(&BasicAuthConfig{
+		Users:      map[string]string{"alice": apr1Pass},
+		Realm:      "test",
+		UserHeader: "X-Forwarded-User",
+	})
+
+	var forwarded *http.Request
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+
+	tests := []struct {
+		name     string
+		password string
+		want     string // forwarded user, empty if rejected
+	}{
+		{name: "valid", password: "password", want: "alice"},
+		{name: "wrong password", password: "wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+
+			// The client tries to choose the user itself.
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth("alice", tt.password)
+			req.Header.Set("X-Forwarded-User", "admin")
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if tt.want == "" {
+				if w.Code != http.StatusUnauthorized || forwarded != nil {
+					t.Fatalf("status %d, want 401", w.Code)
+				}
+				if user := req.Header.Get("X-Forwarded-User"); user != "" {
+					t.Errorf("the client supplied header %q was kept", user)
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if user := forwarded.Header.Values("X-Forwarded-User"); len(user) != 1 || user[0] != tt.want {
+				t.Errorf("forwarded user %q, want %s", user, tt.want)
+			}
+		})
+	}
+}
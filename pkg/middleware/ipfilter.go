@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// IPFilterConfig holds the configuration for the IP filter middleware.
+type IPFilterConfig struct {
+	// Allow lists the accepted client networks. If it is empty and no
+	// AllowFiles are set, every client not denied is accepted.
+	Allow []netip.Prefix
+
+	// Deny lists rejected client networks. Deny takes precedence over Allow.
+	Deny []netip.Prefix
+
+	// AllowFiles and DenyFiles contain additional networks, see ParseIPList.
+	// They are re-read when they change, checked every RefreshInterval.
+	AllowFiles      []string
+	DenyFiles       []string
+	RefreshInterval time.Duration
+
+	// TrustedProxies are the networks of proxies in front of this one. The
+	// client IP is taken from X-Forwarded-For only as far as the request
+	// passed through trusted proxies, see ClientIP.
+	TrustedProxies []netip.Prefix
+
+	// DenyStatus and DenyBody are the response to rejected clients.
+	DenyStatus int
+	DenyBody   string
+}
+
+type ipFilterMiddleware struct {
+	cfg        *IPFilterConfig
+	allowFiles []*fileStore[[]netip.Prefix]
+	denyFiles  []*fileStore[[]netip.Prefix]
+}
+
+func IPFilter(cfg *IPFilterConfig) Middleware {
+	return &ipFilterMiddleware{
+		cfg:        cfg,
+		allowFiles: newIPListStores(cfg.AllowFiles, cfg.RefreshInterval),
+		denyFiles:  newIPListStores(cfg.DenyFiles, cfg.RefreshInterval),
+	}
+}
+
+func newIPListStores(paths []string, interval time.Duration) []*fileStore[[]netip.Prefix] {
+	stores := make([]*fileStore[[]netip.Prefix], 0, len(paths))
+	for _, path := range paths {
+		stores = append(stores, newFileStore(path, ParseIPList, interval))
+	}
+
+	return stores
+}
+
+func (mw *ipFilterMiddleware) Type() Type {
+	return TypeIPFilter
+}
+
+// Handler returns a middleware that rejects clients that are in a deny list
+// or, if allow lists are configured, not in one of them.
+func (mw *ipFilterMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := ClientIP(r, mw.cfg.TrustedProxies)
+		if err != nil || !mw.allowed(ip) {
+			metrics.RecordRejection(r, string(TypeIPFilter))
+			http.Error(w, mw.cfg.DenyBody, mw.cfg.DenyStatus)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (mw *ipFilterMiddleware) allowed(ip netip.Addr) bool {
+	if containsIP(mw.cfg.Deny, ip) {
+		return false
+	}
+	for _, file := range mw.denyFiles {
+		if containsIP(file.get(), ip) {
+			return false
+		}
+	}
+
+	if len(mw.cfg.Allow) == 0 && len(mw.allowFiles) == 0 {
+		return true
+	}
+
+	if containsIP(mw.cfg.Allow, ip) {
+		return true
+	}
+	for _, file := range mw.allowFiles {
+		if containsIP(file.get(), ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(ip) })
+}
+
+// ClientIP returns the IP of the client that sent the request. If the
+// connection comes from a trusted proxy, X-Forwarded-For is followed from
+// the right to the first address that is not a trusted proxy, so clients
+// can't choose their IP by sending the header themselves.
+func ClientIP(r *http.Request, trusted []netip.Prefix) (netip.Addr, error) {
+	ip, err := remoteIP(r)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if !containsIP(trusted, ip) {
+		return ip, nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Anything left of a malformed entry can't be trusted.
+			break
+		}
+
+		ip = hop.Unmap()
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+
+	return ip, nil
+}
+
+// fromTrustedProxy reports whether the connection of the request comes from
+// one of the trusted proxies, so its X-Forwarded-* headers can be believed.
+func fromTrustedProxy(r *http.Request, trusted []netip.Prefix) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+
+	ip, err := remoteIP(r)
+	return err == nil && containsIP(trusted, ip)
+}
+
+// remoteIP returns the IP of the peer of the connection.
+func remoteIP(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid RemoteAddr: %w", err)
+	}
+
+	return ip.Unmap(), nil
+}
+
+// ParsePrefix parses a CIDR or a single IP address, which is treated as a
+// network of one address.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// ParseIPList parses an IP list file: one CIDR or IP address per line,
+// empty lines and text after "#" are ignored.
+func ParseIPList(data []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		prefix, err := ParsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, scanner.Err()
+}
@@ -0,0 +1,301 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+)
+
+const (
+	// jwksMinRefresh limits refetches triggered by tokens with an unknown key
+	// ID, so random kids can't be used to flood the JWKS endpoint.
+	jwksMinRefresh = 30 * time.Second
+	jwksTimeout    = 10 * time.Second
+	jwksMaxBytes   = 1 << 20
+)
+
+// ParsePublicKey parses a PEM encoded RSA, ECDSA P-256 or Ed25519 public key
+// or certificate, for JWTConfig.Keys.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key any
+	var err error
+
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// jwks is a cached JSON Web Key Set. It is refreshed in the background when
+// it is older than the refresh interval and when a token refers to an unknown
+// key ID, so keys rotated by the issuer are picked up without a restart.
+type jwks struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+
+	// running is closed when the running fetch finishes, nil if none runs.
+	running chan struct{}
+}
+
+func newJWKS(url string, refresh time.Duration) *jwks {
+	set := &jwks{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksTimeout},
+	}
+
+	set.mu.Lock()
+	set.start()
+	set.mu.Unlock()
+
+	return set
+}
+
+// get returns the key with the given ID, or all keys if kid is empty. A stale
+// set is served while it is refreshed. Only a lookup that finds no key waits
+// for the refresh, until ctx is done.
+func (s *jwks) get(ctx context.Context, kid string) []crypto.PublicKey {
+	s.mu.Lock()
+
+	keys := s.lookup(kid)
+
+	var running chan struct{}
+	if len(keys) == 0 || time.Since(s.fetchedAt) > s.refresh {
+		running = s.start()
+	}
+	s.mu.Unlock()
+
+	if len(keys) > 0 || running == nil {
+		return keys
+	}
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookup(kid)
+}
+
+func (s *jwks) lookup(kid string) []crypto.PublicKey {
+	if kid != "" {
+		if key, ok := s.keys[kid]; ok {
+			return []crypto.PublicKey{key}
+		}
+		return nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// start starts a fetch unless one is running or the last attempt was too
+// recent, and returns the channel closed when the running fetch finishes, or
+// nil. It must be called with mu held.
+func (s *jwks) start() chan struct{} {
+	if s.running == nil {
+		if time.Since(s.lastAttempt) < jwksMinRefresh {
+			return nil
+		}
+		s.lastAttempt = time.Now()
+
+		s.running = make(chan struct{})
+		go s.fetch(s.running)
+	}
+
+	return s.running
+}
+
+// fetch downloads the key set. On failure the previous keys stay in use.
+func (s *jwks) fetch(done chan struct{}) {
+	keys, err := s.download()
+	if err != nil {
+		slog.Error("failed to fetch JWKS", slog.String("url", s.url), logger.Error(err))
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+		s.fetchedAt = time.Now()
+	}
+	s.running = nil
+	s.mu.Unlock()
+
+	close(done)
+}
+
+func (s *jwks) download() (map[string]crypto.PublicKey, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxBytes)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode key set: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("skipping JWKS key", slog.String("kid", jwk.Kid), logger.Error(err))
+			continue
+		}
+
+		kid := jwk.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+// jsonWebKey is a public key of a JWKS (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 coordinates")
+		}
+
+		// The uncompressed point encoding is validated by ParseUncompressedPublicKey.
+		point := append([]byte{4}, append(x, y...)...)
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
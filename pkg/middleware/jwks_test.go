@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyServer is a stand-in for the JWKS endpoint of an issuer. The served keys
+// can be replaced to simulate a key rotation.
+type keyServer struct {
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	fetches int
+
+	// hold, if set, delays responses until it is closed.
+	hold chan struct{}
+}
+
+func (s *keyServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	s.fetches++
+	hold := s.hold
+	s.mu.Unlock()
+
+	if hold != nil {
+		<-hold
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+}
+
+func (s *keyServer) serve(keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = keys
+}
+
+func (s *keyServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.fetches
+}
+
+// newJWKSMiddleware returns a JWT middleware that only uses the keys of the
+// key server. Unlike JWT, it doesn't prefetch the keys in the background.
+func newJWKSMiddleware(t *testing.T, s *keyServer) *jwtMiddleware {
+	t.Helper()
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	return &jwtMiddleware{
+		cfg: &JWTConfig{
+			Algorithms: []string{AlgRS256, AlgES256, AlgEdDSA},
+			Realm:      "test",
+		},
+		jwks: &jwks{
+			url:     srv.URL,
+			refresh: time.Hour,
+			client:  srv.Client(),
+		},
+	}
+}
+
+func rsaJWK(t *testing.T, kid string) (*rsa.PrivateKey, jsonWebKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(t *testing.T, kid string) (*ecdsa.PrivateKey, jsonWebKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	point, err := key.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}
+}
+
+// signToken returns a token with the header and claims, signed with key
+// according to alg. The algorithm doesn't have to match the key.
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	var err error
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authStatus sends a request with the bearer token through the middleware
+// and returns the response status.
+func authStatus(mw *jwtMiddleware, token string) int {
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w.Code
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	s := &keyServer{}
+	mw := newJWKSMiddleware(t, s)
+
+	oldKey, oldJWK := rsaJWK(t, "old")
+	newKey, newJWK := rsaJWK(t, "new")
+	claims := map[string]any{"sub": "alice"}
+
+	s.serve(oldJWK)
+
+	if status := authStatus(mw, signToken(t, AlgRS256, "old", oldKey, claims)); status != http.StatusOK {
+		t.Fatalf("token of the current key: status %d", status)
+	}
+
+	// The issuer rotates its key. Tokens of the new key are accepted as soon
+	// as the minimum refresh interval has passed, without waiting for the
+	// regular refresh.
+	s.serve(newJWK)
+	mw.jwks.lastAttempt = time.Now().Add(-jwksMinRefresh)
+
+	if status := authStatus(mw, signToken(t, AlgRS256, "new", newKey, claims)); status != http.StatusOK {
+		t.Errorf("token of the rotated key: status %d", status)
+	}
+	if status := authStatus(mw, signToken(t, AlgRS256, "old", oldKey, claims)); status != http.StatusUnauthorized {
+		t.Errorf("token of the removed key: status %d", status)
+	}
+	if fetches := s.fetchCount(); fetches != 2 {
+		t.Errorf("got %d fetches, want 2", fetches)
+	}
+}
+
+func TestJWKSStaleRefresh(t *testing.T) {
+	s := &keyServer{}
+	mw := newJWKSMiddleware(t, s)
+
+	key, jwk := rsaJWK(t, "current")
+	s.serve(jwk)
+
+	token := signToken(t, AlgRS256, "current", key, map[string]any{"sub": "alice"})
+
+	if status := authStatus(mw, token); status != http.StatusOK {
+		t.Fatalf("token of the current key: status %d", status)
+	}
+
+	// Once the set is stale, requests are served with the cached keys while it
+	// is refreshed in the background, even if the JWKS endpoint hangs.
+	hold := make(chan struct{})
+	s.mu.Lock()
+	s.hold = hold
+	s.mu.Unlock()
+
+	mw.jwks.mu.Lock()
+	mw.jwks.fetchedAt = time.Now().Add(-2 * mw.jwks.refresh)
+	mw.jwks.lastAttempt = time.Now().Add(-jwksMinRefresh)
+	mw.jwks.mu.Unlock()
+
+	for range 3 {
+		if status := authStatus(mw, token); status != http.StatusOK {
+			t.Errorf("token of a stale key: status %d", status)
+		}
+	}
+
+	close(hold)
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mw.jwks.mu.Lock()
+		refreshed := time.Since(mw.jwks.fetchedAt) < mw.jwks.refresh
+		mw.jwks.mu.Unlock()
+
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the key set wasn't refreshed")
+		}
+	}
+
+	if fetches := s.fetchCount(); fetches != 2 {
+		t.Errorf("got %d fetches, want 2", fetches)
+	}
+}
+
+func TestJWKSUnknownKid(t *testing.T) {
+	s := &keyServer{}
+	mw := newJWKSMiddleware(t, s)
+
+	key, jwk := rsaJWK(t, "current")
+	s.serve(jwk)
+
+	claims := map[string]any{"sub": "alice"}
+
+	if status := authStatus(mw, signToken(t, AlgRS256, "current", key, claims)); status != http.StatusOK {
+		t.Fatalf("token of the current key: status %d", status)
+	}
+
+	// A token signed with a known key but naming an unknown kid is rejected,
+	// and random kids don't trigger a fetch each.
+	for _, kid := range []string{"unknown-1", "unknown-2", "unknown-3"} {
+		if status := authStatus(mw, signToken(t, AlgRS256, kid, key, claims)); status != http.StatusUnauthorized {
+			t.Errorf("kid %s: status %d, want %d", kid, status, http.StatusUnauthorized)
+		}
+	}
+
+	if fetches := s.fetchCount(); fetches != 1 {
+		t.Errorf("got %d fetches, want 1", fetches)
+	}
+}
+
+func TestJWKSAlgorithmKeyMismatch(t *testing.T) {
+	s := &keyServer{}
+	mw := newJWKSMiddleware(t, s)
+
+	rsaKey, rsaPublic := rsaJWK(t, "rsa")
+	ecKey, ecPublic := ecJWK(t, "ec")
+	s.serve(rsaPublic, ecPublic)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"sub": "alice"}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "RS256 with RSA key", token: signToken(t, AlgRS256, "rsa", rsaKey, claims), status: http.StatusOK},
+		{name: "ES256 with EC key", token: signToken(t, AlgES256, "ec", ecKey, claims), status: http.StatusOK},
+		{name: "ES256 naming the RSA key", token: signToken(t, AlgES256, "rsa", ecKey, claims), status: http.StatusUnauthorized},
+		{name: "RS256 naming the EC key", token: signToken(t, AlgRS256, "ec", rsaKey, claims), status: http.StatusUnauthorized},
+		{name: "EdDSA with a key not in the set", token: signToken(t, AlgEdDSA, "rsa", edKey, claims), status: http.StatusUnauthorized},
+		{name: "HS256 is not allowed", token: signHS256(rsaPublic.N, "rsa", claims), status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := authStatus(mw, tt.token); status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+// signHS256 returns an HS256 token with secret as the HMAC key, e.g. a public
+// key of the key set.
+func signHS256(secret, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(jwtHeader{Alg: AlgHS256, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,398 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// Signing algorithms supported by the JWT middleware.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+const bearerSchema = "Bearer "
+
+// JWTConfig holds the configuration for the JWT bearer token middleware.
+type JWTConfig struct {
+	// Algorithms lists the accepted "alg" header values. Tokens signed with
+	// any other algorithm, including "none", are rejected.
+	Algorithms []string
+
+	// Secret is the shared key for HS256.
+	Secret []byte
+
+	// Keys are the public keys for RS256, ES256 and EdDSA, see ParsePublicKey.
+	Keys []crypto.PublicKey
+
+	// JWKSURL is fetched for additional public keys, selected by the "kid"
+	// token header. The key set is cached for JWKSRefresh and refetched
+	// earlier when a token refers to an unknown key.
+	JWKSURL     string
+	JWKSRefresh time.Duration
+
+	// Issuer, if set, must equal the "iss" claim.
+	Issuer string
+
+	// Audience, if set, must contain at least one value of the "aud" claim.
+	Audience []string
+
+	// ClockSkew is the tolerance when checking "exp" and "nbf".
+	ClockSkew time.Duration
+
+	// RequiredClaims maps a claim name to its accepted values. The claim must
+	// be present; if values are given, the claim (or one element of an array
+	// claim, or one word of a space separated "scope") must match one of them.
+	RequiredClaims map[string][]string
+
+	// ForwardClaims maps a claim name to the request header it is forwarded
+	// in. Client supplied values of these headers are always removed.
+	ForwardClaims map[string]string
+
+	// Realm is reported in the WWW-Authenticate header.
+	Realm string
+}
+
+type jwtMiddleware struct {
+	cfg  *JWTConfig
+	jwks *jwks
+}
+
+func JWT(cfg *JWTConfig) Middleware {
+	mw := &jwtMiddleware{cfg: cfg}
+
+	if cfg.JWKSURL != "" {
+		mw.jwks = newJWKS(cfg.JWKSURL, cfg.JWKSRefresh)
+	}
+
+	return mw
+}
+
+func (mw *jwtMiddleware) Type() Type {
+	return TypeJWT
+}
+
+// Handler returns a middleware that requires a valid JWT in the
+// "Authorization: Bearer" header. Requests without a valid token are rejected
+// with 401, tokens that lack a required claim with 403. The claims of an
+// accepted token are available through ClaimsFromContext.
+func (mw *jwtMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range mw.cfg.ForwardClaims {
+			r.Header.Del(header)
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerSchema)
+		if !ok || token == "" {
+			mw.unauthorized(w, r, "missing_credentials", "")
+			return
+		}
+
+		claims, reason, err := mw.verify(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			mw.unauthorized(w, r, reason, err.Error())
+			return
+		}
+
+		if err := mw.checkRequiredClaims(claims); err != nil {
+			metrics.RecordAuthFailure(r, string(TypeJWT), "insufficient_claims")
+			w.Header().Set("WWW-Authenticate", mw.challenge("insufficient_scope", err.Error()))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		for claim, header := range mw.cfg.ForwardClaims {
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(header, sanitizeHeaderValue(claimString(value)))
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the token accepted by the JWT
+// middleware or of the OIDC session, or nil.
+func ClaimsFromContext(ctx context.Context) map[string]any {
+	claims, _ := ctx.Value(claimsKey{}).(map[string]any)
+	return claims
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and the registered claims of the token. On
+// failure it also returns the reason recorded in the auth failure metric.
+func (mw *jwtMiddleware) verify(ctx context.Context, token string) (map[string]any, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, "malformed_credentials", errors.New("token must have three parts")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, "malformed_credentials", fmt.Errorf("invalid header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, "malformed_credentials", errors.New("invalid signature encoding")
+	}
+
+	if !slices.Contains(mw.cfg.Algorithms, header.Alg) {
+		return nil, "invalid_signature", fmt.Errorf("algorithm %q is not allowed", header.Alg)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !mw.verifySignature(ctx, header, signed, signature) {
+		return nil, "invalid_signature", errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, "malformed_credentials", fmt.Errorf("invalid claims: %w", err)
+	}
+
+	if err := mw.checkRegisteredClaims(claims); err != nil {
+		return nil, "invalid_claims", err
+	}
+
+	return claims, "", nil
+}
+
+func (mw *jwtMiddleware) verifySignature(ctx context.Context, header jwtHeader, signed, signature []byte) bool {
+	if header.Alg == AlgHS256 {
+		if len(mw.cfg.Secret) == 0 {
+			return false
+		}
+
+		mac := hmac.New(sha256.New, mw.cfg.Secret)
+		mac.Write(signed)
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+
+	digest := sha256.Sum256(signed)
+
+	for _, key := range mw.candidateKeys(ctx, header.Kid) {
+		// The key type must match the algorithm, so a public key can never be
+		// used as an HMAC secret or with another scheme.
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if header.Alg == AlgRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if header.Alg == AlgES256 && len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(k, digest[:], r, s) {
+					return true
+				}
+			}
+		case ed25519.PublicKey:
+			if header.Alg == AlgEdDSA && ed25519.Verify(k, signed, signature) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// candidateKeys returns the configured keys and the JWKS keys for the key ID.
+func (mw *jwtMiddleware) candidateKeys(ctx context.Context, kid string) []crypto.PublicKey {
+	keys := mw.cfg.Keys
+	if mw.jwks != nil {
+		keys = append(slices.Clip(keys), mw.jwks.get(ctx, kid)...)
+	}
+
+	return keys
+}
+
+func (mw *jwtMiddleware) checkRegisteredClaims(claims map[string]any) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"]; ok {
+		t, ok := numericDate(exp)
+		if !ok {
+			return errors.New("invalid exp claim")
+		}
+		if !now.Before(t.Add(mw.cfg.ClockSkew)) {
+			return errors.New("token is expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := numericDate(nbf)
+		if !ok {
+			return errors.New("invalid nbf claim")
+		}
+		if now.Add(mw.cfg.ClockSkew).Before(t) {
+			return errors.New("token is not valid yet")
+		}
+	}
+
+	if mw.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != mw.cfg.Issuer {
+			return errors.New("invalid issuer")
+		}
+	}
+
+	if len(mw.cfg.Audience) > 0 {
+		if !slices.ContainsFunc(claimValues(claims["aud"]), func(aud string) bool {
+			return slices.Contains(mw.cfg.Audience, aud)
+		}) {
+			return errors.New("invalid audience")
+		}
+	}
+
+	return nil
+}
+
+func (mw *jwtMiddleware) checkRequiredClaims(claims map[string]any) error {
+	for name, accepted := range mw.cfg.RequiredClaims {
+		value, ok := claims[name]
+		if !ok {
+			return fmt.Errorf("claim %s is required", name)
+		}
+
+		if len(accepted) == 0 {
+			continue
+		}
+
+		values := claimValues(value)
+		if name == "scope" {
+			if s, ok := value.(string); ok {
+				values = strings.Fields(s)
+			}
+		}
+
+		if !slices.ContainsFunc(values, func(v string) bool { return slices.Contains(accepted, v) }) {
+			return fmt.Errorf("claim %s has no accepted value", name)
+		}
+	}
+
+	return nil
+}
+
+func (mw *jwtMiddleware) unauthorized(w http.ResponseWriter, r *http.Request, reason, description string) {
+	metrics.RecordAuthFailure(r, string(TypeJWT), reason)
+
+	errCode := ""
+	if reason != "missing_credentials" {
+		errCode = "invalid_token"
+	}
+
+	w.Header().Set("WWW-Authenticate", mw.challenge(errCode, description))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// challenge builds the WWW-Authenticate value of RFC 6750.
+func (mw *jwtMiddleware) challenge(errCode, description string) string {
+	challenge := fmt.Sprintf(`Bearer realm=%q`, mw.cfg.Realm)
+	if errCode != "" {
+		challenge += fmt.Sprintf(`, error=%q, error_description=%q`, errCode, description)
+	}
+
+	return challenge
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	f, err := n.Float64()
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return time.Time{}, false
+	}
+
+	sec, frac := math.Modf(f)
+
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// claimValues returns a string or array claim as a list of strings.
+func claimValues(v any) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		values := make([]string, 0, len(c))
+		for _, item := range c {
+			values = append(values, claimString(item))
+		}
+		return values
+	case nil:
+		return nil
+	}
+
+	return []string{claimString(v)}
+}
+
+// claimString formats a claim for a header: arrays are joined with commas
+// and objects are encoded as JSON.
+func claimString(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case json.Number:
+		return c.String()
+	case bool:
+		return strconv.FormatBool(c)
+	case []any:
+		return strings.Join(claimValues(c), ",")
+	}
+
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// sanitizeHeaderValue drops control characters, which are not allowed in
+// header values and would make the backend request fail.
+func sanitizeHeaderValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
@@ -8,13 +8,22 @@ import (
 type Type string
 
 const (
-	TypeRateLimit       Type = "rate_limit"       // Enforces request rate limits.
-	TypeBasicAuth       Type = "basic_auth"       // Provides HTTP Basic Authentication.
-	TypeCORS            Type = "cors"             // Handles Cross-Origin Resource Sharing.
-	TypeHeaders         Type = "headers"          // Modifies request and response headers.
-	TypeCompress        Type = "compress"         // Compresses response bodies with gzip.
-	TypeRequestID       Type = "request_id"       // Injects a unique ID into each request for tracing.
-	TypeSecurityHeaders Type = "security_headers" // Adds common HTTP security headers.
+	TypeRateLimit        Type = "rate_limit"        // Enforces request rate limits.
+	TypeBasicAuth        Type = "basic_auth"        // Provides HTTP Basic Authentication.
+	TypeCORS             Type = "cors"              // Handles Cross-Origin Resource Sharing.
+	TypeHeaders          Type = "headers"           // Modifies request and response headers.
+	TypeCompress         Type = "compress"          // Compresses response bodies with gzip.
+	TypeRequestID        Type = "request_id"        // Injects a unique ID into each request for tracing.
+	TypeSecurityHeaders  Type = "security_headers"  // Adds common HTTP security headers.
+	TypeRedirect         Type = "redirect"          // Redirects requests matching URL rules.
+	TypeRewrite          Type = "rewrite"           // Rewrites the request path before proxying.
+	TypeJWT              Type = "jwt"               // Authenticates requests with JWT bearer tokens.
+	TypeForwardAuth      Type = "forward_auth"      // Delegates authentication to an external service.
+	TypeOIDC             Type = "oidc"              // Requires an OpenID Connect login session.
+	TypeAPIKey           Type = "api_key"           // Authenticates API consumers by key.
+	TypeIPFilter         Type = "ip_filter"         // Allows or denies clients by IP network.
+	TypeConcurrencyLimit Type = "concurrency_limit" // Limits the number of requests handled at once.
+	TypeCache            Type = "cache"             // Caches backend responses.
 )
 
 // Middleware represents a configured middleware instance.
@@ -23,3 +32,18 @@ type Middleware interface {
 	Type() Type                        // Type identifies the kind of middleware (e.g., "cors", "basic_auth").
 	Handler(http.Handler) http.Handler // Handler contains the actual middleware logic that wraps the next handler in the chain.
 }
+
+// Skipped stands in for a middleware with side effects, such as counting
+// requests or calling other services, when requests are only explained. It
+// passes every request on.
+type Skipped struct {
+	T Type
+}
+
+func (mw *Skipped) Type() Type {
+	return mw.T
+}
+
+func (mw *Skipped) Handler(next http.Handler) http.Handler {
+	return next
+}
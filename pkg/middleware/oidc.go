@@ -0,0 +1,643 @@
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+const (
+	// oidcLoginTTL is how long a started login can be completed.
+	oidcLoginTTL = 10 * time.Minute
+
+	// oidcMaxCookie is the size limit of a cookie most browsers accept.
+	oidcMaxCookie = 4000
+
+	// oidcDefaultExpiry is used when the provider reports no token lifetime.
+	oidcDefaultExpiry = time.Hour
+
+	// oidcRefreshGrace is how long the result of a refresh is reused for
+	// requests that still carry the old refresh token, e.g. ones sent by the
+	// browser before it received the new session cookie.
+	oidcRefreshGrace = 30 * time.Second
+)
+
+// OIDCConfig holds the configuration for the OpenID Connect login middleware.
+type OIDCConfig struct {
+	// Issuer is the provider URL, its configuration is discovered from
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the callback URL registered at the provider. A path is
+	// resolved against the requested host. Requests to its path are handled
+	// by the middleware.
+	RedirectURL string
+
+	// LogoutPath ends the session. If the provider supports RP-initiated
+	// logout, the user is sent there and then back to PostLogoutRedirectURL.
+	LogoutPath            string
+	PostLogoutRedirectURL string
+
+	Scopes []string
+
+	// CookieName is the name of the session cookie. The cookie is encrypted
+	// with a key derived from CookieSecret, so it must be the same on every
+	// instance behind a load balancer.
+	CookieName   string
+	CookieSecret []byte
+
+	// SessionTTL is the maximum session lifetime. Within it, expired tokens
+	// are refreshed with the refresh token if the provider issued one.
+	SessionTTL time.Duration
+
+	// ClockSkew is the tolerance when checking ID token times.
+	ClockSkew time.Duration
+
+	// AllowedEmails lists the accepted email addresses; an entry starting
+	// with "@" accepts a whole domain. The email must not be marked as
+	// unverified.
+	AllowedEmails []string
+
+	// AllowedGroups lists the accepted groups of GroupsClaim. If both lists
+	// are set, the user must match both.
+	AllowedGroups []string
+	GroupsClaim   string
+
+	// ForwardClaims maps a claim name to the request header it is forwarded
+	// in. Client supplied values of these headers are always removed.
+	ForwardClaims map[string]string
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-Proto
+	// header is believed for the callback URL and the Secure cookie flag.
+	TrustedProxies []netip.Prefix
+}
+
+type oidcMiddleware struct {
+	cfg          *OIDCConfig
+	discovery    *oidcDiscovery
+	aead         cipher.AEAD
+	callbackPath string
+	keepClaims   []string
+
+	// refreshes holds the running and recently finished refreshes by refresh
+	// token, so parallel requests of a session refresh it only once.
+	refreshMu sync.Mutex
+	refreshes map[string]*oidcRefresh
+}
+
+// oidcRefresh is a refresh of the session tokens shared by the requests that
+// carry the same refresh token.
+type oidcRefresh struct {
+	done    chan struct{} // closed when session and err are set
+	session oidcSession
+	err     error
+	expires time.Time // when the finished refresh is dropped
+}
+
+func OIDC(cfg *OIDCConfig) Middleware {
+	key := sha256.Sum256(cfg.CookieSecret)
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+
+	callbackPath := cfg.RedirectURL
+	if u, err := url.Parse(cfg.RedirectURL); err == nil {
+		callbackPath = u.Path
+	}
+
+	keepClaims := []string{"sub", "email", "email_verified", cfg.GroupsClaim}
+	for claim := range cfg.ForwardClaims {
+		keepClaims = append(keepClaims, claim)
+	}
+
+	return &oidcMiddleware{
+		cfg: cfg,
+		discovery: &oidcDiscovery{
+			cfg:    cfg,
+			client: &http.Client{Timeout: oidcTimeout},
+		},
+		aead:         aead,
+		callbackPath: callbackPath,
+		keepClaims:   keepClaims,
+		refreshes:    make(map[string]*oidcRefresh),
+	}
+}
+
+func (mw *oidcMiddleware) Type() Type {
+	return TypeOIDC
+}
+
+// oidcSession is stored in the encrypted session cookie. Only the claims used
+// for the allow-lists and forwarded headers are kept, to stay within the
+// cookie size limit.
+type oidcSession struct {
+	Claims       map[string]any `json:"c"`
+	RefreshToken string         `json:"r,omitempty"`
+	Expiry       int64          `json:"e"`
+	Created      int64          `json:"t"`
+}
+
+// oidcLogin is stored in the login cookie between the redirect to the
+// provider and the callback.
+type oidcLogin struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"r"`
+	Expiry   int64  `json:"e"`
+}
+
+// Handler returns a middleware that requires a browser session established
+// with the OpenID Connect authorization code flow and PKCE. Unauthenticated
+// GET and HEAD requests are redirected to the provider, other requests are
+// rejected with 401. Users outside the allow-lists get 403. The claims of the
+// session are available through ClaimsFromContext.
+func (mw *oidcMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range mw.cfg.ForwardClaims {
+			r.Header.Del(header)
+		}
+
+		switch r.URL.Path {
+		case mw.callbackPath:
+			mw.callback(w, r)
+			return
+		case mw.cfg.LogoutPath:
+			mw.logout(w, r)
+			return
+		}
+
+		session := mw.session(w, r)
+		if session == nil {
+			mw.login(w, r)
+			return
+		}
+
+		if !mw.allowed(session.Claims) {
+			metrics.RecordAuthFailure(r, string(TypeOIDC), "forbidden")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		for claim, header := range mw.cfg.ForwardClaims {
+			if value, ok := session.Claims[claim]; ok {
+				r.Header.Set(header, sanitizeHeaderValue(claimString(value)))
+			}
+		}
+
+		// The session cookies are of no use to the backend and carry the
+		// refresh token.
+		removeCookies(r, mw.cfg.CookieName, mw.loginCookieName())
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, session.Claims)))
+	})
+}
+
+// session returns the session of the request, refreshing its tokens when
+// they have expired. It returns nil if there is no valid session.
+func (mw *oidcMiddleware) session(w http.ResponseWriter, r *http.Request) *oidcSession {
+	var session oidcSession
+	if !mw.readCookie(r, mw.cfg.CookieName, &session) {
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(session.Created, 0).Add(mw.cfg.SessionTTL)) {
+		return nil
+	}
+	if now.Before(time.Unix(session.Expiry, 0)) {
+		return &session
+	}
+	if session.RefreshToken == "" {
+		return nil
+	}
+
+	if err := mw.sharedRefresh(r.Context(), &session); err != nil {
+		slog.Warn("failed to refresh oidc session", logger.Error(err))
+		mw.clearCookie(w, r, mw.cfg.CookieName)
+		return nil
+	}
+
+	if err := mw.writeCookie(w, r, mw.cfg.CookieName, &session, mw.cfg.SessionTTL); err != nil {
+		slog.Error("failed to write oidc session", logger.Error(err))
+		return nil
+	}
+
+	return &session
+}
+
+// sharedRefresh refreshes the session tokens once for all requests with the
+// same refresh token. Providers that rotate refresh tokens reject the old one
+// after its first use, so refreshing per request would end the session of a
+// page that sends several requests at once.
+func (mw *oidcMiddleware) sharedRefresh(ctx context.Context, session *oidcSession) error {
+	token := session.RefreshToken
+	now := time.Now()
+
+	mw.refreshMu.Lock()
+
+	for t, call := range mw.refreshes {
+		if !call.expires.IsZero() && now.After(call.expires) {
+			delete(mw.refreshes, t)
+		}
+	}
+
+	call, ok := mw.refreshes[token]
+	if !ok {
+		call = &oidcRefresh{done: make(chan struct{}), session: *session}
+		mw.refreshes[token] = call
+
+		// The refresh is shared, so it must not be aborted when the client
+		// that started it goes away.
+		go func() {
+			err := mw.refresh(context.WithoutCancel(ctx), &call.session)
+
+			mw.refreshMu.Lock()
+			call.err = err
+			call.expires = time.Now().Add(oidcRefreshGrace)
+			mw.refreshMu.Unlock()
+
+			close(call.done)
+		}()
+	}
+
+	mw.refreshMu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if call.err != nil {
+		return call.err
+	}
+
+	*session = call.session
+
+	return nil
+}
+
+func (mw *oidcMiddleware) refresh(ctx context.Context, session *oidcSession) error {
+	provider, err := mw.discovery.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := mw.token(ctx, provider, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The provider may rotate the refresh token and issue a new ID token.
+	if tokens.RefreshToken != "" {
+		session.RefreshToken = tokens.RefreshToken
+	}
+
+	claims := session.Claims
+	if tokens.IDToken != "" {
+		if claims, _, err = provider.verifier.verify(ctx, tokens.IDToken); err != nil {
+			return fmt.Errorf("invalid id token: %w", err)
+		}
+		if claims["sub"] != session.Claims["sub"] {
+			return errors.New("id token subject changed")
+		}
+	}
+
+	mw.updateSession(session, claims, tokens)
+
+	return nil
+}
+
+// login redirects the user to the provider's authorization endpoint.
+func (mw *oidcMiddleware) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "missing_credentials")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := mw.discovery.get(r.Context())
+	if err != nil {
+		slog.Error("oidc provider discovery failed", slog.String("issuer", mw.cfg.Issuer), logger.Error(err))
+		http.Error(w, "Authentication provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	login := oidcLogin{
+		State:    randomToken(),
+		Verifier: randomToken(),
+		Nonce:    randomToken(),
+		Redirect: r.URL.RequestURI(),
+		Expiry:   time.Now().Add(oidcLoginTTL).Unix(),
+	}
+
+	if err := mw.writeCookie(w, r, mw.loginCookieName(), &login, oidcLoginTTL); err != nil {
+		slog.Error("failed to write oidc login state", logger.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := url.Parse(provider.meta.AuthorizationEndpoint)
+	if err != nil {
+		slog.Error("invalid oidc authorization endpoint", logger.Error(err))
+		http.Error(w, "Authentication provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", mw.cfg.ClientID)
+	query.Set("redirect_uri", mw.absoluteURL(r, mw.cfg.RedirectURL))
+	query.Set("scope", strings.Join(mw.cfg.Scopes, " "))
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// callback completes the login: it exchanges the authorization code for
+// tokens, verifies the ID token and starts the session.
+func (mw *oidcMiddleware) callback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	if !mw.readCookie(r, mw.loginCookieName(), &login) || time.Now().After(time.Unix(login.Expiry, 0)) {
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "invalid_state")
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	mw.clearCookie(w, r, mw.loginCookieName())
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "invalid_state")
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	if errCode := query.Get("error"); errCode != "" {
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "provider_error")
+		http.Error(w, "Login failed: "+sanitizeHeaderValue(errCode), http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := mw.discovery.get(r.Context())
+	if err != nil {
+		slog.Error("oidc provider discovery failed", slog.String("issuer", mw.cfg.Issuer), logger.Error(err))
+		http.Error(w, "Authentication provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	tokens, err := mw.token(r.Context(), provider, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {mw.absoluteURL(r, mw.cfg.RedirectURL)},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		slog.Warn("oidc code exchange failed", logger.Error(err))
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "invalid_code")
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	claims, reason, err := provider.verifier.verify(r.Context(), tokens.IDToken)
+	if err == nil && claims["nonce"] != login.Nonce {
+		reason, err = "invalid_claims", errors.New("invalid nonce")
+	}
+	if err != nil {
+		slog.Warn("invalid oidc id token", logger.Error(err))
+		metrics.RecordAuthFailure(r, string(TypeOIDC), reason)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if !mw.allowed(claims) {
+		metrics.RecordAuthFailure(r, string(TypeOIDC), "forbidden")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	session := oidcSession{
+		RefreshToken: tokens.RefreshToken,
+		Created:      time.Now().Unix(),
+	}
+	mw.updateSession(&session, claims, tokens)
+
+	if err := mw.writeCookie(w, r, mw.cfg.CookieName, &session, mw.cfg.SessionTTL); err != nil {
+		slog.Error("failed to write oidc session", logger.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, localRedirect(login.Redirect), http.StatusFound)
+}
+
+// logout clears the session and ends the session at the provider if it
+// supports RP-initiated logout.
+func (mw *oidcMiddleware) logout(w http.ResponseWriter, r *http.Request) {
+	mw.clearCookie(w, r, mw.cfg.CookieName)
+
+	target := "/"
+	if mw.cfg.PostLogoutRedirectURL != "" {
+		target = mw.absoluteURL(r, mw.cfg.PostLogoutRedirectURL)
+	}
+
+	if provider, err := mw.discovery.get(r.Context()); err == nil && provider.meta.EndSessionEndpoint != "" {
+		if endURL, err := url.Parse(provider.meta.EndSessionEndpoint); err == nil {
+			query := endURL.Query()
+			query.Set("client_id", mw.cfg.ClientID)
+			if mw.cfg.PostLogoutRedirectURL != "" {
+				query.Set("post_logout_redirect_uri", target)
+			}
+			endURL.RawQuery = query.Encode()
+			target = endURL.String()
+		}
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// updateSession stores the claims and the token expiry in the session.
+func (mw *oidcMiddleware) updateSession(session *oidcSession, claims map[string]any, tokens *tokenResponse) {
+	session.Claims = make(map[string]any, len(mw.keepClaims))
+	for _, claim := range mw.keepClaims {
+		if value, ok := claims[claim]; ok {
+			session.Claims[claim] = value
+		}
+	}
+
+	expiry := time.Now().Add(oidcDefaultExpiry)
+	if tokens.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	} else if exp, ok := numericDate(claims["exp"]); ok && tokens.IDToken != "" {
+		expiry = exp
+	}
+	session.Expiry = expiry.Unix()
+}
+
+func (mw *oidcMiddleware) allowed(claims map[string]any) bool {
+	if len(mw.cfg.AllowedEmails) > 0 {
+		email, _ := claims["email"].(string)
+		email = strings.ToLower(email)
+
+		if verified, ok := claims["email_verified"].(bool); email == "" || ok && !verified {
+			return false
+		}
+
+		if !slices.ContainsFunc(mw.cfg.AllowedEmails, func(allowed string) bool {
+			allowed = strings.ToLower(allowed)
+			if strings.HasPrefix(allowed, "@") {
+				return strings.HasSuffix(email, allowed)
+			}
+			return email == allowed
+		}) {
+			return false
+		}
+	}
+
+	if len(mw.cfg.AllowedGroups) > 0 {
+		if !slices.ContainsFunc(claimValues(claims[mw.cfg.GroupsClaim]), func(group string) bool {
+			return slices.Contains(mw.cfg.AllowedGroups, group)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (mw *oidcMiddleware) loginCookieName() string {
+	return mw.cfg.CookieName + "_login"
+}
+
+// writeCookie encrypts v into the cookie. The cookie name is authenticated as
+// well, so a login cookie can't be used as a session cookie.
+func (mw *oidcMiddleware) writeCookie(w http.ResponseWriter, r *http.Request, name string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, mw.aead.NonceSize())
+	rand.Read(nonce)
+
+	value := base64.RawURLEncoding.EncodeToString(mw.aead.Seal(nonce, nonce, data, []byte(name)))
+	if len(value) > oidcMaxCookie {
+		return fmt.Errorf("cookie %s is too large (%d bytes)", name, len(value))
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   requestScheme(r, mw.cfg.TrustedProxies) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+func (mw *oidcMiddleware) readCookie(r *http.Request, name string, v any) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(data) < mw.aead.NonceSize() {
+		return false
+	}
+
+	nonce, ciphertext := data[:mw.aead.NonceSize()], data[mw.aead.NonceSize():]
+
+	plaintext, err := mw.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(plaintext, v) == nil
+}
+
+func (mw *oidcMiddleware) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   requestScheme(r, mw.cfg.TrustedProxies) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// absoluteURL resolves a path against the scheme and host of the request.
+func (mw *oidcMiddleware) absoluteURL(r *http.Request, target string) string {
+	if !strings.HasPrefix(target, "/") {
+		return target
+	}
+
+	return requestScheme(r, mw.cfg.TrustedProxies) + "://" + r.Host + target
+}
+
+// localRedirect only allows paths on the same host, so the redirect stored in
+// the login state can't be used as an open redirect.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+
+	return target
+}
+
+// removeCookies drops the named cookies from the request.
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	if !slices.ContainsFunc(cookies, func(c *http.Cookie) bool { return slices.Contains(names, c.Name) }) {
+		return
+	}
+
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !slices.Contains(names, c.Name) {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// randomToken returns 32 random bytes, base64url encoded, for state, nonce
+// and PKCE verifier values.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
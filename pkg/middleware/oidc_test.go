@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oidcStandIn is a minimal OpenID provider: discovery, an empty key set and
+// a token endpoint that rotates refresh tokens and rejects reused ones.
+type oidcStandIn struct {
+	srv *httptest.Server
+
+	// started and release, if set, hold discovery requests until release
+	// is closed.
+	started chan struct{}
+	release chan struct{}
+
+	mu            sync.Mutex
+	refreshToken  string
+	rotations     int
+	tokenRequests int
+}
+
+func newOIDCStandIn(t *testing.T) *oidcStandIn {
+	t.Helper()
+
+	p := &oidcStandIn{refreshToken: "refresh-0"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[]}`))
+	})
+	mux.HandleFunc("POST /token", p.token)
+
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+
+	return p
+}
+
+func (p *oidcStandIn) discovery(w http.ResponseWriter, r *http.Request) {
+	if p.started != nil {
+		p.started <- struct{}{}
+		<-p.release
+	}
+
+	json.NewEncoder(w).Encode(oidcMetadata{
+		Issuer:                p.srv.URL,
+		AuthorizationEndpoint: p.srv.URL + "/authorize",
+		TokenEndpoint:         p.srv.URL + "/token",
+		JWKSURI:               p.srv.URL + "/jwks",
+	})
+}
+
+func (p *oidcStandIn) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tokenRequests++
+
+	if r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != p.refreshToken {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+		return
+	}
+
+	p.rotations++
+	p.refreshToken = "refresh-" + strconv.Itoa(p.rotations)
+
+	json.NewEncoder(w).Encode(tokenResponse{RefreshToken: p.refreshToken, ExpiresIn: 3600})
+}
+
+func (p *oidcStandIn) tokenRequestCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.tokenRequests
+}
+
+func newTestOIDC(p *oidcStandIn) *oidcMiddleware {
+	return OIDC(&OIDCConfig{
+		Issuer:       p.srv.URL,
+		ClientID:     "rp",
+		ClientSecret: "secret",
+		RedirectURL:  "/oauth2/callback",
+		LogoutPath:   "/logout",
+		Scopes:       []string{"openid"},
+		CookieName:   "_rp_oidc",
+		CookieSecret: []byte("0123456789abcdef0123456789abcdef"),
+		SessionTTL:   time.Hour,
+	}).(*oidcMiddleware)
+}
+
+// expiredSession returns a session cookie whose tokens have to be refreshed.
+func expiredSession(t *testing.T, mw *oidcMiddleware, refreshToken string) *http.Cookie {
+	t.Helper()
+
+	session := &oidcSession{
+		Claims:       map[string]any{"sub": "alice"},
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(-time.Minute).Unix(),
+		Created:      time.Now().Unix(),
+	}
+
+	w := httptest.NewRecorder()
+	if err := mw.writeCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), mw.cfg.CookieName, session, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Result().Cookies()[0]
+}
+
+func TestOIDCParallelRefresh(t *testing.T) {
+	p := newOIDCStandIn(t)
+	mw := newTestOIDC(p)
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cookie := expiredSession(t, mw, "refresh-0")
+
+	const requests = 10
+
+	var wg sync.WaitGroup
+	statuses := make([]int, requests)
+	sessions := make([]oidcSession, requests)
+
+	for i := range requests {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			req.AddCookie(cookie)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			statuses[i] = w.Code
+
+			next := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, c := range w.Result().Cookies() {
+				next.AddCookie(c)
+			}
+			mw.readCookie(next, mw.cfg.CookieName, &sessions[i])
+		})
+	}
+	wg.Wait()
+
+	for i := range requests {
+		if statuses[i] != http.StatusOK {
+			t.Errorf("request %d: status %d, want %d", i, statuses[i], http.StatusOK)
+		}
+		if sessions[i].RefreshToken != "refresh-1" {
+			t.Errorf("request %d: refresh token %q, want refresh-1", i, sessions[i].RefreshToken)
+		}
+	}
+
+	if n := p.tokenRequestCount(); n != 1 {
+		t.Errorf("got %d token requests, want 1", n)
+	}
+}
+
+func TestOIDCRefreshRejected(t *testing.T) {
+	p := newOIDCStandIn(t)
+	mw := newTestOIDC(p)
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.AddCookie(expiredSession(t, mw, "revoked"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("status %d, want a redirect to the provider", w.Code)
+	}
+
+	var cleared bool
+	for _, c := range w.Result().Cookies() {
+		if c.Name == mw.cfg.CookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("the session cookie was not cleared")
+	}
+}
+
+func TestOIDCDiscoveryCanceled(t *testing.T) {
+	p := newOIDCStandIn(t)
+	p.started = make(chan struct{})
+	p.release = make(chan struct{})
+
+	mw := newTestOIDC(p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := mw.discovery.get(ctx)
+		errc <- err
+	}()
+
+	// The client goes away while the provider is slow.
+	<-p.started
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// The discovery is not aborted, and the next request doesn't have to
+	// wait for the retry interval.
+	close(p.release)
+
+	provider, err := mw.discovery.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.meta.TokenEndpoint != p.srv.URL+"/token" {
+		t.Errorf("token endpoint %q", provider.meta.TokenEndpoint)
+	}
+}
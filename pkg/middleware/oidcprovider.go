@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcTimeout  = 10 * time.Second
+	oidcMaxBytes = 1 << 20
+
+	// oidcRetryInterval limits discovery attempts while the provider is
+	// unreachable.
+	oidcRetryInterval = 10 * time.Second
+)
+
+// oidcMetadata is the part of the provider configuration (OpenID Connect
+// Discovery 1.0) used by the middleware.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcProvider is a discovered OpenID provider with the verifier for its ID
+// tokens.
+type oidcProvider struct {
+	meta     oidcMetadata
+	verifier *jwtMiddleware
+}
+
+// oidcDiscovery fetches the provider configuration on first use, so the proxy
+// starts even if the provider is down, and keeps it once it succeeded.
+type oidcDiscovery struct {
+	cfg    *OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	provider    *oidcProvider
+	lastErr     error
+	lastAttempt time.Time
+
+	// running is closed when the running discovery finishes, nil if none runs.
+	running chan struct{}
+}
+
+// get returns the provider, discovering it if needed. The discovery is not
+// bound to ctx: it runs on its own and is shared by every waiting request, so
+// a client that goes away neither aborts it nor leaves its error behind.
+func (d *oidcDiscovery) get(ctx context.Context) (*oidcProvider, error) {
+	d.mu.Lock()
+
+	if d.provider != nil {
+		d.mu.Unlock()
+		return d.provider, nil
+	}
+
+	if d.running == nil {
+		if time.Since(d.lastAttempt) < oidcRetryInterval {
+			d.mu.Unlock()
+			return nil, d.lastErr
+		}
+		d.lastAttempt = time.Now()
+
+		d.running = make(chan struct{})
+		go d.run(d.running)
+	}
+
+	running := d.running
+	d.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.provider, d.lastErr
+}
+
+func (d *oidcDiscovery) run(done chan struct{}) {
+	provider, err := d.discover(context.Background())
+
+	d.mu.Lock()
+	d.provider, d.lastErr = provider, err
+	d.running = nil
+	d.mu.Unlock()
+
+	close(done)
+}
+
+func (d *oidcDiscovery) discover(ctx context.Context) (*oidcProvider, error) {
+	issuer := strings.TrimSuffix(d.cfg.Issuer, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider configuration: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch provider configuration: unexpected status %d", resp.StatusCode)
+	}
+
+	var meta oidcMetadata
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBytes)).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("failed to decode provider configuration: %w", err)
+	}
+
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", meta.Issuer, d.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("provider configuration lacks authorization_endpoint, token_endpoint or jwks_uri")
+	}
+
+	algorithms := []string{AlgRS256, AlgES256, AlgEdDSA}
+	if len(d.cfg.ClientSecret) > 0 {
+		algorithms = append(algorithms, AlgHS256)
+	}
+
+	verifier := JWT(&JWTConfig{
+		Algorithms:  algorithms,
+		Secret:      []byte(d.cfg.ClientSecret),
+		JWKSURL:     meta.JWKSURI,
+		JWKSRefresh: time.Hour,
+		Issuer:      meta.Issuer,
+		Audience:    []string{d.cfg.ClientID},
+		ClockSkew:   d.cfg.ClockSkew,
+	}).(*jwtMiddleware)
+
+	return &oidcProvider{meta: meta, verifier: verifier}, nil
+}
+
+// tokenResponse is the token endpoint response of RFC 6749 and OpenID Connect.
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// token calls the token endpoint with the client credentials.
+func (mw *oidcMiddleware) token(ctx context.Context, provider *oidcProvider, form url.Values) (*tokenResponse, error) {
+	if mw.cfg.ClientSecret == "" {
+		form.Set("client_id", mw.cfg.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if mw.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(mw.cfg.ClientID), url.QueryEscape(mw.cfg.ClientSecret))
+	}
+
+	resp, err := mw.discovery.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBytes)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token response (status %d): %w", resp.StatusCode, err)
+	}
+
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed: unexpected status %d", resp.StatusCode)
+	}
+
+	return &tokens, nil
+}
@@ -3,21 +3,33 @@ package middleware
 import (
 	"fmt"
 	"log/slog"
-	"net"
+	"math"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
-	lru "github.com/hashicorp/golang-lru/v2/expirable"
-	"golang.org/x/time/rate"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
 )
 
 const (
-	lruCapacity = 1000
+	lruCapacity = 10000
 	lruTTL      = 15 * time.Minute
 )
 
+// Rate limit key parts, combined with "+" (e.g. "ip+path").
+const (
+	RateLimitKeyIP       = "ip"
+	RateLimitKeyConsumer = "consumer" // Same as RateLimitKeyAPIKey.
+	RateLimitKeyAPIKey   = "api_key"
+	RateLimitKeyUser     = "user"
+	RateLimitKeyPath     = "path"
+	RateLimitKeyHeader   = "header:" // Followed by the header name.
+)
+
 // RatelimitConfig holds configuration for the rate limiting middleware.
 type RatelimitConfig struct {
 	// Requests is the number of requests allowed within the Window duration.
@@ -28,19 +40,68 @@ type RatelimitConfig struct {
 
 	// Burst is the maximum burst size of requests allowed instantly.
 	Burst int
+
+	// Key lists the parts requests are limited by, see ParseRateLimitKey.
+	// An empty key limits by client IP.
+	Key []string
+
+	// Overrides replaces the limit for individual API consumers. It applies
+	// when Key contains RateLimitKeyConsumer or RateLimitKeyAPIKey.
+	Overrides map[string]RateLimitOverride
+
+	// TrustedProxies are the proxies whose X-Forwarded-For entries are
+	// followed to find the client IP, see ClientIP. Without them the address
+	// of the connection is used.
+	TrustedProxies []netip.Prefix
+
+	// Store keeps the limits. If nil, a memory store is used with CacheSize
+	// limiters, each kept for CacheTTL after its last use. When the memory
+	// store is full, the least recently used limiter is dropped and its client
+	// starts with a full bucket again.
+	Store     RateLimitStore
+	CacheSize int
+	CacheTTL  time.Duration
+
+	// FailOpen lets requests pass when the store fails; otherwise they are
+	// rejected with 503.
+	FailOpen bool
+}
+
+// RateLimitOverride is the limit of a single consumer.
+type RateLimitOverride struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
 }
 
 type ratelimitMiddleware struct {
 	cfg   *RatelimitConfig
-	cache *lru.LRU[string, *rate.Limiter]
+	store RateLimitStore
+
+	// lastStoreError throttles the logging of store failures.
+	lastStoreError atomic.Int64
 }
 
 func RateLimit(cfg *RatelimitConfig) Middleware {
-	cache := lru.NewLRU[string, *rate.Limiter](lruCapacity, nil, lruTTL)
+	store := cfg.Store
+
+	if store == nil {
+		size := cfg.CacheSize
+		if size <= 0 {
+			size = lruCapacity
+		}
+
+		ttl := cfg.CacheTTL
+		if ttl <= 0 {
+			ttl = lruTTL
+		}
+
+		store = NewMemoryRateLimitStore(size, ttl)
+	}
 
 	return &ratelimitMiddleware{
 		cfg:   cfg,
-		cache: cache,
+		store: store,
 	}
 }
 
@@ -48,32 +109,42 @@ func (mw *ratelimitMiddleware) Type() Type {
 	return TypeRateLimit
 }
 
-// RateLimit creates a middleware that enforces rate limiting per client IP address.
-// It uses a token bucket algorithm via golang.org/x/time/rate.
+// RateLimit creates a middleware that enforces rate limiting per client IP address,
+// or per any combination of the key parts of RatelimitConfig.Key.
+// How the limit is enforced depends on the store, see NewMemoryRateLimitStore
+// and NewRedisRateLimitStore.
 //
 // The rate is calculated as Requests per Window (e.g., 10 requests per minute).
-// Burst allows short bursts of traffic beyond the sustained rate.
-// Clients exceeding the limit receive HTTP 429 Too Many Requests.
+// Every response carries the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers; clients exceeding the limit receive HTTP 429 Too
+// Many Requests with a Retry-After header.
 func (mw *ratelimitMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, err := getIP(r)
+		key, limit, err := mw.key(r)
 		if err != nil {
 			slog.Error("failed get ip", logger.Error(err))
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		limiter, ok := mw.cache.Get(ip)
+		result, err := mw.store.Take(r.Context(), key, limit)
+		if err != nil {
+			mw.logStoreError(err)
+
+			if mw.cfg.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-		if !ok {
-			limiter = rate.NewLimiter(
-				rate.Every(mw.cfg.Window/time.Duration(mw.cfg.Requests)),
-				mw.cfg.Burst,
-			)
-			mw.cache.Add(ip, limiter)
+			metrics.RecordRejection(r, string(TypeRateLimit))
+			http.Error(w, "Rate limit unavailable", http.StatusServiceUnavailable)
+			return
 		}
 
-		if !limiter.Allow() {
+		setRateLimitHeaders(w.Header(), result)
+
+		if !result.Allowed {
+			metrics.RecordRejection(r, string(TypeRateLimit))
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
@@ -82,31 +153,107 @@ func (mw *ratelimitMiddleware) Handler(next http.Handler) http.Handler {
 	})
 }
 
-func getIP(r *http.Request) (string, error) {
-	ips := r.Header.Get("X-Forwarded-For")
-	splitIps := strings.Split(ips, ",")
+// setRateLimitHeaders reports the result in the headers of the IETF
+// RateLimit header fields draft, with times rounded up to whole seconds.
+func setRateLimitHeaders(h http.Header, result RateLimitResult) {
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
 
-	if len(splitIps) > 0 {
-		netIP := net.ParseIP(splitIps[0])
-		if netIP != nil {
-			return netIP.String(), nil
+	if !result.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(result.RetryAfter), 1)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(max(d, 0).Seconds()))
+}
+
+func (mw *ratelimitMiddleware) logStoreError(err error) {
+	now := time.Now().UnixNano()
+	last := mw.lastStoreError.Load()
+
+	if now-last < int64(time.Minute) || !mw.lastStoreError.CompareAndSwap(last, now) {
+		return
+	}
+
+	slog.Error("rate limit store failed", slog.Bool("fail_open", mw.cfg.FailOpen), logger.Error(err))
+}
+
+// key returns the cache key of the limiter for the request and its limit.
+// Key parts without a value for the request, e.g. the user of an anonymous
+// request, are replaced by the client IP, so those requests are not all
+// limited together.
+func (mw *ratelimitMiddleware) key(r *http.Request) (string, RateLimitOverride, error) {
+	limit := RateLimitOverride{Requests: mw.cfg.Requests, Window: mw.cfg.Window, Burst: mw.cfg.Burst}
+
+	parts := mw.cfg.Key
+	if len(parts) == 0 {
+		parts = []string{RateLimitKeyIP}
+	}
+
+	var b strings.Builder
+
+	for _, part := range parts {
+		var value string
+
+		switch {
+		case part == RateLimitKeyConsumer || part == RateLimitKeyAPIKey:
+			value = ConsumerFromContext(r.Context())
+			if override, ok := mw.cfg.Overrides[value]; ok && value != "" {
+				limit = override
+			}
+		case part == RateLimitKeyUser:
+			value = UserFromContext(r.Context())
+		case part == RateLimitKeyPath:
+			value = r.URL.Path
+		case strings.HasPrefix(part, RateLimitKeyHeader):
+			value = r.Header.Get(strings.TrimPrefix(part, RateLimitKeyHeader))
+		}
+
+		if value == "" {
+			ip, err := mw.clientIP(r)
+			if err != nil {
+				return "", limit, err
+			}
+			part, value = RateLimitKeyIP, ip
 		}
+
+		fmt.Fprintf(&b, "%s=%q;", part, value)
 	}
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return b.String(), limit, nil
+}
+
+func (mw *ratelimitMiddleware) clientIP(r *http.Request) (string, error) {
+	ip, err := ClientIP(r, mw.cfg.TrustedProxies)
 	if err != nil {
-		return "", fmt.Errorf("invalid RemoteAddr: %w", err)
+		return "", err
 	}
 
-	netIP := net.ParseIP(ip)
-	if netIP != nil {
-		ip := netIP.String()
-		if ip == "::1" {
-			return "127.0.0.1", nil
-		}
+	return ip.String(), nil
+}
+
+// ParseRateLimitKey splits a key like "ip+path" or "header:X-Tenant+user"
+// into its parts and checks them.
+func ParseRateLimitKey(key string) ([]string, error) {
+	parts := strings.Split(key, "+")
 
-		return ip, nil
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		parts[i] = part
+
+		switch {
+		case part == RateLimitKeyIP, part == RateLimitKeyConsumer, part == RateLimitKeyAPIKey,
+			part == RateLimitKeyUser, part == RateLimitKeyPath:
+		case strings.HasPrefix(part, RateLimitKeyHeader):
+			if strings.TrimPrefix(part, RateLimitKeyHeader) == "" {
+				return nil, fmt.Errorf("missing header name in %q", part)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key part %q (must be ip, user, api_key, consumer, path or header:<name>)", part)
+		}
 	}
 
-	return "", fmt.Errorf("failed to parse IP: %s", ip)
+	return parts, nil
 }
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimitClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []netip.Prefix
+		remote  string
+		xff     string
+		want    string
+	}{
+		{name: "no trusted proxies", remote: "203.0.113.7:4000", xff: "198.51.100.1", want: "203.0.113.7"},
+		{name: "untrusted peer", trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, remote: "203.0.113.7:4000", xff: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted peer", trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, remote: "10.0.0.2:4000", xff: "198.51.100.1, 203.0.113.9", want: "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := RateLimit(&RatelimitConfig{Requests: 1, Window: time.Minute, TrustedProxies: tt.trusted}).(*ratelimitMiddleware)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", tt.xff)
+
+			ip, err := mw.clientIP(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip != tt.want {
+				t.Errorf("got %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitSpoofedForwardedFor(t *testing.T) {
+	mw := RateLimit(&RatelimitConfig{Requests: 1, Window: time.Minute, Burst: 1})
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := make([]int, 0, 3)
+	for _, xff := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		r.Header.Set("X-Forwarded-For", xff)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("got statuses %v, a new X-Forwarded-For value must not reset the limit", codes)
+	}
+}
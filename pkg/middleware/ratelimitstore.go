@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitStore keeps the state of the rate limits. The memory store limits
+// every proxy instance on its own; a shared store such as the Redis store
+// enforces the limit across all instances.
+type RateLimitStore interface {
+	// Take counts one request for key under the given limit and reports
+	// whether it is allowed.
+	Take(ctx context.Context, key string, limit RateLimitOverride) (RateLimitResult, error)
+}
+
+// RateLimitResult is the outcome of RateLimitStore.Take, reported to the
+// client in the RateLimit-* and Retry-After headers.
+type RateLimitResult struct {
+	Allowed bool
+
+	// Limit is the number of requests the client can make at once, Remaining
+	// how many of them are left.
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+
+	// RetryAfter is the time until the next request is allowed, set when the
+	// request was denied.
+	RetryAfter time.Duration
+}
+
+type memoryRateLimitStore struct {
+	cache *ttlCache[string, *rate.Limiter]
+}
+
+// NewMemoryRateLimitStore returns a store that keeps a token bucket per key
+// in this process. At most size buckets are kept, unused ones for ttl.
+func NewMemoryRateLimitStore(size int, ttl time.Duration) RateLimitStore {
+	return &memoryRateLimitStore{
+		cache: newTTLCache[string, *rate.Limiter](size, ttl, true),
+	}
+}
+
+// Take uses a token bucket via golang.org/x/time/rate: the bucket holds
+// Burst requests and refills at Requests per Window.
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, limit RateLimitOverride) (RateLimitResult, error) {
+	limiter, ok := s.cache.Get(key)
+
+	if !ok {
+		limiter = rate.NewLimiter(
+			rate.Every(limit.Window/time.Duration(limit.Requests)),
+			limit.Burst,
+		)
+		s.cache.Add(key, limiter)
+	}
+
+	now := time.Now()
+	allowed := limiter.AllowN(now, 1)
+
+	burst := limiter.Burst()
+	tokens := limiter.TokensAt(now)
+	perSecond := float64(limiter.Limit())
+
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     burst,
+		Remaining: max(int(math.Floor(tokens)), 0),
+	}
+
+	if perSecond > 0 {
+		result.Reset = max(secondsDuration((float64(burst)-tokens)/perSecond), 0)
+		if !allowed {
+			result.RetryAfter = secondsDuration((1 - tokens) / perSecond)
+		}
+	}
+
+	return result, nil
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
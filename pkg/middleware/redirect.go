@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+type redirectMiddleware struct {
+	cfg *RewriteConfig
+}
+
+// Redirect returns a middleware that answers matching requests with a redirect
+// instead of forwarding them to the backend.
+//
+// Each rule is matched against the full request URL without the query string,
+// e.g. "http://example.com/docs". This covers the common cases:
+//
+//   - HTTP to HTTPS:        Match = "^http://(.*)",             Replacement = "https://$1"
+//   - www canonicalization: Match = "^(https?)://example.com/(.*)", Replacement = "$1://www.example.com/$2"
+//
+// If PreserveQuery is set, the original query string is appended to the location.
+// Rules whose replacement produces the same URL are skipped to avoid redirect loops.
+func Redirect(cfg *RewriteConfig) Middleware {
+	return &redirectMiddleware{cfg: cfg}
+}
+
+func (mw *redirectMiddleware) Type() Type {
+	return TypeRedirect
+}
+
+func (mw *redirectMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := requestScheme(r, mw.cfg.TrustedProxies) + "://" + r.Host + r.URL.EscapedPath()
+
+		for _, rule := range mw.cfg.Rules {
+			if !rule.matchConditions(r, mw.cfg.TrustedProxies) || !rule.Match.MatchString(target) {
+				continue
+			}
+
+			location := rule.Match.ReplaceAllString(target, rule.Replacement)
+			if location == target {
+				continue
+			}
+
+			if rule.PreserveQuery && r.URL.RawQuery != "" {
+				sep := "?"
+				if strings.Contains(location, "?") {
+					sep = "&"
+				}
+				location += sep + r.URL.RawQuery
+			}
+
+			http.Redirect(w, r, location, rule.StatusCode)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
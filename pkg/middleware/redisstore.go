@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/internal/resp"
+)
+
+// redisRetryInterval is how long the Redis store fails fast after a
+// connection error, so an unreachable server doesn't add its timeout to every
+// request.
+const redisRetryInterval = time.Second
+
+// RedisStoreConfig holds the connection settings of the Redis rate limit store.
+type RedisStoreConfig struct {
+	Address  string
+	Password string
+	DB       int
+	Timeout  time.Duration
+
+	// Prefix is prepended to every key, so several proxies can share a
+	// server without sharing their limits.
+	Prefix string
+}
+
+type redisRateLimitStore struct {
+	client    *resp.Client
+	prefix    string
+	downUntil atomic.Int64
+}
+
+// NewRedisRateLimitStore returns a store that keeps the limits in Redis or
+// a server compatible with its protocol, shared by all proxy instances using
+// it. It uses a sliding window: the count of the current fixed window plus
+// the count of the previous one, weighted by how much of it still overlaps
+// the sliding window, must not exceed Requests. Burst is not supported. The
+// instances' clocks should be synchronized.
+func NewRedisRateLimitStore(cfg *RedisStoreConfig) RateLimitStore {
+	return &redisRateLimitStore{
+		client: redisClient(resp.Config{
+			Address:  cfg.Address,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+			Timeout:  cfg.Timeout,
+		}),
+		prefix: cfg.Prefix,
+	}
+}
+
+var (
+	redisClientsMu sync.Mutex
+	redisClients   = make(map[resp.Config]*resp.Client)
+)
+
+// redisClient returns the client for the connection settings. Clients are
+// shared, so middlewares rebuilt on every config reload reuse the open
+// connections instead of leaking them.
+func redisClient(cfg resp.Config) *resp.Client {
+	redisClientsMu.Lock()
+	defer redisClientsMu.Unlock()
+
+	client, ok := redisClients[cfg]
+	if !ok {
+		client = resp.New(cfg)
+		redisClients[cfg] = client
+	}
+
+	return client
+}
+
+// redisTakeScript counts a request if it fits into the sliding window. It
+// runs atomically, so concurrent requests can't both take the last slot, and
+// denied requests are not counted, so clients that keep retrying are not
+// locked out for longer.
+//
+// KEYS: the counters of the current and the previous window.
+// ARGV: the weight of the previous window, the limit and the counter TTL in
+// milliseconds.
+// Returns {allowed, current count, previous count}.
+const redisTakeScript = `
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+
+if previous * tonumber(ARGV[1]) + current + 1 > tonumber(ARGV[2]) then
+	return {0, current, previous}
+end
+
+current = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+
+return {1, current, previous}
+`
+
+// redisTakeSHA is the SHA-1 the server caches redisTakeScript under.
+var redisTakeSHA = func() string {
+	sum := sha1.Sum([]byte(redisTakeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+var errStoreUnavailable = errors.New("rate limit store unavailable")
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, limit RateLimitOverride) (RateLimitResult, error) {
+	if time.Now().UnixNano() < s.downUntil.Load() {
+		return RateLimitResult{}, errStoreUnavailable
+	}
+
+	result, err := s.take(ctx, key, limit)
+	if err != nil && redisUnreachable(ctx, err) {
+		s.downUntil.Store(time.Now().Add(redisRetryInterval).UnixNano())
+	}
+
+	return result, err
+}
+
+// redisUnreachable reports whether err means the server can't be reached or
+// doesn't answer in time. A request that went away or an error reply says
+// nothing about the server's health.
+func redisUnreachable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, limit RateLimitOverride) (RateLimitResult, error) {
+	now := time.Now()
+	window := limit.Window
+	index := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() - index*int64(window))
+
+	// The limit is part of the key, so a changed limit starts over instead
+	// of being applied to counts made under the old one.
+	base := fmt.Sprintf("%s%d/%d:%s:", s.prefix, limit.Requests, window.Milliseconds(), key)
+	current := base + strconv.FormatInt(index, 10)
+	previous := base + strconv.FormatInt(index-1, 10)
+
+	overlap := 1 - float64(elapsed)/float64(window)
+
+	ttl := 2 * window
+	args := []string{
+		"2", current, previous,
+		strconv.FormatFloat(overlap, 'f', -1, 64),
+		strconv.Itoa(limit.Requests),
+		strconv.FormatInt(ttl.Milliseconds(), 10),
+	}
+
+	// The script is only sent when the server doesn't have it cached yet,
+	// e.g. after a restart. EVAL caches it again.
+	reply, err := s.client.Do(ctx, append([]string{"EVALSHA", redisTakeSHA}, args...)...)
+	if replyErr, ok := err.(resp.Error); ok && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		reply, err = s.client.Do(ctx, append([]string{"EVAL", redisTakeScript}, args...)...)
+	}
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	values, _ := reply.([]any)
+	if len(values) != 3 {
+		return RateLimitResult{}, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	allowed, _ := values[0].(int64)
+	currentCount, _ := values[1].(int64)
+	previousCount, _ := values[2].(int64)
+
+	requests := float64(limit.Requests)
+
+	result := RateLimitResult{
+		Allowed: allowed == 1,
+		Limit:   limit.Requests,
+		Reset:   window - elapsed,
+	}
+
+	if result.Allowed {
+		weighted := float64(previousCount)*overlap + float64(currentCount)
+		result.Remaining = max(int(math.Floor(requests-weighted)), 0)
+		return result, nil
+	}
+
+	result.RetryAfter = slidingRetryAfter(float64(previousCount), float64(currentCount), requests, elapsed, window)
+
+	return result, nil
+}
+
+// slidingRetryAfter returns how long until one more request fits into the
+// sliding window, as the previous window's weight decreases.
+func slidingRetryAfter(previous, current, requests float64, elapsed, window time.Duration) time.Duration {
+	// Within the current window: previous*(1-f) + current + 1 <= requests.
+	if current+1 <= requests && previous > 0 {
+		f := 1 - (requests-current-1)/previous
+		return time.Duration(f*float64(window)) - elapsed
+	}
+
+	// In the next window, the current count becomes the previous one.
+	wait := window - elapsed
+	if current > 0 && requests >= 1 {
+		wait += time.Duration(max(1-(requests-1)/current, 0) * float64(window))
+	}
+
+	return wait
+}
@@ -0,0 +1,331 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking RESP2. It knows the commands the
+// client sends when connecting and runs redisTakeScript natively, by EVAL and,
+// once EVAL cached it, by EVALSHA; commands are executed one at a time, like
+// Redis does.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]string
+	commands []string
+	cached   bool   // whether redisTakeScript is in the script cache
+	fail     string // error reply to every EVAL and EVALSHA, if set
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeRedis{
+		ln:       ln,
+		password: password,
+		counters: make(map[string]int64),
+		ttls:     make(map[string]string),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := s.password == ""
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args[0])
+
+		switch {
+		case args[0] == "AUTH":
+			authed = len(args) == 2 && args[1] == s.password
+			if authed {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			w.WriteString("+OK\r\n")
+		case (args[0] == "EVAL" || args[0] == "EVALSHA") && s.fail != "":
+			w.WriteString("-" + s.fail + "\r\n")
+		case args[0] == "EVAL" && len(args) == 8 && args[1] == redisTakeScript:
+			s.cached = true
+			s.take(w, args[3:5], args[5:])
+		case args[0] == "EVALSHA" && len(args) == 8 && args[1] == redisTakeSHA:
+			if !s.cached {
+				w.WriteString("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+				break
+			}
+			s.take(w, args[3:5], args[5:])
+		default:
+			fmt.Fprintf(w, "-ERR unexpected command %q\r\n", args[0])
+		}
+		s.mu.Unlock()
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// take is redisTakeScript.
+func (s *fakeRedis) take(w *bufio.Writer, keys, argv []string) {
+	weight, _ := strconv.ParseFloat(argv[0], 64)
+	limit, _ := strconv.ParseFloat(argv[1], 64)
+
+	current, previous := s.counters[keys[0]], s.counters[keys[1]]
+
+	allowed := 0
+	if float64(previous)*weight+float64(current)+1 <= limit {
+		allowed = 1
+		current++
+		s.counters[keys[0]] = current
+		s.ttls[keys[0]] = argv[2]
+	}
+
+	fmt.Fprintf(w, "*3\r\n:%d\r\n:%d\r\n:%d\r\n", allowed, current, previous)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func (s *fakeRedis) store(password string, db int) RateLimitStore {
+	return NewRedisRateLimitStore(&RedisStoreConfig{
+		Address:  s.ln.Addr().String(),
+		Password: password,
+		DB:       db,
+		Timeout:  time.Second,
+		Prefix:   "rp:",
+	})
+}
+
+func (s *fakeRedis) commandCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, cmd := range s.commands {
+		if cmd == name {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	store := s.store("secret", 2)
+	limit := RateLimitOverride{Requests: 3, Window: time.Hour}
+
+	for i := range 3 {
+		result, err := store.Take(context.Background(), "ip=1.2.3.4", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed {
+			t.Fatalf("request %d was denied", i)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("request %d: remaining %d, want %d", i, result.Remaining, 2-i)
+		}
+	}
+
+	// Denied requests are not counted.
+	for range 2 {
+		result, err := store.Take(context.Background(), "ip=1.2.3.4", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed {
+			t.Fatal("a request over the limit was allowed")
+		}
+		if result.RetryAfter <= 0 {
+			t.Errorf("retry after %s", result.RetryAfter)
+		}
+	}
+
+	// The script is sent once, later requests refer to it by its hash.
+	if evals, shas := s.commandCount("EVAL"), s.commandCount("EVALSHA"); evals != 1 || shas != 5 {
+		t.Errorf("got %d EVAL and %d EVALSHA commands, want 1 and 5", evals, shas)
+	}
+
+	// After a server restart the script is sent again.
+	s.mu.Lock()
+	s.cached = false
+	s.mu.Unlock()
+
+	if _, err := store.Take(context.Background(), "ip=1.2.3.4", limit); err != nil {
+		t.Fatal(err)
+	}
+	if evals := s.commandCount("EVAL"); evals != 2 {
+		t.Errorf("got %d EVAL commands after the script cache was flushed, want 2", evals)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, count := range s.counters {
+		if count != 3 {
+			t.Errorf("%s: count %d, want 3", key, count)
+		}
+		if ttl := s.ttls[key]; ttl != strconv.FormatInt((2*time.Hour).Milliseconds(), 10) {
+			t.Errorf("%s: ttl %s", key, ttl)
+		}
+	}
+	if len(s.counters) != 1 {
+		t.Errorf("got %d counters, want 1", len(s.counters))
+	}
+}
+
+func TestRedisStoreConcurrentTake(t *testing.T) {
+	s := newFakeRedis(t, "")
+	store := s.store("", 0)
+	limit := RateLimitOverride{Requests: 10, Window: time.Hour}
+
+	const requests = 50
+
+	var wg sync.WaitGroup
+	allowed := make([]bool, requests)
+	errs := make([]error, requests)
+
+	for i := range requests {
+		wg.Go(func() {
+			result, err := store.Take(context.Background(), "ip=1.2.3.4", limit)
+			allowed[i], errs[i] = result.Allowed, err
+		})
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for _, ok := range allowed {
+		if ok {
+			n++
+		}
+	}
+	if n != limit.Requests {
+		t.Errorf("%d requests allowed, want %d", n, limit.Requests)
+	}
+	if shas := s.commandCount("EVALSHA"); shas != requests {
+		t.Errorf("got %d EVALSHA commands, want one per request", shas)
+	}
+}
+
+func TestRedisStoreErrorReply(t *testing.T) {
+	s := newFakeRedis(t, "")
+	s.fail = "BUSY Redis is busy running a script"
+	store := s.store("", 0)
+	limit := RateLimitOverride{Requests: 1, Window: time.Minute}
+
+	// The server answers, so the store keeps asking it.
+	for range 2 {
+		if _, err := store.Take(context.Background(), "ip=1.2.3.4", limit); err == nil || err.Error() != s.fail {
+			t.Fatalf("got %v, want the error reply", err)
+		}
+	}
+	if shas := s.commandCount("EVALSHA"); shas != 2 {
+		t.Errorf("got %d EVALSHA commands, want 2", shas)
+	}
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	s := newFakeRedis(t, "")
+	store := s.store("", 0)
+	limit := RateLimitOverride{Requests: 1, Window: time.Minute}
+
+	// A canceled request doesn't mark the server as down.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.Take(ctx, "ip=1.2.3.4", limit); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	s.ln.Close()
+
+	if _, err := store.Take(context.Background(), "ip=1.2.3.4", limit); err == nil || errors.Is(err, errStoreUnavailable) {
+		t.Fatalf("got %v, want the connection error", err)
+	}
+
+	// The store fails fast until the retry interval has passed.
+	if _, err := store.Take(context.Background(), "ip=1.2.3.4", limit); !errors.Is(err, errStoreUnavailable) {
+		t.Fatalf("got %v, want errStoreUnavailable", err)
+	}
+}
+
+func TestRedisStoreWrongPassword(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	store := s.store("wrong", 0)
+
+	_, err := store.Take(context.Background(), "ip=1.2.3.4", RateLimitOverride{Requests: 1, Window: time.Minute})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if shas := s.commandCount("EVALSHA"); shas != 0 {
+		t.Errorf("got %d EVALSHA commands on an unauthenticated connection", shas)
+	}
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RewriteRule describes a single regex based URL transformation. It is shared by
+// the Rewrite and Redirect middlewares.
+type RewriteRule struct {
+	// Match is the regular expression applied to the request. Rewrite matches it
+	// against the escaped request path, Redirect against the full URL without the
+	// query string (e.g. "http://example.com/path").
+	Match *regexp.Regexp
+
+	// Replacement is the expansion template for the matched value. Capture groups
+	// are referenced as $1, $2 or ${name}.
+	// Example: Match = "^/v1/(.*)", Replacement = "/api/$1"
+	Replacement string
+
+	// Hosts restricts the rule to requests for one of the listed hosts.
+	// An empty list matches any host.
+	Hosts []string
+
+	// Schemes restricts the rule to requests received over one of the listed
+	// schemes ("http" or "https"). An empty list matches any scheme.
+	Schemes []string
+
+	// StatusCode is the redirect status code (301, 302, 307 or 308).
+	// It is used only by the Redirect middleware.
+	StatusCode int
+
+	// PreserveQuery appends the original query string to the redirect location.
+	// It is used only by the Redirect middleware.
+	PreserveQuery bool
+}
+
+// RewriteConfig holds the ordered list of rules for the Rewrite and Redirect middlewares.
+// Rules are evaluated in order and the first matching rule wins.
+type RewriteConfig struct {
+	Rules []*RewriteRule
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-Proto
+	// header is believed when matching schemes.
+	TrustedProxies []netip.Prefix
+}
+
+type rewriteMiddleware struct {
+	cfg *RewriteConfig
+}
+
+// Rewrite returns a middleware that rewrites the request path before it is passed
+// to the next handler, so the backend receives the transformed path while the
+// client URL stays untouched.
+//
+// The rule is matched against the escaped path, so percent-encoded characters
+// (e.g. %2F) survive the rewrite. The query string is always preserved.
+func Rewrite(cfg *RewriteConfig) Middleware {
+	return &rewriteMiddleware{cfg: cfg}
+}
+
+func (mw *rewriteMiddleware) Type() Type {
+	return TypeRewrite
+}
+
+func (mw *rewriteMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escapedPath := r.URL.EscapedPath()
+
+		for _, rule := range mw.cfg.Rules {
+			if !rule.matchConditions(r, mw.cfg.TrustedProxies) || !rule.Match.MatchString(escapedPath) {
+				continue
+			}
+
+			rewritten := rule.Match.ReplaceAllString(escapedPath, rule.Replacement)
+			if !strings.HasPrefix(rewritten, "/") {
+				rewritten = "/" + rewritten
+			}
+
+			decoded, err := url.PathUnescape(rewritten)
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+
+			// The URL is shared with the outer handlers, e.g. the access log,
+			// which must still see the path the client sent.
+			u := *r.URL
+			u.Path, u.RawPath = decoded, rewritten
+
+			rewrittenReq := new(http.Request)
+			*rewrittenReq = *r
+			rewrittenReq.URL = &u
+			r = rewrittenReq
+			break
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rule *RewriteRule) matchConditions(r *http.Request, trusted []netip.Prefix) bool {
+	if len(rule.Hosts) > 0 {
+		host := requestHost(r)
+		if !slices.ContainsFunc(rule.Hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			return false
+		}
+	}
+
+	if len(rule.Schemes) > 0 && !slices.Contains(rule.Schemes, requestScheme(r, trusted)) {
+		return false
+	}
+
+	return true
+}
+
+// requestScheme reports the scheme the client used. X-Forwarded-Proto is honoured
+// on connections from trusted proxies only, so redirects keep working behind a
+// TLS terminating load balancer while clients can't claim a scheme themselves.
+func requestScheme(r *http.Request, trusted []netip.Prefix) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && fromTrustedProxy(r, trusted) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// requestHost returns the lower-cased request host without the port.
+func requestHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+
+	if idx := strings.LastIndex(host, ":"); idx != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:idx]
+	}
+
+	return host
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	mw := Rewrite(&RewriteConfig{Rules: []*RewriteRule{
+		{Match: regexp.MustCompile(`^/v1/(?P<rest>.*)`), Replacement: "/api/${rest}", Hosts: []string{"api.example.com"}},
+		{Match: regexp.MustCompile(`^/old/([^/]+)/(.*)`), Replacement: "/new/$2/$1"},
+		{Match: regexp.MustCompile(`^/secure/(.*)`), Replacement: "/tls/$1", Schemes: []string{"https"}},
+	}})
+
+	tests := []struct {
+		name    string
+		host    string
+		target  string
+		path    string
+		escaped string
+		query   string
+	}{
+		{name: "named capture", host: "api.example.com", target: "/v1/users?page=2", path: "/api/users", query: "page=2"},
+		{name: "other host", host: "www.example.com", target: "/v1/users", path: "/v1/users"},
+		{name: "numbered captures", host: "example.com", target: "/old/a/b/c", path: "/new/b/c/a"},
+		{name: "escaped slash", host: "example.com", target: "/old/a%2Fb/c", path: "/new/c/a/b", escaped: "/new/c/a%2Fb"},
+		{name: "scheme mismatch", host: "example.com", target: "/secure/x", path: "/secure/x"},
+		{name: "no match", host: "example.com", target: "/other", path: "/other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = r
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			original := req.URL.String()
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			escaped := tt.escaped
+			if escaped == "" {
+				escaped = tt.path
+			}
+			if forwarded.URL.Path != tt.path || forwarded.URL.EscapedPath() != escaped {
+				t.Errorf("path %q (escaped %q), want %q (escaped %q)", forwarded.URL.Path, forwarded.URL.EscapedPath(), tt.path, escaped)
+			}
+			if forwarded.URL.RawQuery != tt.query {
+				t.Errorf("query %q, want %q", forwarded.URL.RawQuery, tt.query)
+			}
+
+			// The outer handlers, e.g. the access log, still see the client's URL.
+			if req.URL.String() != original {
+				t.Errorf("the request URL was changed to %s", req.URL)
+			}
+		})
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	mw := Redirect(&RewriteConfig{
+		Rules: []*RewriteRule{
+			{Match: regexp.MustCompile(`^http://(.*)`), Replacement: "https://$1", StatusCode: http.StatusPermanentRedirect, PreserveQuery: true},
+			{Match: regexp.MustCompile(`^(https?)://example\.com/(.*)`), Replacement: "$1://www.example.com/$2", StatusCode: http.StatusMovedPermanently},
+			// Produces the same URL and must be skipped.
+			{Match: regexp.MustCompile(`^(https://www\.example\.com/.*)`), Replacement: "$1", StatusCode: http.StatusFound},
+		},
+		TrustedProxies: trusted,
+	})
+
+	tests := []struct {
+		name     string
+		remote   string
+		proto    string
+		target   string
+		status   int
+		location string
+	}{
+		{name: "http to https", remote: "203.0.113.7:4000", target: "http://example.com/docs?q=1", status: http.StatusPermanentRedirect, location: "https://example.com/docs?q=1"},
+		{name: "untrusted forwarded proto", remote: "203.0.113.7:4000", proto: "https", target: "http://www.example.com/", status: http.StatusPermanentRedirect, location: "https://www.example.com/"},
+		{name: "trusted forwarded proto", remote: "10.0.0.2:4000", proto: "https", target: "http://example.com/docs", status: http.StatusMovedPermanently, location: "https://www.example.com/docs"},
+		{name: "no loop", remote: "10.0.0.2:4000", proto: "https", target: "http://www.example.com/docs", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if location := w.Header().Get("Location"); location != tt.location {
+				t.Errorf("location %q, want %q", location, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+// ttlCache is an LRU cache of at most size entries that expire ttl after
+// they were added or, if sliding is set, last used. Expired entries are
+// dropped when they are looked up or pushed out by new ones; unlike the
+// expirable LRU of golang-lru there is no cleanup goroutine, which would
+// outlive the middleware after a config reload replaced it.
+type ttlCache[K comparable, V any] struct {
+	ttl     time.Duration
+	sliding bool
+
+	mu  sync.Mutex
+	lru *simplelru.LRU[K, *ttlEntry[V]]
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[K comparable, V any](size int, ttl time.Duration, sliding bool) *ttlCache[K, V] {
+	// NewLRU only fails for a size below 1.
+	lru, _ := simplelru.NewLRU[K, *ttlEntry[V]](max(size, 1), nil)
+
+	return &ttlCache[K, V]{ttl: ttl, sliding: sliding, lru: lru}
+}
+
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lru.Get(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	now := time.Now()
+	if now.After(entry.expires) {
+		c.lru.Remove(key)
+
+		var zero V
+		return zero, false
+	}
+
+	if c.sliding {
+		entry.expires = now.Add(c.ttl)
+	}
+
+	return entry.value, true
+}
+
+func (c *ttlCache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Add(key, &ttlEntry[V]{value: value, expires: time.Now().Add(c.ttl)})
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+
+	fixed := newTTLCache[string, int](2, ttl, false)
+	sliding := newTTLCache[string, int](2, ttl, true)
+
+	for _, c := range []*ttlCache[string, int]{fixed, sliding} {
+		c.Add("a", 1)
+	}
+
+	// Half the lifetime in, the entries are used; only the sliding one is
+	// extended by it.
+	time.Sleep(ttl / 2)
+	for _, c := range []*ttlCache[string, int]{fixed, sliding} {
+		if v, ok := c.Get("a"); !ok || v != 1 {
+			t.Fatalf("got %d, %t before the entry expired", v, ok)
+		}
+	}
+
+	time.Sleep(ttl/2 + ttl/5)
+	if _, ok := fixed.Get("a"); ok {
+		t.Error("an expired entry was returned")
+	}
+	if _, ok := sliding.Get("a"); !ok {
+		t.Error("a recently used entry expired")
+	}
+
+	// The least recently used entry is evicted at the size limit.
+	sliding.Add("b", 2)
+	sliding.Get("a")
+	sliding.Add("c", 3)
+	if _, ok := sliding.Get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+}
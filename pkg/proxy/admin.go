@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+// adminServer is the separate listener for operational endpoints, so they are
+// never reachable through the public proxy listener.
+type adminServer struct {
+	server *http.Server
+	mux    *http.ServeMux
+}
+
+func newAdminServer(cfg *proxyCfg.AdminConfig) *adminServer {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.MetricsPath, metrics.Default.Handler())
+
+	return &adminServer{
+		server: &http.Server{
+			Addr:    cfg.Listen,
+			Handler: mux,
+		},
+		mux: mux,
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+const defaultBufferSize = 32 * 1024
+
+// bufferPool hands out fixed-size byte slices used to copy response bodies,
+// so streaming a body does not allocate a fresh buffer per request.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// copyBuffered copies src to dst through a pooled buffer. Backend bodies are
+// never files, so the io.ReaderFrom of the net/http response writer has no
+// zero-copy path for them and would only copy through its own buffer instead
+// of one of buffer_size.
+func (p *bufferPool) copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.get()
+	defer p.put(buf)
+
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, *buf)
+}
+
+// onlyReader hides an optional io.WriterTo implementation of the wrapped
+// reader, so io.CopyBuffer really uses the provided buffer.
+type onlyReader struct {
+	io.Reader
+}
+
+// onlyWriter does the same for an io.ReaderFrom implementation of the writer.
+type onlyWriter struct {
+	io.Writer
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
+)
+
+// responseWriter records the size of the largest write. Like the net/http
+// response writer it implements io.ReaderFrom, which copyBuffered must not use.
+type responseWriter struct {
+	http.ResponseWriter
+	t        *testing.T
+	maxWrite int
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.maxWrite = max(w.maxWrite, len(b))
+	return len(b), nil
+}
+
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.t.Error("the body was copied with ReadFrom")
+	return io.Copy(io.Discard, src)
+}
+
+func TestCopyBufferedUsesPool(t *testing.T) {
+	const size = 4 << 10
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<12) // 64KB
+	w := &responseWriter{ResponseWriter: httptest.NewRecorder(), t: t}
+
+	// The response writer as the proxy sees it, wrapped for the access log
+	// and the metrics.
+	dst := &statusWriter{ResponseWriter: &accesslog.ResponseWriter{ResponseWriter: w}}
+
+	n, err := newBufferPool(size).copyBuffered(dst, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(body)) {
+		t.Errorf("copied %d bytes, want %d", n, len(body))
+	}
+	if w.maxWrite != size {
+		t.Errorf("largest write %d bytes, want the buffer size %d", w.maxWrite, size)
+	}
+}
+
+// BenchmarkCopyBuffered copies large bodies with the pooled buffers and with
+// a freshly allocated buffer per copy, which is what io.Copy does. gc/op is
+// the number of garbage collections per copy.
+func BenchmarkCopyBuffered(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<20) // 16MB
+
+	benchmarks := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{name: "pooled", copy: newBufferPool(defaultBufferSize).copyBuffered},
+		{name: "unpooled", copy: func(dst io.Writer, src io.Reader) (int64, error) {
+			return io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, make([]byte, defaultBufferSize))
+		}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			defer reportGC(b)()
+
+			for b.Loop() {
+				if _, err := bm.copy(io.Discard, bytes.NewReader(body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// reportGC returns a function that reports the garbage collections since
+// reportGC was called as the gc/op metric.
+func reportGC(b *testing.B) func() {
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+
+		b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+	}
+}
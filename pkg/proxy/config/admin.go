@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+type AdminConfig struct {
+	Listen      string
+	MetricsPath string
+}
+
+func (c *AdminConfig) validate() error {
+	if c != nil {
+		if c.Listen == "" {
+			return fmt.Errorf("listen is required")
+		}
+		if !strings.HasPrefix(c.MetricsPath, "/") {
+			return fmt.Errorf("metrics_path must start with /")
+		}
+	}
+
+	return nil
+}
@@ -6,8 +6,11 @@ import (
 
 type Config struct {
 	Server    *ServerConfig
+	Listeners []*ListenerConfig // If empty, a single listener on Server.Listen is used.
 	Log       *LogConfig
 	AccessLog *AccessLogConfig
+	Admin     *AdminConfig
+	Tracing   *TracingConfig
 }
 
 func (c *Config) Validate() error {
@@ -15,6 +18,22 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("failed to validate server config: %w", err)
 	}
 
+	if len(c.Listeners) == 0 && c.Server.Listen == "" {
+		return fmt.Errorf("failed to validate server config: listen is required")
+	}
+
+	addrs := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("failed to validate listener %s: %w", l.Name, err)
+		}
+
+		if addrs[l.Listen] {
+			return fmt.Errorf("duplicate listener address: %s", l.Listen)
+		}
+		addrs[l.Listen] = true
+	}
+
 	if err := c.Log.validate(); err != nil {
 		return fmt.Errorf("failed to validate log config: %w", err)
 	}
@@ -23,5 +42,13 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("failed to validate access_log config: %w", err)
 	}
 
+	if err := c.Admin.validate(); err != nil {
+		return fmt.Errorf("failed to validate admin config: %w", err)
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return fmt.Errorf("failed to validate tracing config: %w", err)
+	}
+
 	return nil
 }
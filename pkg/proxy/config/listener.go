@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// ListenerConfig is an entrypoint of the proxy. Zero timeouts inherit the
+// values of ServerConfig.
+type ListenerConfig struct {
+	Name         string
+	Listen       string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	TLS          *TLSConfig
+	Routes       []string // Route hosts served by the listener. Empty serves all routes.
+}
+
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion string // "1.2" or "1.3"
+}
+
+func (c *ListenerConfig) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if c.ReadTimeout < 0 {
+		return fmt.Errorf("read_timeout can't be negative")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write_timeout can't be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle_timeout can't be negative")
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("failed to validate tls config: %w", err)
+	}
+
+	return nil
+}
+
+func (c *TLSConfig) validate() error {
+	if c != nil {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("cert_file and key_file are required")
+		}
+
+		switch c.MinVersion {
+		case "", "1.2", "1.3":
+		default:
+			return fmt.Errorf("unsupported min_version %q, must be 1.2 or 1.3", c.MinVersion)
+		}
+	}
+
+	return nil
+}
@@ -6,19 +6,18 @@ import (
 )
 
 type ServerConfig struct {
-	Listen          string
+	Listen          string // Address of the default listener, used when Config.Listeners is empty.
 	ReadTimeout     time.Duration
 	WriteTimeout    time.Duration
 	IdleTimeout     time.Duration
 	ShutdownTimeout time.Duration
 	MaxHeaderBytes  int64
 	MaxRequestBody  int64
+	BufferSize      int64  // Size of the pooled buffers used to copy response bodies.
+	Via             string // Pseudonym added to the Via header. Empty disables the header.
 }
 
 func (c *ServerConfig) validate() error {
-	if c.Listen == "" {
-		return fmt.Errorf("listen is required")
-	}
 	if c.ReadTimeout < 0 {
 		return fmt.Errorf("read_timeout can't be negative")
 	}
@@ -31,6 +30,9 @@ func (c *ServerConfig) validate() error {
 	if c.ShutdownTimeout < 0 {
 		return fmt.Errorf("shutdown_timeout can't be negative")
 	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("buffer_size can't be negative")
+	}
 
 	return nil
 }
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/tracing"
+)
+
+type TracingConfig struct {
+	ServiceName   string
+	Endpoint      string
+	Headers       map[string]string
+	SampleRatio   float64
+	Propagators   []string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+func (c *TracingConfig) validate() error {
+	if c != nil {
+		if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+			return fmt.Errorf("invalid endpoint: %s", c.Endpoint)
+		}
+		if c.SampleRatio < 0 || c.SampleRatio > 1 {
+			return fmt.Errorf("sample_ratio must be between 0 and 1")
+		}
+		if len(c.Propagators) == 0 {
+			return fmt.Errorf("at least one propagator is required")
+		}
+		for _, p := range c.Propagators {
+			if !isValidPropagator(p) {
+				return fmt.Errorf("invalid propagator: %s (must be tracecontext or b3)", p)
+			}
+		}
+		if c.BatchSize <= 0 {
+			return fmt.Errorf("batch_size must be greater then 0")
+		}
+		if c.FlushInterval <= 0 {
+			return fmt.Errorf("flush_interval must be greater then 0")
+		}
+		if c.Timeout < 0 {
+			return fmt.Errorf("timeout can't be negative")
+		}
+	}
+
+	return nil
+}
+
+func isValidPropagator(p string) bool {
+	propagators := []string{tracing.PropagatorTraceContext, tracing.PropagatorB3}
+	return slices.Contains(propagators, p)
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+)
+
+// Explanation describes how the proxy handles a request, see Explain.
+type Explanation struct {
+	// Route is the host pattern of the matched route, empty if no route matched.
+	Route   string
+	Backend string
+
+	// Middlewares is the chain after merging global and route middlewares,
+	// outermost first.
+	Middlewares []middleware.Type
+
+	// Skipped are the middlewares of the chain that were not evaluated, see
+	// middleware.Skipped.
+	Skipped []middleware.Type
+
+	// StoppedBy is the middleware that answered the request itself, with the
+	// status and headers of its response. It is empty if the request reached
+	// the backend.
+	StoppedBy middleware.Type
+	Status    int
+	Header    http.Header
+
+	// Upstream is the request that would be sent to the backend.
+	Upstream *http.Request
+}
+
+// Explain runs the request through the middlewares of the matching route and
+// reports what would be sent to the backend, without contacting it. If
+// listener is set, only the routes served by the listener with this name are
+// considered. Middlewares run for real; build stateful ones such as
+// rate_limit as middleware.Skipped to explain without side effects.
+func (p *Proxy) Explain(r *http.Request, listener string) (*Explanation, error) {
+	var allowed map[string]bool
+
+	if listener != "" {
+		var found bool
+		for _, l := range p.listeners {
+			if l.cfg.Name == listener {
+				allowed, found = l.allowedRoutes(), true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown listener: %s", listener)
+		}
+	}
+
+	rt, ok := p.router.lookup(r.Host, allowed)
+	if !ok {
+		return &Explanation{Status: http.StatusNotFound}, nil
+	}
+
+	exp := &Explanation{
+		Route:       rt.host,
+		Backend:     rt.backend.String(),
+		Middlewares: rt.chain,
+	}
+
+	for _, mw := range rt.merged {
+		if _, ok := mw.(*middleware.Skipped); ok {
+			exp.Skipped = append(exp.Skipped, mw.Type())
+		}
+	}
+
+	var backendErr error
+	reached := false
+	terminal := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		reached = true
+		exp.Upstream, backendErr = rt.newBackendRequest(r)
+	})
+
+	// depth is the index of the middleware that is currently handling the
+	// request; if the backend is never reached, it is the one that stopped it.
+	depth := 0
+	handler := http.Handler(terminal)
+	for i := len(rt.merged) - 1; i >= 0; i-- {
+		next := handler
+		handler = rt.merged[i].Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			depth = i + 1
+			next.ServeHTTP(w, r)
+		}))
+	}
+
+	rec := &explainRecorder{header: make(http.Header)}
+	handler.ServeHTTP(rec, r)
+
+	if backendErr != nil {
+		return nil, fmt.Errorf("failed to create backend request: %w", backendErr)
+	}
+
+	if !reached {
+		exp.StoppedBy = rt.merged[depth].Type()
+		exp.Status = rec.status
+		if exp.Status == 0 {
+			exp.Status = http.StatusOK
+		}
+		exp.Header = rec.header
+	}
+
+	return exp, nil
+}
+
+// explainRecorder captures the response of a middleware that answers the
+// request itself and discards the body.
+type explainRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *explainRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *explainRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *explainRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
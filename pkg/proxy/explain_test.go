@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+func TestExplain(t *testing.T) {
+	p := New(&proxyCfg.Config{
+		Server: &proxyCfg.ServerConfig{},
+		Listeners: []*proxyCfg.ListenerConfig{
+			{Name: "public", Routes: []string{"api.example.com"}},
+		},
+	})
+
+	global := []middleware.Middleware{
+		&middleware.Skipped{T: middleware.TypeRateLimit},
+		middleware.Headers(&middleware.HeadersConfig{Request: &middleware.HeaderRules{Set: map[string]string{"X-Global": "1"}}}),
+	}
+
+	err := p.Reload(global, []RouteDefinition{
+		{
+			Host:    "api.example.com",
+			Backend: "http://10.0.0.1:8080/base",
+			Options: []RouteOption{
+				WithStripPrefix("/api"),
+				WithMiddlewares(middleware.Rewrite(&middleware.RewriteConfig{Rules: []*middleware.RewriteRule{
+					// Middlewares see the path before strip_prefix.
+					{Match: regexp.MustCompile(`^/api/v1/(.*)`), Replacement: "/api/v2/$1"},
+				}})),
+			},
+		},
+		{
+			Host:    "old.example.com",
+			Backend: "http://10.0.0.2:8080",
+			Options: []RouteOption{
+				WithMiddlewares(middleware.Redirect(&middleware.RewriteConfig{Rules: []*middleware.RewriteRule{
+					{Match: regexp.MustCompile(`^http://old\.example\.com/(.*)`), Replacement: "https://new.example.com/$1", StatusCode: http.StatusMovedPermanently},
+				}})),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	explain := func(t *testing.T, host, target, listener string) *Explanation {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = host
+
+		exp, err := p.Explain(req, listener)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return exp
+	}
+
+	t.Run("reaches backend", func(t *testing.T) {
+		exp := explain(t, "api.example.com", "/api/v1/users?page=2", "")
+
+		if exp.Route != "api.example.com" || exp.Backend != "http://10.0.0.1:8080/base" {
+			t.Errorf("route %s, backend %s", exp.Route, exp.Backend)
+		}
+
+		chain := []middleware.Type{middleware.TypeRateLimit, middleware.TypeHeaders, middleware.TypeRewrite}
+		if !slices.Equal(exp.Middlewares, chain) {
+			t.Errorf("middlewares %v, want %v", exp.Middlewares, chain)
+		}
+		if !slices.Equal(exp.Skipped, []middleware.Type{middleware.TypeRateLimit}) {
+			t.Errorf("skipped %v", exp.Skipped)
+		}
+		if exp.StoppedBy != "" {
+			t.Errorf("stopped by %s", exp.StoppedBy)
+		}
+
+		if exp.Upstream == nil {
+			t.Fatal("no upstream request")
+		}
+		if got := exp.Upstream.URL.String(); got != "http://10.0.0.1:8080/base/v2/users?page=2" {
+			t.Errorf("upstream URL %s", got)
+		}
+		if exp.Upstream.Header.Get("X-Global") != "1" {
+			t.Error("the global headers middleware didn't run")
+		}
+	})
+
+	t.Run("stopped by middleware", func(t *testing.T) {
+		exp := explain(t, "old.example.com", "/page", "")
+
+		if exp.StoppedBy != middleware.TypeRedirect || exp.Status != http.StatusMovedPermanently {
+			t.Errorf("stopped by %q with %d", exp.StoppedBy, exp.Status)
+		}
+		if loc := exp.Header.Get("Location"); loc != "https://new.example.com/page" {
+			t.Errorf("Location %q", loc)
+		}
+		if exp.Upstream != nil {
+			t.Error("the request reached the backend")
+		}
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		if exp := explain(t, "old.example.com", "/page", "public"); exp.Route != "" || exp.Status != http.StatusNotFound {
+			t.Errorf("route %q, status %d for a route the listener doesn't serve", exp.Route, exp.Status)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if _, err := p.Explain(req, "missing"); err == nil {
+			t.Error("no error for an unknown listener")
+		}
+	})
+}
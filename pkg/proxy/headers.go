@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/haadi-coder/reverse-proxy/internal/lib/hopheader"
+)
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// prepareRequestHeaders copies the client headers into the backend request,
+// dropping hop-by-hop headers. "TE: trailers" is kept because it signals that
+// the client is able to receive trailers, which gRPC backends rely on.
+func prepareRequestHeaders(dst, src http.Header) {
+	copyHeader(dst, src)
+	hopheader.Remove(dst)
+
+	if headerContainsToken(src["Te"], "trailers") {
+		dst.Set("Te", "trailers")
+	}
+}
+
+// addVia appends this proxy to the Via header as described in RFC 9110 section 7.6.3.
+func addVia(h http.Header, protoMajor, protoMinor int, pseudonym string) {
+	if pseudonym == "" {
+		return
+	}
+
+	h.Add("Via", fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, pseudonym))
+}
+
+// announceTrailers declares the backend trailers in the response Trailer header,
+// so they can be sent after the body. It must be called before WriteHeader.
+func announceTrailers(w http.ResponseWriter, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+
+	return len(keys)
+}
+
+// copyTrailers writes the backend trailers once the body has been copied.
+// Trailers that were not announced upfront are sent using http.TrailerPrefix.
+func copyTrailers(w http.ResponseWriter, resp *http.Response, announced int) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+
+	if len(resp.Trailer) == announced {
+		copyHeader(w.Header(), resp.Trailer)
+		return
+	}
+
+	for k, vv := range resp.Trailer {
+		k = http.TrailerPrefix + k
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+// headerContainsToken reports whether any of the comma-separated header values
+// contains the token, ignoring case and parameters (e.g. "trailers;q=1").
+func headerContainsToken(values []string, token string) bool {
+	for _, v := range values {
+		for part := range strings.SplitSeq(v, ",") {
+			part, _, _ = strings.Cut(part, ";")
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+const testHost = "example.com"
+
+// newTestProxy starts a proxy with a single route for testHost to the
+// backend and returns its URL.
+func newTestProxy(tb testing.TB, backend http.Handler, via string) string {
+	tb.Helper()
+
+	upstream := httptest.NewServer(backend)
+	tb.Cleanup(upstream.Close)
+
+	p := New(&proxyCfg.Config{
+		Server: &proxyCfg.ServerConfig{Via: via},
+	})
+	if err := p.Reload(nil, []RouteDefinition{{Host: testHost, Backend: upstream.URL}}); err != nil {
+		tb.Fatal(err)
+	}
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.serveHTTP(w, r, p.listeners[0])
+	}))
+	tb.Cleanup(front.Close)
+
+	return front.URL
+}
+
+func newTestRequest(tb testing.TB, method, url string, body io.Reader) *http.Request {
+	tb.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	req.Host = testHost
+
+	return req
+}
+
+func TestHopByHopHeadersAreStripped(t *testing.T) {
+	var got http.Header
+	proxyURL := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-End-To-End", "1")
+	}), "")
+
+	req := newTestRequest(t, http.MethodGet, proxyURL, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("X-End-To-End", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Client-Hop", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("backend received hop-by-hop header %s: %q", name, v)
+		}
+	}
+	if got.Get("X-End-To-End") != "1" {
+		t.Errorf("backend did not receive X-End-To-End")
+	}
+
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("client received hop-by-hop header %s: %q", name, v)
+		}
+	}
+	if resp.Header.Get("X-End-To-End") != "1" {
+		t.Errorf("client did not receive X-End-To-End")
+	}
+}
+
+func TestVia(t *testing.T) {
+	tests := []struct {
+		name string
+		via  string
+		want string
+	}{
+		{name: "disabled", via: "", want: ""},
+		{name: "pseudonym", via: "rp", want: "1.1 rp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			proxyURL := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Via")
+			}), tt.via)
+
+			resp, err := http.DefaultClient.Do(newTestRequest(t, http.MethodGet, proxyURL, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if got != tt.want {
+				t.Errorf("request Via = %q, want %q", got, tt.want)
+			}
+			if v := resp.Header.Get("Via"); v != tt.want {
+				t.Errorf("response Via = %q, want %q", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestTE(t *testing.T) {
+	tests := []struct {
+		name string
+		te   string
+		want string
+	}{
+		{name: "trailers", te: "trailers", want: "trailers"},
+		{name: "trailers among codings", te: "gzip, trailers;q=1", want: "trailers"},
+		{name: "codings only", te: "gzip, deflate", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			proxyURL := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Te")
+			}), "")
+
+			req := newTestRequest(t, http.MethodGet, proxyURL, nil)
+			req.Header.Set("TE", tt.te)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if got != tt.want {
+				t.Errorf("backend TE = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	proxyURL := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			// Rejected without reading the body.
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		io.Copy(w, r.Body)
+	}), "")
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+		body   string
+	}{
+		{name: "rejected", auth: "", status: http.StatusUnauthorized, body: "Unauthorized\n"},
+		{name: "accepted", auth: "Bearer token", status: http.StatusOK, body: "payload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(t, http.MethodPost, proxyURL, strings.NewReader("payload"))
+			req.Header.Set("Expect", "100-continue")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	proxyURL := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "body")
+
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	}), "")
+
+	req := newTestRequest(t, http.MethodGet, proxyURL, nil)
+	req.Header.Set("TE", "trailers")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "body" {
+		t.Errorf("body = %q, want %q", body, "body")
+	}
+
+	if v := resp.Trailer.Get("X-Checksum"); v != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want %q", v, "abc")
+	}
+	if v := resp.Trailer.Get("X-Late"); v != "def" {
+		t.Errorf("trailer X-Late = %q, want %q", v, "def")
+	}
+}
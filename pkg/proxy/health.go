@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// unhealthyThreshold is the number of consecutive failed round trips after
+// which a backend is reported as unhealthy.
+const unhealthyThreshold = 3
+
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusUnhealthy = "unhealthy"
+	HealthStatusDraining  = "draining"
+)
+
+// HealthStatus is a snapshot of the passive health of a route backend,
+// derived from the outcome of proxied requests.
+type HealthStatus struct {
+	Status              string     `json:"status"`
+	InFlight            int64      `json:"in_flight"`
+	TotalRequests       uint64     `json:"total_requests"`
+	TotalFailures       uint64     `json:"total_failures"`
+	ConsecutiveFailures uint64     `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+}
+
+// backendHealth tracks request outcomes and the drain state of a route backend.
+type backendHealth struct {
+	draining atomic.Bool
+	inFlight atomic.Int64
+
+	mu                  sync.Mutex
+	totalRequests       uint64
+	totalFailures       uint64
+	consecutiveFailures uint64
+	lastError           string
+	lastErrorAt         time.Time
+}
+
+func (h *backendHealth) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.totalRequests++
+	h.consecutiveFailures = 0
+}
+
+func (h *backendHealth) recordFailure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.totalRequests++
+	h.totalFailures++
+	h.consecutiveFailures++
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+}
+
+func (h *backendHealth) snapshot() HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := HealthStatus{
+		Status:              HealthStatusHealthy,
+		InFlight:            h.inFlight.Load(),
+		TotalRequests:       h.totalRequests,
+		TotalFailures:       h.totalFailures,
+		ConsecutiveFailures: h.consecutiveFailures,
+		LastError:           h.lastError,
+	}
+
+	if !h.lastErrorAt.IsZero() {
+		lastErrorAt := h.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+
+	switch {
+	case h.draining.Load():
+		status.Status = HealthStatusDraining
+	case h.consecutiveFailures >= unhealthyThreshold:
+		status.Status = HealthStatusUnhealthy
+	}
+
+	return status
+}
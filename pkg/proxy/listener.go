@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+// listener is an entrypoint of the proxy with its own server settings. Routes
+// that are not allowed on a listener are not reachable through it at all.
+type listener struct {
+	cfg    *proxyCfg.ListenerConfig
+	server *http.Server
+
+	// routes holds the prepared host patterns served by the listener, nil
+	// allows every route. It is replaced on reload.
+	routes atomic.Pointer[map[string]bool]
+}
+
+func newListener(cfg *proxyCfg.ListenerConfig, server *proxyCfg.ServerConfig) *listener {
+	l := &listener{
+		cfg: cfg,
+		server: &http.Server{
+			Addr:           cfg.Listen,
+			ReadTimeout:    cmp.Or(cfg.ReadTimeout, server.ReadTimeout),
+			WriteTimeout:   cmp.Or(cfg.WriteTimeout, server.WriteTimeout),
+			IdleTimeout:    cmp.Or(cfg.IdleTimeout, server.IdleTimeout),
+			MaxHeaderBytes: int(server.MaxHeaderBytes),
+		},
+	}
+
+	l.setRoutes(cfg.Routes)
+
+	return l
+}
+
+// setRoutes restricts the listener to the route hosts, an empty list allows
+// every route.
+func (l *listener) setRoutes(hosts []string) {
+	var routes map[string]bool
+
+	if len(hosts) > 0 {
+		routes = make(map[string]bool, len(hosts))
+		for _, host := range hosts {
+			routes[prepareHost(host)] = true
+		}
+	}
+
+	l.routes.Store(&routes)
+}
+
+// allowedRoutes returns the prepared host patterns served by the listener, nil
+// allows every route.
+func (l *listener) allowedRoutes() map[string]bool {
+	return *l.routes.Load()
+}
+
+// defaultListener is the single listener of configs that only set Server.Listen.
+func defaultListener(server *proxyCfg.ServerConfig) *proxyCfg.ListenerConfig {
+	return &proxyCfg.ListenerConfig{
+		Name:   "default",
+		Listen: server.Listen,
+	}
+}
+
+// loadTLS loads the certificate of a TLS listener, so a broken certificate is
+// reported before any socket is bound.
+func (l *listener) loadTLS() error {
+	if l.cfg.TLS == nil {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.cfg.TLS.CertFile, l.cfg.TLS.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate of listener %s: %w", l.cfg.Name, err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if l.cfg.TLS.MinVersion == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+
+	l.server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+func TestListenerRoutes(t *testing.T) {
+	backend := func(name string) string {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(upstream.Close)
+
+		return upstream.URL
+	}
+
+	p := New(&proxyCfg.Config{
+		Server: &proxyCfg.ServerConfig{},
+		Listeners: []*proxyCfg.ListenerConfig{
+			{Name: "all"},
+			{Name: "exact", Routes: []string{"API.example.com"}},
+			{Name: "wildcard", Routes: []string{"*.example.com"}},
+		},
+	})
+
+	err := p.Reload(nil, []RouteDefinition{
+		{Host: "api.example.com", Backend: backend("exact")},
+		{Host: "*.example.com", Backend: backend("wildcard")},
+		{Host: "other.test", Backend: backend("other")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		listener int
+		host     string
+		want     string // backend name, empty for 404
+	}{
+		{listener: 0, host: "api.example.com", want: "exact"},
+		{listener: 0, host: "www.example.com", want: "wildcard"},
+		{listener: 0, host: "other.test", want: "other"},
+
+		// Hosts are compared case-insensitively and without the port.
+		{listener: 1, host: "api.example.com:8080", want: "exact"},
+		{listener: 1, host: "www.example.com"},
+		{listener: 1, host: "other.test"},
+
+		// The exact route isn't served by this listener, so the request falls
+		// through to the wildcard route.
+		{listener: 2, host: "api.example.com", want: "wildcard"},
+		{listener: 2, host: "www.example.com", want: "wildcard"},
+		{listener: 2, host: "other.test"},
+	}
+
+	for _, tt := range tests {
+		l := p.listeners[tt.listener]
+
+		t.Run(l.cfg.Name+"/"+tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+
+			w := httptest.NewRecorder()
+			p.serveHTTP(w, req, l)
+
+			if tt.want == "" {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status %d, want 404", w.Code)
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("status %d, body %q, want %s", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	// The routes of a running listener can be replaced, an empty list serves
+	// every route again.
+	if err := p.SetListenerRoutes("exact", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "other.test"
+
+	w := httptest.NewRecorder()
+	p.serveHTTP(w, req, p.listeners[1])
+
+	if w.Body.String() != "other" {
+		t.Errorf("after SetListenerRoutes: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	if err := p.SetListenerRoutes("missing", nil); err == nil {
+		t.Error("no error for an unknown listener")
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
+)
+
+// metricsMiddleware records request count, latency and in-flight requests for a route.
+// It also stores the route in the request context for middleware metrics.
+type metricsMiddleware struct {
+	route   string
+	backend string
+}
+
+func (m *metricsMiddleware) Handler(next http.Handler) http.Handler {
+	inFlight := metrics.RequestsInFlight.WithLabelValues(m.route)
+	duration := metrics.RequestDuration.WithLabelValues(m.route, m.backend)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(metrics.WithRoute(r.Context(), m.route))
+
+		next.ServeHTTP(sw, r)
+
+		duration.Observe(time.Since(start).Seconds())
+		metrics.RequestsTotal.WithLabelValues(m.route, m.backend, metrics.StatusClass(sw.status)).Inc()
+	})
+}
+
+// statusWriter captures the response status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// instrumentDial wraps a dial function to track the upstream connection pool:
+// dial results and the number of currently open connections to the backend.
+func instrumentDial(backend string, dial dialFunc) dialFunc {
+	open := metrics.UpstreamConnectionsOpen.WithLabelValues(backend)
+	succeeded := metrics.UpstreamDials.WithLabelValues(backend, "success")
+	failed := metrics.UpstreamDials.WithLabelValues(backend, "error")
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			failed.Inc()
+			return nil, err
+		}
+
+		succeeded.Inc()
+		open.Inc()
+
+		return &trackedConn{Conn: conn, onClose: open.Dec}, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
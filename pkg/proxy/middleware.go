@@ -30,11 +30,16 @@ func (m *recoveryMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				slog.Error("panic recovered", slog.Any("error", err))
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			}
-			next.ServeHTTP(w, r)
 		}()
+
+		next.ServeHTTP(w, r)
 	})
 }
 
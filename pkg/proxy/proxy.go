@@ -2,95 +2,504 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
 	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
 	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
 	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+	"github.com/haadi-coder/reverse-proxy/pkg/tracing"
 )
 
 type Proxy struct {
-	cfg         *proxyCfg.Config
-	server      *http.Server
-	router      *Router
-	middlewares []middleware.Middleware
+	cfg          *proxyCfg.Config
+	listeners    []*listener
+	router       *Router
+	middlewares  []middleware.Middleware
+	accessLogger *accesslog.AccessLogger
+	bufferPool   *bufferPool
+	admin        *adminServer
+	tracer       *tracing.Tracer
+	listen       ListenFunc
+	notifiers    []Notifier
+
+	watchdogInterval time.Duration
+
+	// serving is set while Run serves requests; reloads before that are part
+	// of the startup and are not reported to notifiers.
+	serving atomic.Bool
+
+	// mu serializes changes of the routing table and global middlewares.
+	mu sync.Mutex
+
+	// routesModified is set when Route or RemoveRoute changed the routing
+	// table after the last Reload. Guarded by mu.
+	routesModified bool
+}
+
+// ListenFunc creates the listener for an address of the proxy. It allows the
+// proxy to serve on sockets that were inherited instead of bound by itself.
+type ListenFunc func(network, addr string) (net.Listener, error)
+
+// Event is a lifecycle change of the proxy reported to notifiers.
+type Event int
+
+const (
+	EventReady     Event = iota // All listeners are bound and serving, also sent after a reload.
+	EventReloading              // The routing table is being replaced.
+	EventStopping               // Shutdown started, in-flight requests are drained.
+	EventWatchdog               // Periodic keep-alive while serving, see WithWatchdog.
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventReady:
+		return "ready"
+	case EventReloading:
+		return "reloading"
+	case EventStopping:
+		return "stopping"
+	case EventWatchdog:
+		return "watchdog"
+	}
+
+	return fmt.Sprintf("event(%d)", int(e))
+}
+
+// Notifier is informed about lifecycle events, e.g. to report readiness to a
+// parent process or service manager.
+type Notifier interface {
+	Notify(event Event) error
+}
+
+type Option func(*Proxy)
+
+// WithWatchdog makes Run send EventWatchdog to the notifiers at half of the
+// given interval, the deadline after which a service manager considers the
+// process hung.
+func WithWatchdog(interval time.Duration) Option {
+	return func(p *Proxy) {
+		p.watchdogInterval = interval
+	}
 }
 
-func New(cfg *proxyCfg.Config) *Proxy {
+// WithListenFunc replaces net.Listen for the proxy and admin listeners.
+func WithListenFunc(fn ListenFunc) Option {
+	return func(p *Proxy) {
+		p.listen = fn
+	}
+}
+
+// WithNotifier adds a notifier for lifecycle events. It can be used several times.
+func WithNotifier(n Notifier) Option {
+	return func(p *Proxy) {
+		p.notifiers = append(p.notifiers, n)
+	}
+}
+
+func New(cfg *proxyCfg.Config, opts ...Option) *Proxy {
 	p := &Proxy{
-		cfg: cfg,
-		server: &http.Server{
-			Addr:           cfg.Server.Listen,
-			ReadTimeout:    cfg.Server.ReadTimeout,
-			WriteTimeout:   cfg.Server.WriteTimeout,
-			IdleTimeout:    cfg.Server.IdleTimeout,
-			MaxHeaderBytes: int(cfg.Server.MaxHeaderBytes),
-		},
-		router: &Router{
-			exact:     make(map[string]*route),
-			wildcards: make(map[string]*route),
-		},
+		cfg:         cfg,
+		router:      newRouter(),
 		middlewares: make([]middleware.Middleware, 0),
+		bufferPool:  newBufferPool(int(cfg.Server.BufferSize)),
+		listen:      net.Listen,
+	}
+
+	for _, opt := range opts {
+		opt(p)
 	}
 
-	p.server.Handler = http.HandlerFunc(p.serveHTTP)
+	if cfg.AccessLog != nil {
+		p.accessLogger = accesslog.NewLogger(&accesslog.AccessLogConfig{Format: cfg.AccessLog.Format})
+	}
+
+	if cfg.Admin != nil {
+		p.admin = newAdminServer(cfg.Admin)
+	}
+
+	if cfg.Tracing != nil {
+		p.tracer = tracing.NewTracer(&tracing.Config{
+			ServiceName:   cfg.Tracing.ServiceName,
+			Endpoint:      cfg.Tracing.Endpoint,
+			Headers:       cfg.Tracing.Headers,
+			SampleRatio:   cfg.Tracing.SampleRatio,
+			Propagators:   cfg.Tracing.Propagators,
+			BatchSize:     cfg.Tracing.BatchSize,
+			FlushInterval: cfg.Tracing.FlushInterval,
+			Timeout:       cfg.Tracing.Timeout,
+		})
+	}
+
+	listenerCfgs := cfg.Listeners
+	if len(listenerCfgs) == 0 {
+		listenerCfgs = []*proxyCfg.ListenerConfig{defaultListener(cfg.Server)}
+	}
+
+	for _, lc := range listenerCfgs {
+		l := newListener(lc, cfg.Server)
+		l.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.serveHTTP(w, r, l)
+		})
+
+		p.listeners = append(p.listeners, l)
+	}
 
 	return p
 }
 
-func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request, l *listener) {
 	if r.Host == "" {
 		http.Error(w, "Missing Host header", http.StatusBadRequest)
 		return
 	}
 
-	route, ok := p.router.lookup(r.Host)
+	route, ok := p.router.lookup(r.Host, l.allowedRoutes())
 	if !ok {
+		metrics.UnmatchedRequests.WithLabelValues().Inc()
 		http.Error(w, "No route found for host", http.StatusNotFound)
 		return
 	}
 
-	var accessLogger *accesslog.AccessLogger
-	if p.cfg.AccessLog != nil {
-		accessLogger = accesslog.NewLogger(&accesslog.AccessLogConfig{Format: p.cfg.AccessLog.Format})
-	}
-
-	route.handle(w, r, p.cfg, p.middlewares, accessLogger)
+	route.handler.ServeHTTP(w, r)
 }
 
 func (p *Proxy) Run(ctx context.Context) error {
-	errChan := make(chan error, 1)
-	go func() {
-		if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errChan <- err
+	for _, l := range p.listeners {
+		if err := l.loadTLS(); err != nil {
+			return err
+		}
+	}
+
+	// All sockets are bound before serving, so a busy address fails the start
+	// instead of leaving the proxy partially reachable.
+	sockets := make([]net.Listener, 0, len(p.listeners)+1)
+	closeSockets := func() {
+		for _, ln := range sockets {
+			ln.Close()
+		}
+	}
+
+	for _, l := range p.listeners {
+		ln, err := p.listen("tcp", l.server.Addr)
+		if err != nil {
+			closeSockets()
+			return fmt.Errorf("failed to listen on %s: %w", l.server.Addr, err)
+		}
+		sockets = append(sockets, ln)
+	}
+
+	var adminLn net.Listener
+	if p.admin != nil {
+		var err error
+		adminLn, err = p.listen("tcp", p.admin.server.Addr)
+		if err != nil {
+			closeSockets()
+			return fmt.Errorf("failed to listen on %s: %w", p.admin.server.Addr, err)
+		}
+	}
+
+	errChan := make(chan error, len(p.listeners)+1)
+
+	for i, l := range p.listeners {
+		go func(ln net.Listener) {
+			slog.Info("starting listener",
+				slog.String("name", l.cfg.Name),
+				slog.String("addr", l.server.Addr),
+				slog.Bool("tls", l.cfg.TLS != nil),
+			)
+
+			var err error
+			if l.cfg.TLS != nil {
+				err = l.server.ServeTLS(ln, "", "")
+			} else {
+				err = l.server.Serve(ln)
+			}
+
+			if err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("listener %s: %w", l.cfg.Name, err)
+			}
+		}(sockets[i])
+	}
+
+	if p.admin != nil {
+		go func() {
+			slog.Info("starting admin server", slog.String("addr", p.admin.server.Addr))
+
+			if err := p.admin.server.Serve(adminLn); err != nil && err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("admin server: %w", err)
+			}
+		}()
+	}
+
+	p.serving.Store(true)
+	p.notify(EventReady)
+
+	var watchdog <-chan time.Time
+	if p.watchdogInterval > 0 {
+		ticker := time.NewTicker(p.watchdogInterval / 2)
+		defer ticker.Stop()
+
+		watchdog = ticker.C
+	}
+
+	var runErr error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case runErr = <-errChan:
+			break loop
+		case <-watchdog:
+			p.notify(EventWatchdog)
+		}
+	}
+
+	p.serving.Store(false)
+	p.notify(EventStopping)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), p.cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if p.admin != nil {
+		if err := p.admin.server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to shutdown admin server", logger.Error(err))
+		}
+	}
+
+	// Listeners drain concurrently, so all of them share the shutdown timeout.
+	var wg sync.WaitGroup
+	shutdownErrs := make([]error, len(p.listeners))
+
+	for i, l := range p.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownErrs[i] = l.server.Shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(shutdownErrs...); err != nil && runErr == nil {
+		runErr = err
+	}
+
+	if p.tracer != nil {
+		if err := p.tracer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to flush traces", logger.Error(err))
 		}
-	}()
+	}
+
+	return runErr
+}
 
-	select {
-	case <-ctx.Done():
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), p.cfg.Server.ShutdownTimeout)
-		defer cancel()
-		return p.server.Shutdown(shutdownCtx)
-	case err := <-errChan:
-		return err
+func (p *Proxy) notify(event Event) {
+	for _, n := range p.notifiers {
+		if err := n.Notify(event); err != nil {
+			slog.Error("failed to notify lifecycle event", slog.String("event", event.String()), logger.Error(err))
+		}
 	}
 }
 
-func (p *Proxy) Route(host string, backend string, opts ...RouteOption) {
+func (p *Proxy) Route(host string, backend string, opts ...RouteOption) error {
 	backendURL, err := url.Parse(backend)
 	if err != nil {
-		slog.Error("failed to parse backend url", logger.Error(err))
+		return fmt.Errorf("failed to parse backend url of route %s: %w", host, err)
 	}
 
-	route := newRoute(backendURL, opts...)
-	p.router.add(host, route)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	route := newRoute(host, backendURL, opts...)
+	route.build(p)
+
+	if old := p.router.add(host, route); old != nil {
+		old.transport.CloseIdleConnections()
+	}
+	p.routesModified = true
 
 	slog.Info("route registered", slog.String("host", host), slog.String("backend", backend))
+
+	return nil
+}
+
+// RouteDefinition describes a route passed to Reload.
+type RouteDefinition struct {
+	Host    string
+	Backend string
+	Options []RouteOption
+}
+
+// Reload replaces the global middlewares and the whole routing table. The new
+// routes and their handler chains are built first and then swapped in at once,
+// so every request is served either entirely by the old or by the new
+// configuration. If any backend URL is invalid the current routes are kept.
+//
+// Health statistics and the drain state are carried over for routes whose
+// backend did not change.
+func (p *Proxy) Reload(middlewares []middleware.Middleware, routes []RouteDefinition) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.serving.Load() {
+		p.notify(EventReloading)
+		defer p.notify(EventReady)
+	}
+
+	next := newRouter()
+
+	prevMiddlewares := p.middlewares
+	p.middlewares = middlewares
+
+	for _, def := range routes {
+		backendURL, err := url.Parse(def.Backend)
+		if err != nil {
+			p.middlewares = prevMiddlewares
+			return fmt.Errorf("failed to parse backend url of route %s: %w", def.Host, err)
+		}
+
+		route := newRoute(def.Host, backendURL, def.Options...)
+		if old, ok := p.router.get(def.Host); ok && old.backend.String() == route.backend.String() {
+			route.health = old.health
+		}
+
+		route.build(p)
+		next.add(def.Host, route)
+	}
+
+	for _, old := range p.router.replace(next) {
+		old.transport.CloseIdleConnections()
+	}
+	p.routesModified = false
+
+	slog.Info("routing table updated", slog.Int("routes", len(routes)), slog.Int("middlewares", len(middlewares)))
+
+	return nil
+}
+
+// RoutesModified reports whether routes were added, replaced or removed with
+// Route or RemoveRoute since the last Reload.
+func (p *Proxy) RoutesModified() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.routesModified
 }
 
+// SetListenerRoutes replaces the route hosts served by the listener with this
+// name, an empty list serves every route. The other listener settings can only
+// be changed by a restart.
+func (p *Proxy) SetListenerRoutes(name string, hosts []string) error {
+	for _, l := range p.listeners {
+		if l.cfg.Name == name {
+			l.setRoutes(hosts)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown listener: %s", name)
+}
+
+// RemoveRoute unregisters the route for the host. Requests already being
+// handled by the route are completed. It reports whether the route existed.
+func (p *Proxy) RemoveRoute(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	route, ok := p.router.remove(host)
+	if !ok {
+		return false
+	}
+
+	route.transport.CloseIdleConnections()
+	p.routesModified = true
+
+	slog.Info("route removed", slog.String("host", host))
+
+	return true
+}
+
+// RouteInfo describes a registered route for runtime inspection.
+type RouteInfo struct {
+	Host        string            `json:"host"`
+	Backend     string            `json:"backend"`
+	Middlewares []middleware.Type `json:"middlewares"`
+	Health      HealthStatus      `json:"health"`
+}
+
+// Routes returns a snapshot of all registered routes sorted by host.
+func (p *Proxy) Routes() []RouteInfo {
+	routes := make([]RouteInfo, 0)
+
+	p.router.each(func(_ string, rt *route) {
+		routes = append(routes, RouteInfo{
+			Host:        rt.host,
+			Backend:     rt.backend.String(),
+			Middlewares: rt.chain,
+			Health:      rt.health.snapshot(),
+		})
+	})
+
+	slices.SortFunc(routes, func(a, b RouteInfo) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+
+	return routes
+}
+
+// DrainBackend marks every route pointing to the backend as draining (or
+// clears the mark). Draining routes answer new requests with 503 while the
+// in-flight ones complete. It returns the number of affected routes.
+func (p *Proxy) DrainBackend(backend string, drain bool) int {
+	affected := 0
+
+	p.router.each(func(_ string, rt *route) {
+		if strings.TrimSuffix(rt.backend.String(), "/") == strings.TrimSuffix(backend, "/") {
+			rt.health.draining.Store(drain)
+			affected++
+		}
+	})
+
+	if affected > 0 {
+		slog.Info("backend drain state changed", slog.String("backend", backend), slog.Bool("draining", drain))
+	}
+
+	return affected
+}
+
+// AdminHandle registers a handler on the admin listener. It returns false if
+// the admin listener is not configured.
+func (p *Proxy) AdminHandle(pattern string, handler http.Handler) bool {
+	if p.admin == nil {
+		return false
+	}
+
+	p.admin.mux.Handle(pattern, handler)
+
+	return true
+}
+
+// Use appends global middlewares. Routes that are already registered get their
+// handler chains rebuilt, so Use must be called before the proxy starts serving.
 func (p *Proxy) Use(middlewares ...middleware.Middleware) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.middlewares = append(p.middlewares, middlewares...)
+
+	p.router.each(func(_ string, rt *route) {
+		rt.build(p)
+	})
 }
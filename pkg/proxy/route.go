@@ -1,26 +1,38 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"path"
+	"strings"
 	"time"
 
+	"github.com/haadi-coder/reverse-proxy/internal/lib/hopheader"
 	"github.com/haadi-coder/reverse-proxy/internal/lib/logger"
 	"github.com/haadi-coder/reverse-proxy/pkg/accesslog"
+	"github.com/haadi-coder/reverse-proxy/pkg/metrics"
 	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
-	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+	"github.com/haadi-coder/reverse-proxy/pkg/tracing"
 )
 
 type route struct {
+	host         string
 	backend      *url.URL
 	transport    *http.Transport
 	preserveHost bool
+	stripPrefix  string
+	addPrefix    string
+	via          string
+	bufferPool   *bufferPool
+	tracer       *tracing.Tracer
 	middlewares  []middleware.Middleware
+	merged       []middleware.Middleware // Global and route middlewares after mergeMiddlewares.
+	chain        []middleware.Type
+	health       *backendHealth
+	handler      http.Handler
 }
 
 type RouteOption func(r *route)
@@ -31,6 +43,21 @@ func WithPreserveHost(preserve bool) RouteOption {
 	}
 }
 
+// WithStripPrefix removes the given prefix from the request path before it is
+// forwarded, so a service can be mounted under a sub-path (e.g. "/api").
+func WithStripPrefix(prefix string) RouteOption {
+	return func(r *route) {
+		r.stripPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithAddPrefix prepends the given prefix to the request path before it is forwarded.
+func WithAddPrefix(prefix string) RouteOption {
+	return func(r *route) {
+		r.addPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
 func WithIdleConnTimeout(timeout time.Duration) RouteOption {
 	return func(r *route) {
 		r.transport.IdleConnTimeout = timeout
@@ -61,15 +88,21 @@ func WithMiddlewares(middlewares ...middleware.Middleware) RouteOption {
 	}
 }
 
-func newRoute(backend *url.URL, opts ...RouteOption) *route {
+func newRoute(host string, backend *url.URL, opts ...RouteOption) *route {
 	route := &route{
+		host:         host,
 		backend:      backend,
 		preserveHost: true,
 		middlewares:  []middleware.Middleware{},
+		health:       &backendHealth{},
 		transport: &http.Transport{
 			ResponseHeaderTimeout: 30 * time.Second,
 			IdleConnTimeout:       90 * time.Second,
 			MaxIdleConns:          100,
+			// Requests with "Expect: 100-continue" wait for the backend's interim
+			// response before the body is sent, so a rejecting backend never
+			// causes the proxy to read the client body.
+			ExpectContinueTimeout: 1 * time.Second,
 		},
 	}
 
@@ -77,27 +110,155 @@ func newRoute(backend *url.URL, opts ...RouteOption) *route {
 		opt(route)
 	}
 
+	dial := route.transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	route.transport.DialContext = instrumentDial(backend.Host, dial)
+
 	return route
 }
 
-func (rt *route) handle(w http.ResponseWriter, r *http.Request, cfg *proxyCfg.Config, globalMws []middleware.Middleware, accessLogger *accesslog.AccessLogger) {
-	backendURL := *rt.backend
-	backendURL.Path = path.Join(backendURL.Path, r.URL.Path)
-	backendURL.RawQuery = r.URL.RawQuery
+// build precompiles the full handler chain of the route: access log, internal
+// middlewares, the merged user middlewares and the backend handler. It is
+// called once when the route is registered, so serving a request only walks
+// the already wrapped handlers.
+func (rt *route) build(p *Proxy) {
+	rt.via = p.cfg.Server.Via
+	rt.bufferPool = p.bufferPool
+	rt.tracer = p.tracer
 
-	backendReq, err := http.NewRequestWithContext(r.Context(), r.Method, backendURL.String(), r.Body)
+	userMiddlewares := mergeMiddlewares(p.middlewares, rt.middlewares)
+	handler := applyMiddlewares(http.HandlerFunc(rt.serveBackend), userMiddlewares)
+
+	rt.merged = userMiddlewares
+
+	rt.chain = make([]middleware.Type, 0, len(userMiddlewares))
+	for _, mw := range userMiddlewares {
+		rt.chain = append(rt.chain, mw.Type())
+	}
+
+	internalMws := []internalMiddleware{
+		&metricsMiddleware{route: rt.host, backend: rt.backend.Host},
+		&recoveryMiddleware{},
+		&maxRequestBodyMiddleware{maxBytes: p.cfg.Server.MaxRequestBody},
+	}
+	if p.tracer != nil {
+		internalMws = append([]internalMiddleware{
+			&tracingMiddleware{tracer: p.tracer, route: rt.host, backend: rt.backend.Host},
+		}, internalMws...)
+	}
+
+	handler = applyInternalMiddlewares(handler, internalMws)
+
+	if p.accessLogger != nil {
+		accesslogMw := &accesslog.Middleware{Logger: p.accessLogger}
+		handler = accesslogMw.Handler(handler)
+	}
+
+	rt.handler = handler
+}
+
+// serveBackend forwards the request to the backend and streams the response back.
+// The backend request is built here, at the end of the chain, so that changes
+// made by middlewares (rewritten path, modified headers) reach the backend.
+func (rt *route) serveBackend(w http.ResponseWriter, r *http.Request) {
+	if rt.health.draining.Load() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Backend is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	rt.health.inFlight.Add(1)
+	defer rt.health.inFlight.Add(-1)
+
+	backendReq, err := rt.newBackendRequest(r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create backend request: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 
-	for k, vv := range r.Header {
-		for _, v := range vv {
-			backendReq.Header.Add(k, v)
+	// RoundTrip is used instead of http.Client so that backend redirects and
+	// cookies are passed through to the client untouched.
+	span := rt.startUpstreamSpan(r, backendReq)
+	if span != nil {
+		defer span.End()
+	}
+
+	start := time.Now()
+
+	resp, err := rt.transport.RoundTrip(backendReq)
+
+	// The client exceeded max_request_body, the backend is not to blame.
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(rt.host, rt.backend.Host).Inc()
+		rt.health.recordFailure(err)
+		if span != nil {
+			span.SetError(err.Error())
+		}
+
+		http.Error(w, fmt.Sprintf("Failed to do request: %s", err.Error()), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	rt.health.recordSuccess()
+
+	if span != nil {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetError(resp.Status)
 		}
 	}
 
+	metrics.UpstreamDuration.WithLabelValues(rt.host, rt.backend.Host).Observe(time.Since(start).Seconds())
+	metrics.UpstreamRequestsTotal.WithLabelValues(rt.host, rt.backend.Host, metrics.StatusClass(resp.StatusCode)).Inc()
+
+	hopheader.Remove(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor, rt.via)
+
+	announced := announceTrailers(w, resp)
+	w.WriteHeader(resp.StatusCode)
+
+	_, err = rt.bufferPool.copyBuffered(w, resp.Body)
+	if err != nil {
+		slog.Error("Failed to copy response body", logger.Error(err))
+	}
+
+	copyTrailers(w, resp, announced)
+}
+
+// newBackendRequest builds the request sent to the backend: the upstream URL,
+// the original body framing and the forwarded headers.
+func (rt *route) newBackendRequest(r *http.Request) (*http.Request, error) {
+	backendURL := rt.upstreamURL(r.URL)
+
+	backendReq, err := http.NewRequestWithContext(r.Context(), r.Method, backendURL.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the original framing: a known length is forwarded as is instead of
+	// being re-encoded as chunked, and an empty body is not sent at all.
+	backendReq.ContentLength = r.ContentLength
+	if r.ContentLength == 0 {
+		backendReq.Body = http.NoBody
+	}
+
+	prepareRequestHeaders(backendReq.Header, r.Header)
 	addForwardedHeaders(backendReq, r)
+	addVia(backendReq.Header, r.ProtoMajor, r.ProtoMinor, rt.via)
+
+	if rt.stripPrefix != "" && hasPathPrefix(r.URL.EscapedPath(), rt.stripPrefix) {
+		backendReq.Header.Set("X-Forwarded-Prefix", rt.stripPrefix)
+	}
 
 	if rt.preserveHost {
 		backendReq.Host = r.Host
@@ -105,43 +266,70 @@ func (rt *route) handle(w http.ResponseWriter, r *http.Request, cfg *proxyCfg.Co
 		backendReq.Host = rt.backend.Host
 	}
 
-	baseHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		client := &http.Client{Transport: rt.transport}
-		resp, err := client.Do(backendReq)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to do request: %s", err.Error()), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
+	return backendReq, nil
+}
+
+// upstreamURL builds the backend URL for the request. It works on the escaped
+// path, so trailing slashes, repeated slashes and encoded characters such as
+// %2F reach the backend exactly as the client sent them.
+func (rt *route) upstreamURL(reqURL *url.URL) *url.URL {
+	reqPath := reqURL.EscapedPath()
 
-		for k, vv := range resp.Header {
-			for _, v := range vv {
-				w.Header().Add(k, v)
-			}
+	if rt.stripPrefix != "" && hasPathPrefix(reqPath, rt.stripPrefix) {
+		reqPath = reqPath[len(rt.stripPrefix):]
+		if !strings.HasPrefix(reqPath, "/") {
+			reqPath = "/" + reqPath
 		}
-		w.WriteHeader(resp.StatusCode)
+	}
+
+	if rt.addPrefix != "" {
+		reqPath = rt.addPrefix + reqPath
+	}
+
+	target := *rt.backend
+	target.RawQuery = reqURL.RawQuery
+	target.RawPath = joinURLPath(rt.backend.EscapedPath(), reqPath)
+
+	decoded, err := url.PathUnescape(target.RawPath)
+	if err != nil {
+		decoded = target.RawPath
+	}
+	target.Path = decoded
 
-		_, err = io.Copy(w, resp.Body)
-		if err != nil {
-			slog.Error("Failed to copy response body", logger.Error(err))
+	return &target
+}
+
+// joinURLPath joins two escaped paths with exactly one slash between them,
+// leaving everything else (including a trailing slash) untouched.
+func joinURLPath(a, b string) string {
+	if b == "" {
+		if a == "" {
+			return "/"
 		}
-	})
+		return a
+	}
 
-	userMiddlewares := mergeMiddlewares(globalMws, rt.middlewares)
-	handler := applyMiddlewares(baseHandler, userMiddlewares)
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
 
-	internalMws := []internalMiddleware{
-		&maxRequestBodyMiddleware{maxBytes: cfg.Server.MaxHeaderBytes},
-		&recoveryMiddleware{},
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
 	}
-	handler = applyInternalMiddlewares(handler, internalMws)
 
-	if accessLogger != nil {
-		accesslogMw := &accesslog.Middleware{Logger: accessLogger}
-		handler = accesslogMw.Handler(handler)
+	return a + b
+}
+
+// hasPathPrefix reports whether p starts with prefix on a path segment
+// boundary, so "/api" matches "/api" and "/api/users" but not "/apiv2".
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
 	}
 
-	handler.ServeHTTP(w, r)
+	return len(p) == len(prefix) || p[len(prefix)] == '/'
 }
 
 func mergeMiddlewares(global, route []middleware.Middleware) []middleware.Middleware {
@@ -192,7 +380,11 @@ func addForwardedHeaders(backendReq *http.Request, originalReq *http.Request) {
 
 	backendReq.Header.Set("X-Forwarded-For", clientIP)
 	backendReq.Header.Set("X-Forwarded-Host", originalReq.Host)
-	backendReq.Header.Set("X-Forwarded-Proto", "http")
+	proto := "http"
+	if originalReq.TLS != nil {
+		proto = "https"
+	}
+	backendReq.Header.Set("X-Forwarded-Proto", proto)
 }
 
 func getClientIP(r *http.Request) string {
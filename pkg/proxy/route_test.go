@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/middleware"
+	proxyCfg "github.com/haadi-coder/reverse-proxy/pkg/proxy/config"
+)
+
+// BenchmarkServeHTTP measures the per-request cost of the proxy itself: route
+// lookup, the precompiled middleware chain and the backend round trip.
+func BenchmarkServeHTTP(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	benchmarks := []struct {
+		name        string
+		middlewares []middleware.Middleware
+	}{
+		{name: "no middlewares"},
+		{name: "middlewares", middlewares: []middleware.Middleware{
+			middleware.RequestID(&middleware.RequestIDConfig{HeaderName: "X-Request-ID"}),
+			middleware.SecurityHeaders(&middleware.SecurityHeadersConfig{ContentTypeOptions: "nosniff"}),
+			middleware.Headers(&middleware.HeadersConfig{
+				Request: &middleware.HeaderRules{Set: map[string]string{"X-Proxy": "rp"}},
+			}),
+		}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			p := New(&proxyCfg.Config{Server: &proxyCfg.ServerConfig{}})
+			err := p.Reload(bm.middlewares, []RouteDefinition{{Host: testHost, Backend: upstream.URL}})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			l := p.listeners[0]
+			req := httptest.NewRequest(http.MethodGet, "http://"+testHost+"/path?q=1", nil)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				w := httptest.NewRecorder()
+				p.serveHTTP(w, req, l)
+
+				if w.Code != http.StatusOK {
+					b.Fatalf("status = %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+// TestMaxRequestBody checks that request bodies are limited by
+// max_request_body, independent of max_header_bytes.
+func TestMaxRequestBody(t *testing.T) {
+	var received atomic.Int64
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+	}))
+	defer upstream.Close()
+
+	p := New(&proxyCfg.Config{Server: &proxyCfg.ServerConfig{MaxHeaderBytes: 1 << 20, MaxRequestBody: 16}})
+	if err := p.Reload(nil, []RouteDefinition{{Host: testHost, Backend: upstream.URL}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{name: "within the limit", size: 16, status: http.StatusOK},
+		{name: "over the limit", size: 17, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received.Store(0)
+
+			req := httptest.NewRequest(http.MethodPost, "http://"+testHost+"/", strings.NewReader(strings.Repeat("x", tt.size)))
+			w := httptest.NewRecorder()
+			p.serveHTTP(w, req, p.listeners[0])
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && received.Load() != int64(tt.size) {
+				t.Errorf("the backend received %d bytes, want %d", received.Load(), tt.size)
+			}
+		})
+	}
+}
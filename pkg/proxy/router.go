@@ -11,44 +11,63 @@ type Router struct {
 	mu        sync.RWMutex
 }
 
-func (r *Router) add(host string, route *route) {
+func newRouter() *Router {
+	return &Router{
+		exact:     make(map[string]*route),
+		wildcards: make(map[string]*route),
+	}
+}
+
+// add registers the route for the host and returns the route it replaced, if any.
+func (r *Router) add(host string, route *route) *route {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	prepared := prepareHost(host)
 
+	routes := r.exact
 	if isWildcard(prepared) {
-		r.wildcards[prepared] = route
-	} else {
-		r.exact[prepared] = route
+		routes = r.wildcards
 	}
+
+	old := routes[prepared]
+	routes[prepared] = route
+
+	return old
 }
 
-func (r *Router) remove(host string) {
+// remove unregisters the route for the host and returns it.
+func (r *Router) remove(host string) (*route, bool) {
 	prepared := prepareHost(host)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	routes := r.exact
 	if isWildcard(prepared) {
-		delete(r.wildcards, prepared)
-	} else {
-		delete(r.exact, prepared)
+		routes = r.wildcards
 	}
+
+	route, ok := routes[prepared]
+	delete(routes, prepared)
+
+	return route, ok
 }
 
-func (r *Router) lookup(host string) (*route, bool) {
+// lookup finds the route for the request host among the allowed host
+// patterns. A nil allowed set permits every route.
+func (r *Router) lookup(host string, allowed map[string]bool) (*route, bool) {
 	prepared := prepareHost(host)
 
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	if route, ok := r.exact[prepared]; ok {
+	if route, ok := r.exact[prepared]; ok && (allowed == nil || allowed[prepared]) {
 		return route, true
 	}
 
 	for pattern, route := range r.wildcards {
-		if matchWildcard(prepared, pattern) {
+		if matchWildcard(prepared, pattern) && (allowed == nil || allowed[pattern]) {
 			return route, true
 		}
 	}
@@ -56,6 +75,56 @@ func (r *Router) lookup(host string) (*route, bool) {
 	return nil, false
 }
 
+// get returns the route registered for exactly this host pattern.
+func (r *Router) get(host string) (*route, bool) {
+	prepared := prepareHost(host)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if isWildcard(prepared) {
+		route, ok := r.wildcards[prepared]
+		return route, ok
+	}
+
+	route, ok := r.exact[prepared]
+	return route, ok
+}
+
+// replace atomically swaps the routing table with the one of next and returns
+// the routes that were registered before.
+func (r *Router) replace(next *Router) []*route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := make([]*route, 0, len(r.exact)+len(r.wildcards))
+	for _, route := range r.exact {
+		old = append(old, route)
+	}
+	for _, route := range r.wildcards {
+		old = append(old, route)
+	}
+
+	r.exact = next.exact
+	r.wildcards = next.wildcards
+
+	return old
+}
+
+// each calls fn for every registered route.
+func (r *Router) each(fn func(host string, route *route)) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for host, route := range r.exact {
+		fn(host, route)
+	}
+
+	for host, route := range r.wildcards {
+		fn(host, route)
+	}
+}
+
 func prepareHost(host string) string {
 	host = strings.ToLower(host)
 
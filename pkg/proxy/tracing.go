@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/haadi-coder/reverse-proxy/pkg/tracing"
+)
+
+// tracingMiddleware starts the server span of a request. The parent trace
+// context is taken from the incoming headers and the span is stored in the
+// request context, so the backend round trip becomes its child.
+type tracingMiddleware struct {
+	tracer  *tracing.Tracer
+	route   string
+	backend string
+}
+
+func (m *tracingMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := m.tracer.Extract(r.Header)
+
+		span := m.tracer.Start(r.Method+" "+m.route, tracing.SpanKindServer, parent)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("server.address", r.Host)
+		span.SetAttribute("client.address", getClientIP(r))
+		span.SetAttribute("user_agent.original", r.UserAgent())
+		span.SetAttribute("rp.route", m.route)
+		span.SetAttribute("rp.backend", m.backend)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(tracing.ContextWithSpan(r.Context(), span)))
+
+		span.SetAttribute("http.response.status_code", sw.status)
+		if sw.status >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(sw.status))
+		}
+	})
+}
+
+// startUpstreamSpan starts the client span for the backend round trip and
+// injects its context into the backend request headers. It returns nil when
+// tracing is disabled.
+func (rt *route) startUpstreamSpan(r, backendReq *http.Request) *tracing.Span {
+	if rt.tracer == nil {
+		return nil
+	}
+
+	var parent tracing.SpanContext
+	if serverSpan := tracing.SpanFromContext(r.Context()); serverSpan != nil {
+		parent = serverSpan.Context()
+	}
+
+	span := rt.tracer.Start(backendReq.Method, tracing.SpanKindClient, parent)
+	span.SetAttribute("http.request.method", backendReq.Method)
+	span.SetAttribute("url.full", backendReq.URL.String())
+	span.SetAttribute("server.address", rt.backend.Host)
+	span.SetAttribute("rp.route", rt.host)
+
+	rt.tracer.Inject(backendReq.Header, span.Context())
+
+	return span
+}
@@ -0,0 +1,192 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector that records the
+// export requests it receives.
+type collector struct {
+	mu       sync.Mutex
+	requests []*otlpRequest
+	headers  []http.Header
+	status   int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requests = append(c.requests, &req)
+	c.headers = append(c.headers, r.Header.Clone())
+
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+}
+
+func (c *collector) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+
+	return spans
+}
+
+func newTestTracer(t *testing.T, c *collector, batchSize int) *Tracer {
+	t.Helper()
+
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+
+	return NewTracer(&Config{
+		ServiceName:   "rp-test",
+		Endpoint:      srv.URL + "/v1/traces",
+		Headers:       map[string]string{"Authorization": "Bearer secret"},
+		SampleRatio:   1,
+		Propagators:   []string{PropagatorTraceContext},
+		BatchSize:     batchSize,
+		FlushInterval: time.Hour,
+		Timeout:       time.Second,
+	})
+}
+
+func shutdown(t *testing.T, tracer *Tracer) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	tracer := newTestTracer(t, c, 10)
+
+	parent, _ := extract(http.Header{"Traceparent": {"00-" + testTraceID + "-" + testSpanID + "-01"}}, []string{PropagatorTraceContext})
+
+	server := tracer.Start("GET example.com", SpanKindServer, parent)
+	server.SetAttribute("http.request.method", "GET")
+	server.SetAttribute("http.response.status_code", 502)
+
+	client := tracer.Start("upstream", SpanKindClient, server.Context())
+	client.SetError("connection refused")
+	client.End()
+	server.End()
+
+	shutdown(t, tracer)
+
+	c.mu.Lock()
+	if len(c.requests) != 1 {
+		t.Fatalf("got %d export requests, want 1", len(c.requests))
+	}
+	if got := c.headers[0].Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if got := c.headers[0].Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	resource := c.requests[0].ResourceSpans[0].Resource
+	c.mu.Unlock()
+
+	if len(resource.Attributes) != 1 || *resource.Attributes[0].Value.StringValue != "rp-test" {
+		t.Errorf("unexpected resource attributes: %+v", resource.Attributes)
+	}
+
+	spans := c.spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+
+	clientSpan, serverSpan := spans[0], spans[1]
+
+	if serverSpan.Name != "GET example.com" || serverSpan.Kind != SpanKindServer {
+		t.Errorf("server span: name %q kind %d", serverSpan.Name, serverSpan.Kind)
+	}
+	if serverSpan.TraceID != testTraceID || serverSpan.ParentSpanID != testSpanID {
+		t.Errorf("server span: trace %s parent %s", serverSpan.TraceID, serverSpan.ParentSpanID)
+	}
+	if len(serverSpan.Attributes) != 2 || *serverSpan.Attributes[1].Value.IntValue != "502" {
+		t.Errorf("server span attributes: %+v", serverSpan.Attributes)
+	}
+
+	if clientSpan.TraceID != testTraceID || clientSpan.ParentSpanID != serverSpan.SpanID {
+		t.Errorf("client span: trace %s parent %s", clientSpan.TraceID, clientSpan.ParentSpanID)
+	}
+	if clientSpan.Status.Code != statusCodeError || clientSpan.Status.Message != "connection refused" {
+		t.Errorf("client span status: %+v", clientSpan.Status)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	c := &collector{}
+	tracer := newTestTracer(t, c, 2)
+
+	for range 5 {
+		tracer.Start("span", SpanKindServer, SpanContext{}).End()
+	}
+
+	shutdown(t, tracer)
+
+	c.mu.Lock()
+	requests := len(c.requests)
+	c.mu.Unlock()
+
+	if requests != 3 {
+		t.Errorf("got %d export requests, want 3", requests)
+	}
+	if spans := len(c.spans()); spans != 5 {
+		t.Errorf("got %d spans, want 5", spans)
+	}
+}
+
+func TestExportSkipsUnsampled(t *testing.T) {
+	c := &collector{}
+	tracer := newTestTracer(t, c, 10)
+
+	parent, _ := extract(http.Header{"Traceparent": {"00-" + testTraceID + "-" + testSpanID + "-00"}}, []string{PropagatorTraceContext})
+	tracer.Start("unsampled", SpanKindServer, parent).End()
+
+	shutdown(t, tracer)
+
+	if spans := len(c.spans()); spans != 0 {
+		t.Errorf("got %d spans, want 0", spans)
+	}
+}
+
+func TestExportCollectorError(t *testing.T) {
+	c := &collector{status: http.StatusServiceUnavailable}
+	tracer := newTestTracer(t, c, 10)
+
+	span := tracer.Start("span", SpanKindServer, SpanContext{})
+	span.End()
+
+	if err := tracer.exporter.export([]*Span{span}); err == nil {
+		t.Error("expected an error for a failing collector")
+	}
+
+	shutdown(t, tracer)
+}
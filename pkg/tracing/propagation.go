@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Propagator names accepted in Config.Propagators.
+const (
+	PropagatorTraceContext = "tracecontext" // W3C traceparent/tracestate headers.
+	PropagatorB3           = "b3"           // Zipkin B3 single and multi headers.
+)
+
+const (
+	headerTraceparent = "Traceparent"
+	headerTracestate  = "Tracestate"
+	headerB3          = "B3"
+	headerB3TraceID   = "X-B3-Traceid"
+	headerB3SpanID    = "X-B3-Spanid"
+	headerB3Sampled   = "X-B3-Sampled"
+	headerB3Flags     = "X-B3-Flags"
+	headerB3ParentID  = "X-B3-Parentspanid"
+)
+
+// extract reads the parent span context from the request headers, trying the
+// configured propagators in order.
+func extract(h http.Header, propagators []string) (SpanContext, bool) {
+	for _, p := range propagators {
+		var sc SpanContext
+		var ok bool
+
+		switch p {
+		case PropagatorTraceContext:
+			sc, ok = extractTraceContext(h)
+		case PropagatorB3:
+			sc, ok = extractB3(h)
+		}
+
+		if ok {
+			return sc, true
+		}
+	}
+
+	return SpanContext{}, false
+}
+
+// inject writes the span context into the outgoing headers for every
+// configured propagator, replacing any values received from the client.
+func inject(h http.Header, sc SpanContext, propagators []string) {
+	for _, p := range propagators {
+		switch p {
+		case PropagatorTraceContext:
+			h.Set(headerTraceparent, fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags))
+			if sc.TraceState != "" {
+				h.Set(headerTracestate, sc.TraceState)
+			} else {
+				h.Del(headerTracestate)
+			}
+
+		case PropagatorB3:
+			h.Del(headerB3)
+			h.Del(headerB3ParentID)
+			h.Del(headerB3Flags)
+			h.Set(headerB3TraceID, sc.TraceID.String())
+			h.Set(headerB3SpanID, sc.SpanID.String())
+			if sc.Sampled() {
+				h.Set(headerB3Sampled, "1")
+			} else {
+				h.Set(headerB3Sampled, "0")
+			}
+		}
+	}
+}
+
+// extractTraceContext parses the W3C traceparent header:
+// version "-" trace-id "-" parent-id "-" trace-flags.
+func extractTraceContext(h http.Header) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h.Get(headerTraceparent)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// Version 00 has exactly four fields; future versions may append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	if !decodeHex(parts[1], sc.TraceID[:]) || !decodeHex(parts[2], sc.SpanID[:]) {
+		return SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(parts[3], flags[:]) {
+		return SpanContext{}, false
+	}
+	sc.Flags = flags[0] & flagSampled
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	sc.TraceState = h.Get(headerTracestate)
+
+	return sc, true
+}
+
+// extractB3 parses either the single "b3" header
+// ({TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}) or the X-B3-* headers.
+func extractB3(h http.Header) (SpanContext, bool) {
+	var traceID, spanID, sampled string
+
+	if single := h.Get(headerB3); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return SpanContext{}, false
+		}
+		traceID, spanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceID = h.Get(headerB3TraceID)
+		spanID = h.Get(headerB3SpanID)
+		sampled = h.Get(headerB3Sampled)
+		if h.Get(headerB3Flags) == "1" {
+			sampled = "d"
+		}
+	}
+
+	// 64-bit trace IDs are left-padded to the 128-bit W3C size.
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+
+	var sc SpanContext
+	if !decodeHex(traceID, sc.TraceID[:]) || !decodeHex(spanID, sc.SpanID[:]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	switch sampled {
+	case "1", "d", "true":
+		sc.Flags = flagSampled
+	}
+
+	return sc, true
+}
+
+func decodeHex(s string, dst []byte) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
@@ -0,0 +1,185 @@
+package tracing
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestExtractTraceContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		ok          bool
+		sampled     bool
+	}{
+		{name: "sampled", traceparent: "00-" + testTraceID + "-" + testSpanID + "-01", ok: true, sampled: true},
+		{name: "not sampled", traceparent: "00-" + testTraceID + "-" + testSpanID + "-00", ok: true},
+		{name: "unknown flags are dropped", traceparent: "00-" + testTraceID + "-" + testSpanID + "-03", ok: true, sampled: true},
+		{name: "future version with more fields", traceparent: "01-" + testTraceID + "-" + testSpanID + "-01-extra", ok: true, sampled: true},
+		{name: "version 00 with more fields", traceparent: "00-" + testTraceID + "-" + testSpanID + "-01-extra"},
+		{name: "invalid version", traceparent: "ff-" + testTraceID + "-" + testSpanID + "-01"},
+		{name: "zero trace id", traceparent: "00-00000000000000000000000000000000-" + testSpanID + "-01"},
+		{name: "zero span id", traceparent: "00-" + testTraceID + "-0000000000000000-01"},
+		{name: "upper case", traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01"},
+		{name: "short trace id", traceparent: "00-4bf92f35-" + testSpanID + "-01"},
+		{name: "missing", traceparent: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("traceparent", tt.traceparent)
+			h.Set("tracestate", "vendor=value")
+
+			sc, ok := extract(h, []string{PropagatorTraceContext})
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			if sc.TraceID.String() != testTraceID || sc.SpanID.String() != testSpanID {
+				t.Errorf("got trace %s span %s", sc.TraceID, sc.SpanID)
+			}
+			if sc.Sampled() != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled(), tt.sampled)
+			}
+			if sc.TraceState != "vendor=value" {
+				t.Errorf("tracestate = %q", sc.TraceState)
+			}
+		})
+	}
+}
+
+func TestExtractB3(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		traceID string
+		ok      bool
+		sampled bool
+	}{
+		{
+			name:    "single header",
+			header:  http.Header{"B3": {testTraceID + "-" + testSpanID + "-1"}},
+			traceID: testTraceID, ok: true, sampled: true,
+		},
+		{
+			name:    "single header without sampling state",
+			header:  http.Header{"B3": {testTraceID + "-" + testSpanID}},
+			traceID: testTraceID, ok: true,
+		},
+		{
+			name: "multi headers",
+			header: http.Header{
+				"X-B3-Traceid": {testTraceID},
+				"X-B3-Spanid":  {testSpanID},
+				"X-B3-Sampled": {"1"},
+			},
+			traceID: testTraceID, ok: true, sampled: true,
+		},
+		{
+			name: "64-bit trace id",
+			header: http.Header{
+				"X-B3-Traceid": {"a3ce929d0e0e4736"},
+				"X-B3-Spanid":  {testSpanID},
+			},
+			traceID: "0000000000000000a3ce929d0e0e4736", ok: true,
+		},
+		{
+			name: "debug flag",
+			header: http.Header{
+				"X-B3-Traceid": {testTraceID},
+				"X-B3-Spanid":  {testSpanID},
+				"X-B3-Flags":   {"1"},
+			},
+			traceID: testTraceID, ok: true, sampled: true,
+		},
+		{
+			name:   "invalid span id",
+			header: http.Header{"B3": {testTraceID + "-xyz-1"}},
+		},
+		{
+			name:   "missing",
+			header: http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := extract(tt.header, []string{PropagatorB3})
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			if sc.TraceID.String() != tt.traceID || sc.SpanID.String() != testSpanID {
+				t.Errorf("got trace %s span %s", sc.TraceID, sc.SpanID)
+			}
+			if sc.Sampled() != tt.sampled {
+				t.Errorf("sampled = %v, want %v", sc.Sampled(), tt.sampled)
+			}
+		})
+	}
+}
+
+func TestExtractPropagatorOrder(t *testing.T) {
+	h := http.Header{}
+	h.Set("traceparent", "00-"+testTraceID+"-"+testSpanID+"-01")
+	h.Set("b3", "0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-0")
+
+	sc, ok := extract(h, []string{PropagatorB3, PropagatorTraceContext})
+	if !ok || sc.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("b3 was not preferred: %s, %v", sc.TraceID, ok)
+	}
+
+	sc, ok = extract(h, []string{PropagatorTraceContext, PropagatorB3})
+	if !ok || sc.TraceID.String() != testTraceID {
+		t.Errorf("tracecontext was not preferred: %s, %v", sc.TraceID, ok)
+	}
+}
+
+func TestInject(t *testing.T) {
+	sc, ok := extract(http.Header{"Traceparent": {"00-" + testTraceID + "-" + testSpanID + "-01"}}, []string{PropagatorTraceContext})
+	if !ok {
+		t.Fatal("failed to extract span context")
+	}
+
+	h := http.Header{}
+	h.Set("tracestate", "client=stale")
+	h.Set("b3", "client-supplied")
+	h.Set("X-B3-Parentspanid", "client-supplied")
+
+	inject(h, sc, []string{PropagatorTraceContext, PropagatorB3})
+
+	want := map[string]string{
+		"Traceparent":       "00-" + testTraceID + "-" + testSpanID + "-01",
+		"Tracestate":        "",
+		"B3":                "",
+		"X-B3-Parentspanid": "",
+		"X-B3-Traceid":      testTraceID,
+		"X-B3-Spanid":       testSpanID,
+		"X-B3-Sampled":      "1",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	// Injected headers are extracted again unchanged.
+	for _, p := range []string{PropagatorTraceContext, PropagatorB3} {
+		got, ok := extract(h, []string{p})
+		if !ok || got.TraceID != sc.TraceID || got.SpanID != sc.SpanID || got.Flags != sc.Flags {
+			t.Errorf("%s round trip: got %+v, want %+v", p, got, sc)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package tracing implements distributed tracing for the proxy: W3C trace
+// context (and optionally B3) propagation, server and client spans, and export
+// of finished spans to an OpenTelemetry collector over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const flagSampled byte = 0x01
+
+// TraceID is a 16-byte W3C trace identifier.
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID is an 8-byte W3C span identifier.
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that is propagated across process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+// IsValid reports whether both IDs are non-zero, as required by the W3C spec.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// SpanKind describes the relationship of the span to the remote side, using
+// the OTLP numeric values.
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = 2
+	SpanKindClient SpanKind = 3
+)
+
+// Config defines the tracer settings.
+type Config struct {
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g. "http://localhost:4318/v1/traces".
+	Endpoint string
+
+	// Headers are added to every export request, e.g. for collector authentication.
+	Headers map[string]string
+
+	// SampleRatio is the fraction of new traces (without a sampled parent) that
+	// are recorded, between 0 and 1. Incoming sampling decisions are always respected.
+	SampleRatio float64
+
+	// Propagators lists the header formats used to extract and inject the trace
+	// context: "tracecontext" and/or "b3".
+	Propagators []string
+
+	// BatchSize is the maximum number of spans sent in one export request.
+	BatchSize int
+
+	// FlushInterval is how often pending spans are exported.
+	FlushInterval time.Duration
+
+	// Timeout limits a single export request.
+	Timeout time.Duration
+}
+
+// Tracer creates spans and hands finished sampled spans to the exporter.
+type Tracer struct {
+	cfg       *Config
+	threshold uint64
+	exporter  *exporter
+}
+
+func NewTracer(cfg *Config) *Tracer {
+	return &Tracer{
+		cfg:       cfg,
+		threshold: ratioThreshold(cfg.SampleRatio),
+		exporter:  newExporter(cfg),
+	}
+}
+
+// Shutdown flushes pending spans and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.exporter.shutdown(ctx)
+}
+
+// Extract returns the parent span context carried by the request headers.
+func (t *Tracer) Extract(h http.Header) (SpanContext, bool) {
+	return extract(h, t.cfg.Propagators)
+}
+
+// Inject writes the span context into outgoing request headers.
+func (t *Tracer) Inject(h http.Header, sc SpanContext) {
+	inject(h, sc, t.cfg.Propagators)
+}
+
+// Start begins a new span. If parent is valid the span joins its trace and
+// inherits its sampling decision; otherwise a new trace is started and
+// sampled according to SampleRatio.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	if parent.IsValid() {
+		span.parentID = parent.SpanID
+		span.sc = SpanContext{
+			TraceID:    parent.TraceID,
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		}
+	} else {
+		span.sc.TraceID = newTraceID()
+		if t.shouldSample(span.sc.TraceID) {
+			span.sc.Flags = flagSampled
+		}
+	}
+
+	span.sc.SpanID = newSpanID()
+
+	return span
+}
+
+// shouldSample makes a deterministic decision from the trace ID, so every
+// service using the same ratio agrees on the same traces.
+func (t *Tracer) shouldSample(id TraceID) bool {
+	return binary.BigEndian.Uint64(id[8:]) < t.threshold
+}
+
+func ratioThreshold(ratio float64) uint64 {
+	switch {
+	case ratio >= 1:
+		return math.MaxUint64
+	case ratio <= 0:
+		return 0
+	}
+
+	return uint64(ratio * math.MaxUint64)
+}
+
+// Span is a single timed operation.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	sc       SpanContext
+	parentID SpanID
+	start    time.Time
+	end      time.Time
+
+	mu         sync.Mutex
+	attributes []attribute
+	statusCode int
+	statusMsg  string
+	ended      bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Context returns the span context to propagate to children.
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+// SetAttribute records a string, bool, int or float64 attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	if !s.sc.Sampled() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statusCode = statusCodeError
+	s.statusMsg = msg
+}
+
+// End finishes the span and queues it for export if it is sampled.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled() {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span stored by ContextWithSpan, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		_, _ = rand.Read(id[:])
+	}
+
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		_, _ = rand.Read(id[:])
+	}
+
+	return id
+}